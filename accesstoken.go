@@ -0,0 +1,315 @@
+package registry
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AccessTokenPrefix is the prefix of every access token, so access tokens can be told apart from passwords and found by secret scanners.
+const AccessTokenPrefix = "drat_"
+
+// AccessToken is a long-lived credential that is used as password in place of the real password of an account, like a personal access token of a developer or the credential of a robot account used in CI.
+type AccessToken struct {
+	// ID identifies the access token, it is not secret and is used to list and revoke access tokens.
+	ID string
+	// Name describes what the access token is used for.
+	Name string
+	// Subject is the account the access token authenticates as.
+	Subject string
+	// Robot marks the access token as the credential of a robot account, which is not a user known to other authenticators.
+	Robot bool
+	// Groups are the groups of the identity authenticated with a robot access token. Robot accounts are not known to other authenticators, so their groups are stored with the access token. For other access tokens the current groups of the subject are looked up on every use, and Groups is ignored.
+	Groups []string
+	// Scopes restricts the scopes the access token can be granted, see Identity.AllowedScopes. Nil means the access token is not restricted.
+	Scopes    []*Scope
+	CreatedAt time.Time
+	// ExpiresAt is the time the access token expires at, the zero time means the access token never expires.
+	ExpiresAt time.Time
+	// LastUsedAt is the time the access token was last used to authenticate, the zero time means it was never used.
+	LastUsedAt time.Time
+}
+
+// Expired checks if the access token has expired at the given time.
+func (t *AccessToken) Expired(now time.Time) bool {
+	return !t.ExpiresAt.IsZero() && !now.Before(t.ExpiresAt)
+}
+
+// AccessTokenStore is an interface for storing access tokens. The store only ever receives a hash of the access token, never the access token itself.
+type AccessTokenStore interface {
+	// Store stores the access token for the given access token hash.
+	Store(ctx context.Context, hash string, token *AccessToken) error
+	// Get returns the access token for the given access token hash. If the access token hash is unknown, an error is returned.
+	Get(ctx context.Context, hash string) (*AccessToken, error)
+	// List returns the access tokens of the given subject.
+	List(ctx context.Context, subject string) ([]*AccessToken, error)
+	// Touch sets the last used time of the access token with the given access token hash.
+	Touch(ctx context.Context, hash string, usedAt time.Time) error
+	// Delete deletes the access token with the given ID, deleting an unknown ID is not an error.
+	Delete(ctx context.Context, id string) error
+}
+
+// InMemoryAccessTokenStore is an AccessTokenStore that keeps the access tokens in memory, access tokens are lost when the process exits.
+type InMemoryAccessTokenStore struct {
+	mu     sync.RWMutex
+	tokens map[string]*AccessToken
+}
+
+// NewInMemoryAccessTokenStore creates a new InMemoryAccessTokenStore.
+func NewInMemoryAccessTokenStore() *InMemoryAccessTokenStore {
+	return &InMemoryAccessTokenStore{
+		tokens: make(map[string]*AccessToken),
+	}
+}
+
+func (s *InMemoryAccessTokenStore) Store(ctx context.Context, hash string, token *AccessToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copied := *token
+	s.tokens[hash] = &copied
+	return nil
+}
+
+func (s *InMemoryAccessTokenStore) Get(ctx context.Context, hash string) (*AccessToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	token, ok := s.tokens[hash]
+	if !ok {
+		return nil, fmt.Errorf("unknown access token")
+	}
+	copied := *token
+	return &copied, nil
+}
+
+func (s *InMemoryAccessTokenStore) List(ctx context.Context, subject string) ([]*AccessToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var tokens []*AccessToken
+	for _, token := range s.tokens {
+		if token.Subject == subject {
+			copied := *token
+			tokens = append(tokens, &copied)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.Before(tokens[j].CreatedAt)
+	})
+	return tokens, nil
+}
+
+func (s *InMemoryAccessTokenStore) Touch(ctx context.Context, hash string, usedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if token, ok := s.tokens[hash]; ok {
+		token.LastUsedAt = usedAt
+	}
+	return nil
+}
+
+func (s *InMemoryAccessTokenStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for hash, token := range s.tokens {
+		if token.ID == id {
+			delete(s.tokens, hash)
+		}
+	}
+	return nil
+}
+
+// AccessTokenManager issues, validates and revokes access tokens.
+type AccessTokenManager struct {
+	store AccessTokenStore
+}
+
+// NewAccessTokenManager creates a new AccessTokenManager using the given store.
+func NewAccessTokenManager(store AccessTokenStore) *AccessTokenManager {
+	return &AccessTokenManager{store: store}
+}
+
+// Issue issues a new access token with the subject, name, groups, scopes and expiry of the given access token, its ID and creation time are set by Issue. The access token is only returned here, it can not be retrieved later.
+func (m *AccessTokenManager) Issue(ctx context.Context, token *AccessToken) (string, error) {
+	if token == nil {
+		return "", fmt.Errorf("access token is nil")
+	}
+
+	if token.Subject == "" {
+		return "", fmt.Errorf("access tokens can only be issued for a subject")
+	}
+
+	raw := make([]byte, 40)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	accessToken := AccessTokenPrefix + encodeBase64(raw[8:])
+
+	token.ID = hex.EncodeToString(raw[:8])
+	token.CreatedAt = time.Now()
+	token.LastUsedAt = time.Time{}
+
+	if err := m.store.Store(ctx, hashAccessToken(accessToken), token); err != nil {
+		return "", err
+	}
+
+	return accessToken, nil
+}
+
+// Validate validates the access token for the given account and returns it, or an ErrInvalidCredentials error. The last used time of the access token is updated.
+func (m *AccessTokenManager) Validate(ctx context.Context, account, accessToken string) (*AccessToken, error) {
+	if !IsAccessToken(accessToken) {
+		return nil, ErrInvalidCredentials
+	}
+
+	hash := hashAccessToken(accessToken)
+	token, err := m.store.Get(ctx, hash)
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	// An access token of one account must not be usable to log in as another account.
+	if token.Subject != account {
+		return nil, ErrInvalidCredentials
+	}
+
+	now := time.Now()
+	if token.Expired(now) {
+		return nil, ErrInvalidCredentials.WithDetail("access token has expired")
+	}
+
+	// Tracking the last use is informational, a failing store must not lock out the access token.
+	_ = m.store.Touch(ctx, hash, now)
+	token.LastUsedAt = now
+
+	return token, nil
+}
+
+// List returns the access tokens of the given subject.
+func (m *AccessTokenManager) List(ctx context.Context, subject string) ([]*AccessToken, error) {
+	return m.store.List(ctx, subject)
+}
+
+// Revoke revokes the access token with the given ID.
+func (m *AccessTokenManager) Revoke(ctx context.Context, id string) error {
+	return m.store.Delete(ctx, id)
+}
+
+// IsAccessToken checks if the password has the format of an access token.
+func IsAccessToken(password string) bool {
+	return strings.HasPrefix(password, AccessTokenPrefix)
+}
+
+func hashAccessToken(accessToken string) string {
+	sum := sha256.Sum256([]byte(accessToken))
+	return hex.EncodeToString(sum[:])
+}
+
+// AccessTokenAuthenticator is an authenticator accepting access tokens as password. Passwords that are not access tokens are passed on to the next authenticator, so users can log in with either.
+type AccessTokenAuthenticator struct {
+	manager    *AccessTokenManager
+	next       IdentityAuthenticator
+	identities IdentityLookup
+}
+
+// NewAccessTokenAuthenticator creates a new AccessTokenAuthenticator. Passwords that are not access tokens are authenticated with next, if next is nil only access tokens are accepted. The current identity of the subject of an access token that is not a robot access token is looked up with identities on every use, so deleted or disabled users can not use their access tokens anymore. If identities is nil, next is used when it implements IdentityLookup, and such access tokens are rejected otherwise.
+func NewAccessTokenAuthenticator(manager *AccessTokenManager, next IdentityAuthenticator, identities IdentityLookup) *AccessTokenAuthenticator {
+	if identities == nil {
+		identities, _ = next.(IdentityLookup)
+	}
+
+	return &AccessTokenAuthenticator{
+		manager:    manager,
+		next:       next,
+		identities: identities,
+	}
+}
+
+// AuthenticateIdentity authenticates the user with an access token, or with the next authenticator if the password is not an access token. The identity of an access token is restricted to the scopes of the access token, and has the ID and name of the access token as access_token_id and access_token_name attributes. A robot access token has its stored groups, other access tokens the current groups of their subject.
+func (a *AccessTokenAuthenticator) AuthenticateIdentity(ctx context.Context, user string, pass string) (*Identity, error) {
+	if !IsAccessToken(pass) {
+		if a.next == nil {
+			return nil, ErrUnknownUser
+		}
+		return a.next.AuthenticateIdentity(ctx, user, pass)
+	}
+
+	// An invalid access token is never passed on, so it does not end up at a password backend like LDAP.
+	token, err := a.manager.Validate(ctx, user, pass)
+	if err != nil {
+		return nil, err
+	}
+
+	identity, err := a.identity(ctx, token)
+	if errors.Is(err, ErrUnknownUser) {
+		return nil, ErrInvalidCredentials
+	}
+	return identity, err
+}
+
+// LookupIdentity looks up the current identity of the user with the IdentityLookup of the authenticator, see NewAccessTokenAuthenticator. Without one, ErrNoIdentityLookup is returned.
+func (a *AccessTokenAuthenticator) LookupIdentity(ctx context.Context, subject string) (*Identity, error) {
+	if a.identities == nil {
+		return nil, ErrNoIdentityLookup
+	}
+	return a.identities.LookupIdentity(ctx, subject)
+}
+
+// LookupAccessToken returns the current identity of the access token of the subject with the given ID, like AuthenticateIdentity does for the access token itself. If the access token was revoked or has expired, or its subject does not exist anymore, ErrUnknownUser is returned. The TokenHandler uses it to check the access token a refresh token was obtained with on every use, so revoking an access token revokes its refresh tokens as well.
+func (a *AccessTokenAuthenticator) LookupAccessToken(ctx context.Context, subject, id string) (*Identity, error) {
+	tokens, err := a.manager.List(ctx, subject)
+	if err != nil {
+		return nil, ErrUnknown.WithCause(fmt.Errorf("access tokens: %w", err))
+	}
+
+	for _, token := range tokens {
+		if id != "" && token.ID == id && !token.Expired(time.Now()) {
+			return a.identity(ctx, token)
+		}
+	}
+	return nil, ErrUnknownUser
+}
+
+// identity returns the identity of a valid access token.
+func (a *AccessTokenAuthenticator) identity(ctx context.Context, token *AccessToken) (*Identity, error) {
+	identity := &Identity{Subject: token.Subject, Groups: append([]string(nil), token.Groups...)}
+	if !token.Robot {
+		var err error
+		if identity, err = a.lookup(ctx, token.Subject); err != nil {
+			return nil, err
+		}
+	}
+
+	identity = identity.restrictScopes(token.Scopes)
+	identity.Method = AuthMethodAccessToken
+	if identity.Attributes == nil {
+		identity.Attributes = make(map[string]string, 3)
+	}
+	identity.Attributes["access_token_id"] = token.ID
+	identity.Attributes["access_token_name"] = token.Name
+	if token.Robot {
+		identity.Attributes["robot"] = "true"
+	}
+	return identity, nil
+}
+
+// lookup returns the current identity of the subject of an access token. A subject that does not exist anymore is ErrUnknownUser.
+func (a *AccessTokenAuthenticator) lookup(ctx context.Context, subject string) (*Identity, error) {
+	if a.identities == nil {
+		return nil, ErrInvalidCredentials.WithCause(errors.New("access tokens of users need an IdentityLookup to check their subject"))
+	}
+
+	identity, err := a.identities.LookupIdentity(ctx, subject)
+	if err != nil {
+		return nil, err
+	}
+	if identity == nil {
+		return nil, ErrUnknown.WithCause(errors.New("identity lookup returned no identity"))
+	}
+	return identity, nil
+}
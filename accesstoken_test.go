@@ -0,0 +1,227 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessTokenManager(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemoryAccessTokenStore()
+	m := NewAccessTokenManager(store)
+
+	accessToken, err := m.Issue(ctx, &AccessToken{Name: "ci", Subject: "jens"})
+	assert.NoError(t, err)
+	assert.True(t, IsAccessToken(accessToken))
+
+	// The store must never hold the access token itself
+	_, err = store.Get(ctx, accessToken)
+	assert.Error(t, err)
+
+	tokens, err := m.List(ctx, "jens")
+	assert.NoError(t, err)
+	assert.Len(t, tokens, 1)
+	assert.NotEmpty(t, tokens[0].ID)
+	assert.False(t, strings.Contains(accessToken, tokens[0].ID))
+	assert.True(t, tokens[0].LastUsedAt.IsZero())
+
+	token, err := m.Validate(ctx, "jens", accessToken)
+	assert.NoError(t, err)
+	assert.Equal(t, "ci", token.Name)
+
+	tokens, err = m.List(ctx, "jens")
+	assert.NoError(t, err)
+	assert.False(t, tokens[0].LastUsedAt.IsZero())
+
+	for _, account := range []string{"other", ""} {
+		_, err = m.Validate(ctx, account, accessToken)
+		assert.True(t, errors.Is(err, ErrInvalidCredentials))
+	}
+	_, err = m.Validate(ctx, "jens", AccessTokenPrefix+"unknown")
+	assert.True(t, errors.Is(err, ErrInvalidCredentials))
+
+	assert.NoError(t, m.Revoke(ctx, tokens[0].ID))
+	_, err = m.Validate(ctx, "jens", accessToken)
+	assert.True(t, errors.Is(err, ErrInvalidCredentials))
+
+	_, err = m.Issue(ctx, &AccessToken{Name: "no subject"})
+	assert.Error(t, err)
+}
+
+func TestAccessTokenManager_ValidateExpired(t *testing.T) {
+	m := NewAccessTokenManager(NewInMemoryAccessTokenStore())
+
+	accessToken, err := m.Issue(context.Background(), &AccessToken{Subject: "jens", ExpiresAt: time.Now().Add(-time.Second)})
+	assert.NoError(t, err)
+
+	_, err = m.Validate(context.Background(), "jens", accessToken)
+	assert.True(t, errors.Is(err, ErrInvalidCredentials))
+}
+
+func TestAccessTokenAuthenticator(t *testing.T) {
+	ctx := context.Background()
+	m := NewAccessTokenManager(NewInMemoryAccessTokenStore())
+	users := newMockAuthenticator("jens", "secret")
+	a := NewAccessTokenAuthenticator(m, AdaptAuthenticator(users), users)
+
+	robotToken, err := m.Issue(ctx, &AccessToken{
+		Name:    "ci",
+		Subject: "robot$ci",
+		Robot:   true,
+		Groups:  []string{"ci"},
+		Scopes:  []*Scope{{Type: ScopeTypeRepository, Name: "foo/bar", Actions: ActionSet{ActionPull}}},
+	})
+	assert.NoError(t, err)
+
+	identity, err := a.AuthenticateIdentity(ctx, "robot$ci", robotToken)
+	assert.NoError(t, err)
+	assert.Equal(t, "robot$ci", identity.Subject)
+	assert.Equal(t, AuthMethodAccessToken, identity.Method)
+	assert.True(t, identity.HasGroup("ci"))
+	assert.Equal(t, "true", identity.Attribute("robot"))
+	assert.Equal(t, "ci", identity.Attribute("access_token_name"))
+	assert.Len(t, identity.AllowedScopes, 1)
+
+	// Passwords are passed on to the next authenticator
+	identity, err = a.AuthenticateIdentity(ctx, "jens", "secret")
+	assert.NoError(t, err)
+	assert.Equal(t, AuthMethodPassword, identity.Method)
+
+	_, err = a.AuthenticateIdentity(ctx, "jens", robotToken)
+	assert.True(t, errors.Is(err, ErrInvalidCredentials))
+
+	_, err = NewAccessTokenAuthenticator(m, nil, nil).AuthenticateIdentity(ctx, "jens", "secret")
+	assert.True(t, errors.Is(err, ErrInvalidCredentials))
+}
+
+func TestAccessTokenAuthenticator_LooksUpSubject(t *testing.T) {
+	ctx := context.Background()
+	m := NewAccessTokenManager(NewInMemoryAccessTokenStore())
+	users := &groupAuthenticator{groups: []string{"developers"}}
+	a := NewAccessTokenAuthenticator(m, nil, users)
+
+	accessToken, err := m.Issue(ctx, &AccessToken{
+		Subject: "jens",
+		Groups:  []string{"admins"},
+		Scopes:  []*Scope{{Type: ScopeTypeRepository, Name: "foo/bar", Actions: ActionSet{ActionPull}}},
+	})
+	assert.NoError(t, err)
+
+	// The groups stored with the access token are ignored, the current groups are used
+	identity, err := a.AuthenticateIdentity(ctx, "jens", accessToken)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"developers"}, identity.Groups)
+	assert.Equal(t, AuthMethodAccessToken, identity.Method)
+	assert.Len(t, identity.AllowedScopes, 1)
+
+	users.groups = []string{"readers"}
+	identity, err = a.AuthenticateIdentity(ctx, "jens", accessToken)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"readers"}, identity.Groups)
+
+	// Users are looked up with the lookup of the authenticator
+	identity, err = a.LookupIdentity(ctx, "jens")
+	assert.NoError(t, err)
+	assert.Equal(t, AuthMethodPassword, identity.Method)
+	_, err = NewAccessTokenAuthenticator(m, nil, nil).LookupIdentity(ctx, "jens")
+	assert.True(t, errors.Is(err, ErrNoIdentityLookup))
+
+	// Access tokens of removed users can not be used anymore
+	users.removed = true
+	_, err = a.AuthenticateIdentity(ctx, "jens", accessToken)
+	assert.True(t, errors.Is(err, ErrInvalidCredentials))
+
+	// Without a lookup, only robot access tokens are accepted
+	_, err = NewAccessTokenAuthenticator(m, nil, nil).AuthenticateIdentity(ctx, "jens", accessToken)
+	assert.True(t, errors.Is(err, ErrInvalidCredentials))
+}
+
+func TestTokenHandler_AccessTokenScopes(t *testing.T) {
+	m := NewAccessTokenManager(NewInMemoryAccessTokenStore())
+	h := newTestTokenHandler(t, NewDummyAuthorizer())
+	h.authenticator = NewAccessTokenAuthenticator(m, h.authenticator, h.options.Identities)
+
+	accessToken, err := m.Issue(context.Background(), &AccessToken{
+		Subject: "jens",
+		Scopes:  []*Scope{{Type: ScopeTypeRepository, Name: "foo/bar", Actions: ActionSet{ActionPull}}},
+	})
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name  string
+		scope string
+		code  int
+	}{
+		{"TestAllowedScope", "repository:foo/bar:pull", http.StatusOK},
+		{"TestAllowedScopeOtherAction", "repository:foo/bar:push", http.StatusForbidden},
+		{"TestOtherScope", "repository:foo/baz:pull", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/?account=jens&service=registry&client_id=docker&scope="+tt.scope, nil)
+			req.SetBasicAuth("jens", accessToken)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			assert.Equal(t, tt.code, rec.Code)
+		})
+	}
+}
+
+func TestTokenHandler_RevokedAccessTokenRefresh(t *testing.T) {
+	ctx := context.Background()
+	m := NewAccessTokenManager(NewInMemoryAccessTokenStore())
+	h := newTestTokenHandler(t, NewDummyAuthorizer())
+	h.authenticator = NewAccessTokenAuthenticator(m, h.authenticator, h.options.Identities)
+
+	login := func(user, accessToken string) string {
+		req := httptest.NewRequest(http.MethodGet, "/?account="+user+"&service=registry&client_id=docker&offline_token=true", nil)
+		req.SetBasicAuth(user, accessToken)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		body, _ := decodeToken(t, rec)
+		return body["refresh_token"].(string)
+	}
+	refresh := func(refreshToken string) int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, newFormRequest(url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {refreshToken},
+			"service":       {"registry"},
+			"client_id":     {"docker"},
+			"scope":         {"repository:foo/bar:pull"},
+		}))
+		return rec.Code
+	}
+
+	accessToken, err := m.Issue(ctx, &AccessToken{Subject: "jens", Name: "ci"})
+	assert.NoError(t, err)
+	robotToken, err := m.Issue(ctx, &AccessToken{Subject: "robot$ci", Robot: true, Groups: []string{"pushers"}})
+	assert.NoError(t, err)
+
+	refreshToken := login("jens", accessToken)
+	robotRefreshToken := login("robot$ci", robotToken)
+	assert.Equal(t, http.StatusOK, refresh(refreshToken))
+	assert.Equal(t, http.StatusOK, refresh(robotRefreshToken))
+
+	// Revoking an access token revokes the refresh tokens obtained with it
+	tokens, err := m.List(ctx, "jens")
+	assert.NoError(t, err)
+	assert.NoError(t, m.Revoke(ctx, tokens[0].ID))
+	assert.Equal(t, http.StatusUnauthorized, refresh(refreshToken))
+	assert.Equal(t, http.StatusOK, refresh(robotRefreshToken))
+
+	// Without an AccessTokenAuthenticator the access token can not be checked
+	h.authenticator = AdaptAuthenticator(newMockAuthenticator("jens", "secret"))
+	assert.Equal(t, http.StatusUnauthorized, refresh(robotRefreshToken))
+	h.options.AccessTokens = NewAccessTokenAuthenticator(m, nil, nil)
+	assert.Equal(t, http.StatusOK, refresh(robotRefreshToken))
+}
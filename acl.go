@@ -0,0 +1,401 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// ACLMode decides which rule of an ACL applies when several rules match a scope.
+type ACLMode string
+
+const (
+	// ACLFirstMatch applies the first matching rule, in the order of the file.
+	ACLFirstMatch ACLMode = "first_match"
+	// ACLMostSpecific applies the most specific matching rule: the one whose repository pattern has the most literal characters, then the one with the most specific principal (an account, an account pattern, a group, anyone), then the one with the longest IP prefix. Ties go to the earlier rule.
+	ACLMostSpecific ACLMode = "most_specific"
+)
+
+// accountPlaceholder is replaced by the subject of the identity in the name pattern of a rule, so a rule can grant every user their own namespace.
+const accountPlaceholder = "${account}"
+
+// maxACLNamePatterns is the number of name patterns with the account placeholder a rule keeps compiled, they are compiled again when it is reached.
+const maxACLNamePatterns = 1024
+
+// ACLRule is a rule of an ACL. The match fields that are set must all match a scope for the rule to apply, fields that are empty match anything. Account, group and name are glob patterns, where * matches any characters except /, ** matches any characters including / and ? matches a single character except /.
+type ACLRule struct {
+	// Account matches the subject of the identity. Anonymous requests have no subject, so only rules without account match them.
+	Account string `yaml:"account,omitempty" json:"account,omitempty"`
+	// Group matches any of the groups of the identity.
+	Group string `yaml:"group,omitempty" json:"group,omitempty"`
+	// IP is an IP address or CIDR range matching the client IP.
+	IP string `yaml:"ip,omitempty" json:"ip,omitempty"`
+	// Anonymous matches only anonymous requests when true, and only authenticated requests when false.
+	Anonymous *bool `yaml:"anonymous,omitempty" json:"anonymous,omitempty"`
+	// Type matches the scope type, repository or registry.
+	Type ScopeType `yaml:"type,omitempty" json:"type,omitempty"`
+	// Name matches the name of the scope, like team-a/* or ${account}/**.
+	Name string `yaml:"name,omitempty" json:"name,omitempty"`
+	// Actions are the actions the rule allows, * allows every action. A rule without actions denies the scope.
+	Actions []string `yaml:"actions" json:"actions"`
+	Comment string   `yaml:"comment,omitempty" json:"comment,omitempty"`
+}
+
+// ACL is the format of an ACL file, in the style of the static ACL of docker_auth.
+//
+//	mode: first_match
+//	rules:
+//	  - account: admin
+//	    actions: ["*"]
+//	  - group: team-a
+//	    name: team-a/**
+//	    actions: [pull, push]
+//	  - name: ${account}/*
+//	    anonymous: false
+//	    actions: [pull, push]
+//	  - name: library/*
+//	    actions: [pull]
+type ACL struct {
+	// Mode defaults to ACLFirstMatch.
+	Mode  ACLMode   `yaml:"mode,omitempty" json:"mode,omitempty"`
+	Rules []ACLRule `yaml:"rules" json:"rules"`
+}
+
+// ParseACL parses the contents of an ACL file and validates it. JSON is parsed when isJSON is true, YAML otherwise.
+func ParseACL(data []byte, isJSON bool) (*ACL, error) {
+	acl := &ACL{}
+	if err := unmarshalConfig(data, isJSON, acl); err != nil {
+		return nil, err
+	}
+
+	if err := acl.Validate(); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// Validate checks that the mode is known and every rule has valid patterns, IP ranges and actions.
+func (a *ACL) Validate() error {
+	_, err := compileACL(a)
+	return err
+}
+
+type compiledACL struct {
+	mode  ACLMode
+	rules []*aclRule
+}
+
+type aclRule struct {
+	account *regexp.Regexp
+	group   *regexp.Regexp
+	network *net.IPNet
+	// name is nil if the pattern holds the account placeholder, it is compiled per subject into names then
+	name      *regexp.Regexp
+	rule      ACLRule
+	actions   ActionSet
+	principal int
+
+	mu    sync.Mutex
+	names map[string]*regexp.Regexp
+}
+
+func compileACL(acl *ACL) (*compiledACL, error) {
+	compiled := &compiledACL{mode: acl.Mode, rules: make([]*aclRule, 0, len(acl.Rules))}
+	switch compiled.mode {
+	case "":
+		compiled.mode = ACLFirstMatch
+	case ACLFirstMatch, ACLMostSpecific:
+	default:
+		return nil, fmt.Errorf("unknown acl mode %s", acl.Mode)
+	}
+
+	for i, rule := range acl.Rules {
+		r, err := compileACLRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("acl rule %d: %w", i, err)
+		}
+		compiled.rules = append(compiled.rules, r)
+	}
+	return compiled, nil
+}
+
+func compileACLRule(rule ACLRule) (*aclRule, error) {
+	r := &aclRule{rule: rule, names: make(map[string]*regexp.Regexp)}
+	var err error
+
+	switch {
+	case rule.Account != "" && !strings.ContainsAny(rule.Account, "*?"):
+		r.principal = 3
+	case rule.Account != "":
+		r.principal = 2
+	case rule.Group != "":
+		r.principal = 1
+	}
+
+	if rule.Account != "" {
+		if r.account, err = compileGlob(rule.Account, ""); err != nil {
+			return nil, err
+		}
+	}
+	if rule.Group != "" {
+		if r.group, err = compileGlob(rule.Group, ""); err != nil {
+			return nil, err
+		}
+	}
+	if rule.Name != "" && !strings.Contains(rule.Name, accountPlaceholder) {
+		if r.name, err = compileGlob(rule.Name, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	if rule.IP != "" {
+		if r.network, err = parseNetwork(rule.IP); err != nil {
+			return nil, err
+		}
+	}
+
+	if rule.Type != "" {
+		if _, err := ParseScopeType(rule.Type.String()); err != nil {
+			return nil, err
+		}
+	}
+
+	if r.actions, err = ParseActions(rule.Actions); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// parseNetwork parses an IP address or CIDR range.
+func parseNetwork(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip %s", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+
+	_, network, err := net.ParseCIDR(s)
+	return network, err
+}
+
+// compileGlob compiles a glob pattern into an anchored regular expression. The account placeholder is replaced by the given account, which is matched literally.
+func compileGlob(pattern, account string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case strings.HasPrefix(pattern[i:], accountPlaceholder):
+			if account == "" {
+				return nil, fmt.Errorf("pattern %s needs an account", pattern)
+			}
+			b.WriteString(regexp.QuoteMeta(account))
+			i += len(accountPlaceholder) - 1
+		case strings.HasPrefix(pattern[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case pattern[i] == '*':
+			b.WriteString("[^/]*")
+		case pattern[i] == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// literalLength returns the number of characters of the pattern that are not wildcards.
+func literalLength(pattern, account string) int {
+	pattern = strings.ReplaceAll(pattern, accountPlaceholder, account)
+	return len(pattern) - strings.Count(pattern, "*") - strings.Count(pattern, "?")
+}
+
+// aclSubject returns the subject the rules match the request on, which is empty for anonymous requests.
+func aclSubject(req *AuthorizationRequest) string {
+	if req.Identity == nil || req.Identity.IsAnonymous() {
+		return ""
+	}
+	return req.Identity.Subject
+}
+
+// namePattern returns the name pattern of the rule compiled for the subject.
+func (r *aclRule) namePattern(subject string) (*regexp.Regexp, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if name, ok := r.names[subject]; ok {
+		return name, nil
+	}
+
+	name, err := compileGlob(r.rule.Name, subject)
+	if err != nil {
+		return nil, err
+	}
+	if len(r.names) >= maxACLNamePatterns {
+		r.names = make(map[string]*regexp.Regexp)
+	}
+	r.names[subject] = name
+	return name, nil
+}
+
+// matches checks if the rule applies to the scope of the request for the subject.
+func (r *aclRule) matches(req *AuthorizationRequest, subject string, scope *Scope) bool {
+	if r.rule.Anonymous != nil && *r.rule.Anonymous != req.Identity.IsAnonymous() {
+		return false
+	}
+
+	if r.account != nil && (subject == "" || !r.account.MatchString(subject)) {
+		return false
+	}
+
+	if r.group != nil {
+		matched := false
+		if req.Identity != nil {
+			for _, group := range req.Identity.Groups {
+				if r.group.MatchString(group) {
+					matched = true
+					break
+				}
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if r.network != nil {
+		ip := net.ParseIP(req.IP)
+		if ip == nil || !r.network.Contains(ip) {
+			return false
+		}
+	}
+
+	if r.rule.Type != "" && r.rule.Type != scope.Type {
+		return false
+	}
+
+	if r.rule.Name != "" {
+		name := r.name
+		if name == nil {
+			// Rules for the own namespace of the account never match anonymous requests
+			if subject == "" {
+				return false
+			}
+			var err error
+			if name, err = r.namePattern(subject); err != nil {
+				return false
+			}
+		}
+		if !name.MatchString(scope.Name) {
+			return false
+		}
+	}
+	return true
+}
+
+// moreSpecific checks if the rule is more specific than the other rule for the subject, see ACLMostSpecific.
+func (r *aclRule) moreSpecific(other *aclRule, subject string) bool {
+	if a, b := literalLength(r.rule.Name, subject), literalLength(other.rule.Name, subject); a != b {
+		return a > b
+	}
+	if r.principal != other.principal {
+		return r.principal > other.principal
+	}
+	return prefixLength(r.network) > prefixLength(other.network)
+}
+
+func prefixLength(network *net.IPNet) int {
+	if network == nil {
+		return -1
+	}
+	ones, _ := network.Mask.Size()
+	return ones
+}
+
+// ACLAuthorizer is an authorizer allowing the actions of the rules in an ACL file, see ACL for the format. Scopes no rule matches are denied. The file is loaded again when it changes on disk.
+type ACLAuthorizer struct {
+	reloader *fileReloader
+
+	mu  sync.RWMutex
+	acl *compiledACL
+}
+
+// NewACLAuthorizer creates a new ACLAuthorizer for the ACL file at the given path. Files with a .json extension are parsed as JSON, others as YAML. If the file can not be loaded or is invalid, an error is returned.
+func NewACLAuthorizer(path string) (*ACLAuthorizer, error) {
+	a := &ACLAuthorizer{}
+	a.reloader = newFileReloader(path, func(data []byte) error {
+		return a.load(data, isJSONPath(path))
+	})
+	if err := a.reloader.reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *ACLAuthorizer) load(data []byte, isJSON bool) error {
+	parsed := &ACL{}
+	if err := unmarshalConfig(data, isJSON, parsed); err != nil {
+		return err
+	}
+	acl, err := compileACL(parsed)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.acl = acl
+	return nil
+}
+
+// Reload loads the ACL file if it has changed. This is done on every authorization as well, calling it is only needed to check for errors in the file. If the file can not be loaded, the previously loaded rules are kept.
+func (a *ACLAuthorizer) Reload() error {
+	return a.reloader.reload()
+}
+
+// SetErrorLog sets the logger for failures to reload the ACL file on authorization. If nil, the standard logger of the log package is used.
+func (a *ACLAuthorizer) SetErrorLog(logger *log.Logger) {
+	a.reloader.setErrorLog(logger)
+}
+
+// Authorize returns the requested actions of the scope that the applying rule allows. If the file can not be reloaded, the previously loaded rules are used and the error is logged.
+func (a *ACLAuthorizer) Authorize(ctx context.Context, req *AuthorizationRequest, scope *Scope) (ActionSet, error) {
+	a.reloader.refresh()
+
+	a.mu.RLock()
+	acl := a.acl
+	a.mu.RUnlock()
+
+	subject := aclSubject(req)
+	var applied *aclRule
+	for _, rule := range acl.rules {
+		if !rule.matches(req, subject, scope) {
+			continue
+		}
+		if acl.mode == ACLFirstMatch {
+			applied = rule
+			break
+		}
+		if applied == nil || rule.moreSpecific(applied, subject) {
+			applied = rule
+		}
+	}
+
+	if applied == nil {
+		return ActionSet{}, nil
+	}
+	allowed := applied.actions
+	if allowed.Contains(ActionAll) {
+		allowed = scope.Actions
+	}
+	return scope.Actions.Intersect(allowed), nil
+}
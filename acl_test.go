@@ -0,0 +1,182 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"path/filepath"
+	"testing"
+)
+
+const testACLYAML = `rules:
+  - account: admin
+    actions: ["*"]
+  - ip: 203.0.113.0/24
+    comment: the untrusted network can not push
+    actions: [pull]
+  - group: team-a
+    name: team-a/**
+    actions: [pull, push]
+  - account: "ci-*"
+    type: repository
+    actions: [pull]
+  - name: ${account}/*
+    anonymous: false
+    actions: [pull, push]
+  - name: library/*
+    actions: [pull]
+`
+
+func newTestACLAuthorizer(t *testing.T, contents string) (*ACLAuthorizer, string) {
+	path := filepath.Join(t.TempDir(), "acl.yaml")
+	writeTestFile(t, path, contents)
+	a, err := NewACLAuthorizer(path)
+	assert.NoError(t, err)
+	return a, path
+}
+
+func authorizeTestScope(t *testing.T, a Authorizer, req *AuthorizationRequest, scope string) ActionSet {
+	s, err := ParseScope(scope)
+	assert.NoError(t, err)
+	actions, err := a.Authorize(context.Background(), req, s)
+	assert.NoError(t, err)
+	return actions
+}
+
+func TestCompileGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"team-a/*", "team-a/app", true},
+		{"team-a/*", "team-a/app/sub", false},
+		{"team-a/**", "team-a/app/sub", true},
+		{"team-a/**", "team-b/app", false},
+		{"app-?", "app-1", true},
+		{"app-?", "app-10", false},
+		{"a.b", "axb", false},
+		{"*", "library", true},
+	}
+
+	for _, tt := range tests {
+		re, err := compileGlob(tt.pattern, "")
+		assert.NoError(t, err)
+		assert.Equal(t, tt.want, re.MatchString(tt.name), "%s %s", tt.pattern, tt.name)
+	}
+
+	// The account is matched literally
+	re, err := compileGlob("${account}/*", "jens.*")
+	assert.NoError(t, err)
+	assert.True(t, re.MatchString("jens.*/app"))
+	assert.False(t, re.MatchString("jensx/app"))
+	_, err = compileGlob("${account}/*", "")
+	assert.Error(t, err)
+}
+
+func TestACLAuthorizer_FirstMatch(t *testing.T) {
+	a, _ := newTestACLAuthorizer(t, testACLYAML)
+
+	user := func(account string, groups ...string) *AuthorizationRequest {
+		return &AuthorizationRequest{Account: account, IP: "192.0.2.1", Identity: &Identity{Subject: account, Groups: groups, Method: AuthMethodPassword}}
+	}
+	fromUntrusted := user("admin")
+	fromUntrusted.IP = "203.0.113.7"
+	anonymous := &AuthorizationRequest{IP: "192.0.2.1", Identity: AnonymousIdentity()}
+
+	tests := []struct {
+		name  string
+		req   *AuthorizationRequest
+		scope string
+		want  ActionSet
+	}{
+		// * allows every requested action
+		{"TestAdmin", user("admin"), "repository:team-b/app:pull,push", ActionSet{ActionPull, ActionPush}},
+		{"TestAdminCatalog", user("admin"), "registry:catalog:*", ActionSet{ActionAll}},
+		{"TestAdminBeforeIP", fromUntrusted, "repository:team-b/app:push", ActionSet{ActionPush}},
+		{"TestUntrustedNetwork", func() *AuthorizationRequest { r := user("jens", "team-a"); r.IP = "203.0.113.7"; return r }(), "repository:team-a/app:pull,push", ActionSet{ActionPull}},
+		{"TestGroupNested", user("jens", "team-a"), "repository:team-a/app/sub:pull,push", ActionSet{ActionPull, ActionPush}},
+		{"TestGroupOtherTeam", user("jens", "team-a"), "repository:team-b/app:push", ActionSet{}},
+		{"TestAccountPattern", user("ci-build"), "repository:team-b/app:pull,push", ActionSet{ActionPull}},
+		{"TestAccountPatternType", user("ci-build"), "registry:catalog:*", ActionSet{}},
+		{"TestOwnNamespace", user("jens"), "repository:jens/app:pull,push", ActionSet{ActionPull, ActionPush}},
+		{"TestOtherNamespace", user("jens"), "repository:alice/app:pull", ActionSet{}},
+		{"TestPublic", user("jens"), "repository:library/alpine:pull,push", ActionSet{ActionPull}},
+		{"TestAnonymousPublic", anonymous, "repository:library/alpine:pull", ActionSet{ActionPull}},
+		{"TestAnonymousPrivate", anonymous, "repository:anonymous/app:pull", ActionSet{}},
+		// Rules match the subject of the identity, not the account the client sent
+		{"TestAccountNotSubject", &AuthorizationRequest{Account: "admin", IP: "192.0.2.1", Identity: &Identity{Subject: "jens", Method: AuthMethodPassword}}, "repository:team-b/app:push", ActionSet{}},
+		{"TestAccountNamespaceNotSubject", &AuthorizationRequest{Account: "alice", IP: "192.0.2.1", Identity: &Identity{Subject: "jens", Method: AuthMethodPassword}}, "repository:alice/app:pull", ActionSet{}},
+		{"TestAccountWithoutIdentity", &AuthorizationRequest{Account: "admin", IP: "192.0.2.1"}, "repository:team-b/app:push", ActionSet{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, authorizeTestScope(t, a, tt.req, tt.scope))
+		})
+	}
+}
+
+func TestACLAuthorizer_MostSpecific(t *testing.T) {
+	a, _ := newTestACLAuthorizer(t, `mode: most_specific
+rules:
+  - name: "**"
+    actions: [pull]
+  - group: team-a
+    name: team-a/*
+    actions: [pull, push]
+  - account: jens
+    name: team-a/*
+    actions: [pull]
+  - name: team-a/secret
+    actions: []
+`)
+
+	req := &AuthorizationRequest{Account: "jens", Identity: &Identity{Subject: "jens", Groups: []string{"team-a"}}}
+	alice := &AuthorizationRequest{Account: "alice", Identity: &Identity{Subject: "alice", Groups: []string{"team-a"}}}
+
+	// The account rule is more specific than the group rule with the same pattern
+	assert.Equal(t, ActionSet{ActionPull}, authorizeTestScope(t, a, req, "repository:team-a/app:pull,push"))
+	assert.Equal(t, ActionSet{ActionPull, ActionPush}, authorizeTestScope(t, a, alice, "repository:team-a/app:pull,push"))
+	// A longer pattern is more specific than any principal
+	assert.Equal(t, ActionSet{}, authorizeTestScope(t, a, alice, "repository:team-a/secret:pull"))
+	assert.Equal(t, ActionSet{ActionPull}, authorizeTestScope(t, a, alice, "repository:team-b/app:pull,push"))
+}
+
+func TestACLAuthorizer_Reload(t *testing.T) {
+	a, path := newTestACLAuthorizer(t, "rules:\n  - name: library/*\n    actions: [pull]\n")
+	req := &AuthorizationRequest{Account: "jens", Identity: &Identity{Subject: "jens"}}
+	assert.Equal(t, ActionSet{ActionPull}, authorizeTestScope(t, a, req, "repository:library/alpine:pull"))
+
+	// Invalid files keep the previous rules, and are logged
+	var logs bytes.Buffer
+	a.SetErrorLog(log.New(&logs, "", 0))
+	writeTestFile(t, path, "rules:\n  - name: library/*\n    actions: [delete]\n")
+	assert.Equal(t, ActionSet{ActionPull}, authorizeTestScope(t, a, req, "repository:library/alpine:pull"))
+	assert.Contains(t, logs.String(), "reloading "+path+" failed")
+	assert.Error(t, a.Reload())
+
+	writeTestFile(t, path, "rules:\n  - name: library/*\n    actions: []\n")
+	assert.Equal(t, ActionSet{}, authorizeTestScope(t, a, req, "repository:library/alpine:pull"))
+}
+
+func TestParseACL(t *testing.T) {
+	acl, err := ParseACL([]byte(`{"mode": "most_specific", "rules": [{"group": "admins", "actions": ["pull", "push"]}]}`), true)
+	assert.NoError(t, err)
+	assert.Equal(t, ACLMostSpecific, acl.Mode)
+	assert.Len(t, acl.Rules, 1)
+
+	invalid := []string{
+		"mode: last_match\nrules: []\n",
+		"rules:\n  - ip: 300.0.0.1\n    actions: [pull]\n",
+		"rules:\n  - ip: 10.0.0.0/33\n    actions: [pull]\n",
+		"rules:\n  - type: blob\n    actions: [pull]\n",
+		"rules:\n  - name: library/*\n    actions: [pul]\n",
+		"rules:\n  - repository: library/*\n    actions: [pull]\n",
+	}
+	for _, data := range invalid {
+		_, err := ParseACL([]byte(data), false)
+		assert.Error(t, err, data)
+	}
+}
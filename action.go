@@ -71,6 +71,17 @@ func (a ActionSet) ContainsAll(actions []ActionType) bool {
 	return true
 }
 
+// Intersect returns a new ActionSet containing the actions that are in both the ActionSet and the given ActionSet, in the order of the ActionSet.
+func (a ActionSet) Intersect(actions ActionSet) ActionSet {
+	intersection := make(ActionSet, 0, len(a))
+	for _, action := range a {
+		if actions.Contains(action) && !intersection.Contains(action) {
+			intersection = append(intersection, action)
+		}
+	}
+	return intersection
+}
+
 // ToStrings returns a slice of strings representing the actions in the ActionSet.
 func (a ActionSet) ToStrings() []string {
 	actions := make([]string, len(a))
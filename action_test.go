@@ -94,3 +94,32 @@ func TestActionSet_ToStrings(t *testing.T) {
 		}
 	}
 }
+
+func TestActionSet_Intersect(t *testing.T) {
+	set := ActionSet{ActionPull, ActionPush}
+	tests := []struct {
+		name    string
+		actions ActionSet
+		want    []string
+	}{
+		{"TestAllInSet", ActionSet{ActionPush, ActionPull}, []string{"pull", "push"}},
+		{"TestSomeInSet", ActionSet{ActionPull, ActionAll}, []string{"pull"}},
+		{"TestNoneInSet", ActionSet{ActionAll}, []string{}},
+		{"TestEmpty", ActionSet{}, []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := set.Intersect(tt.actions).ToStrings()
+			if len(got) != len(tt.want) {
+				t.Errorf("ActionSet.Intersect() = %v, want %v", got, tt.want)
+				return
+			}
+			for i, action := range got {
+				if action != tt.want[i] {
+					t.Errorf("ActionSet.Intersect() = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
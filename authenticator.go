@@ -1,6 +1,9 @@
 package registry
 
-import "context"
+import (
+	"context"
+	"errors"
+)
 
 // Authenticator is an interface for authenticating users for the registry server.
 type Authenticator interface {
@@ -8,6 +11,168 @@ type Authenticator interface {
 	Authenticate(ctx context.Context, user string, pass string) error
 }
 
+// IdentityAuthenticator is an interface for authenticating users that returns the identity of the authenticated user, so authorizers can decide on more than the account name. Use AdaptAuthenticator to use an Authenticator where an IdentityAuthenticator is expected.
+type IdentityAuthenticator interface {
+	// AuthenticateIdentity authenticates the user with the given username and password and returns the identity of the user. If the authentication fails, an error is returned. Context is used to pass the request context, which can be used to cancel the request or extract additional information.
+	AuthenticateIdentity(ctx context.Context, user string, pass string) (*Identity, error)
+}
+
+// IdentityLookup is an interface for looking up the current identity of a user without credentials. It is used to check the users of long-lived credentials, like refresh tokens and access tokens, on every use, so users that are deleted or disabled lose access and changes to their groups take effect.
+type IdentityLookup interface {
+	// LookupIdentity returns the current identity of the user with the given subject. If the user does not exist or can not authenticate anymore, like a disabled user, ErrUnknownUser is returned.
+	LookupIdentity(ctx context.Context, subject string) (*Identity, error)
+}
+
+// ErrNoIdentityLookup is returned by LookupIdentity of an authenticator wrapping another authenticator, when the wrapped authenticator does not implement IdentityLookup.
+var ErrNoIdentityLookup = errors.New("authenticator does not implement IdentityLookup")
+
+// lookupIdentity looks up the current identity of the user with an authenticator that is wrapped by another authenticator, if it implements IdentityLookup. Otherwise ErrNoIdentityLookup is returned.
+func lookupIdentity(ctx context.Context, authenticator IdentityAuthenticator, subject string) (*Identity, error) {
+	lookup, ok := authenticator.(IdentityLookup)
+	if !ok {
+		return nil, ErrNoIdentityLookup
+	}
+	return lookup.LookupIdentity(ctx, subject)
+}
+
+// AuthMethod is the method a user was authenticated with.
+type AuthMethod string
+
+const (
+	AuthMethodPassword    AuthMethod = "password"
+	AuthMethodAccessToken AuthMethod = "access_token"
+	AuthMethodOIDC        AuthMethod = "oidc"
+	AuthMethodKubernetes  AuthMethod = "kubernetes"
+	AuthMethodCertificate AuthMethod = "certificate"
+	AuthMethodAnonymous   AuthMethod = "anonymous"
+)
+
+// AnonymousSubject is the subject of the identity of requests without credentials.
+const AnonymousSubject = "anonymous"
+
+// String returns the string representation of an AuthMethod.
+func (m AuthMethod) String() string {
+	return string(m)
+}
+
+// Identity is the identity of an authenticated user.
+type Identity struct {
+	// Subject is the unique name of the user, usually the account name.
+	Subject     string
+	DisplayName string
+	Groups      []string
+	// Attributes contains additional information about the user, which depends on the authenticator.
+	Attributes map[string]string
+	Method     AuthMethod
+	// Backend is the name of the backend that authenticated the user, it is set by the ChainAuthenticator.
+	Backend string
+	// AllowedScopes restricts the scopes the identity can be granted, whatever the authorizer allows. Scopes without a matching allowed scope are granted no actions. Nil means the identity is not restricted.
+	AllowedScopes []*Scope
+}
+
+// AnonymousIdentity returns the identity of a request without credentials, which the TokenHandler uses when anonymous requests are allowed.
+func AnonymousIdentity() *Identity {
+	return &Identity{Subject: AnonymousSubject, Method: AuthMethodAnonymous}
+}
+
+// IsAnonymous checks if the identity is the identity of a request without credentials. A user that is named anonymous is not.
+func (i *Identity) IsAnonymous() bool {
+	return i != nil && i.Method == AuthMethodAnonymous
+}
+
+// HasGroup checks if the identity is a member of the given group.
+func (i *Identity) HasGroup(group string) bool {
+	for _, g := range i.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// Attribute returns the attribute with the given name, or an empty string if the identity does not have it.
+func (i *Identity) Attribute(name string) string {
+	return i.Attributes[name]
+}
+
+// Clone returns a copy of the identity, which can be changed without changing the original.
+func (i *Identity) Clone() *Identity {
+	if i == nil {
+		return nil
+	}
+
+	clone := *i
+	clone.Groups = append([]string(nil), i.Groups...)
+	if i.Attributes != nil {
+		clone.Attributes = make(map[string]string, len(i.Attributes))
+		for name, value := range i.Attributes {
+			clone.Attributes[name] = value
+		}
+	}
+	if i.AllowedScopes != nil {
+		clone.AllowedScopes = append([]*Scope{}, i.AllowedScopes...)
+	}
+	return &clone
+}
+
+// restrictScopes returns a copy of the identity that is restricted to the given allowed scopes as well as its own, so it is never granted more than both allow. Nil allowed scopes do not restrict the identity.
+func (i *Identity) restrictScopes(allowed []*Scope) *Identity {
+	clone := i.Clone()
+	if allowed == nil {
+		return clone
+	}
+	if i.AllowedScopes == nil {
+		clone.AllowedScopes = append([]*Scope{}, allowed...)
+		return clone
+	}
+
+	clone.AllowedScopes = make([]*Scope, 0, len(allowed))
+	for _, scope := range allowed {
+		clone.AllowedScopes = append(clone.AllowedScopes, &Scope{
+			Type:    scope.Type,
+			Name:    scope.Name,
+			Actions: i.restrictActions(scope, scope.Actions),
+		})
+	}
+	return clone
+}
+
+// restrictActions restricts the actions granted for the scope to the allowed scopes of the identity.
+func (i *Identity) restrictActions(scope *Scope, actions ActionSet) ActionSet {
+	if i == nil || i.AllowedScopes == nil {
+		return actions
+	}
+
+	for _, allowed := range i.AllowedScopes {
+		if allowed.Matches(scope) {
+			return actions.Intersect(allowed.Actions)
+		}
+	}
+	return ActionSet{}
+}
+
+// AdaptAuthenticator adapts an Authenticator to an IdentityAuthenticator. The identity of an authenticated user only has the username as subject. If the authenticator already implements IdentityAuthenticator, it is returned as is.
+func AdaptAuthenticator(authenticator Authenticator) IdentityAuthenticator {
+	if a, ok := authenticator.(IdentityAuthenticator); ok {
+		return a
+	}
+	return &authenticatorAdapter{authenticator: authenticator}
+}
+
+type authenticatorAdapter struct {
+	authenticator Authenticator
+}
+
+func (a *authenticatorAdapter) AuthenticateIdentity(ctx context.Context, user string, pass string) (*Identity, error) {
+	if err := a.authenticator.Authenticate(ctx, user, pass); err != nil {
+		return nil, err
+	}
+	return &Identity{
+		Subject: user,
+		Method:  AuthMethodPassword,
+	}, nil
+}
+
 // DummyAuthenticator is an authenticator that always succeeds.
 type DummyAuthenticator struct {
 }
@@ -19,3 +184,15 @@ func NewDummyAuthenticator() *DummyAuthenticator {
 func (a *DummyAuthenticator) Authenticate(ctx context.Context, user string, pass string) error {
 	return nil
 }
+
+func (a *DummyAuthenticator) AuthenticateIdentity(ctx context.Context, user string, pass string) (*Identity, error) {
+	return &Identity{
+		Subject: user,
+		Method:  AuthMethodPassword,
+	}, nil
+}
+
+// LookupIdentity returns an identity for every subject, like Authenticate accepts every user.
+func (a *DummyAuthenticator) LookupIdentity(ctx context.Context, subject string) (*Identity, error) {
+	return &Identity{Subject: subject, Method: AuthMethodPassword}, nil
+}
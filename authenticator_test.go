@@ -1,20 +1,82 @@
 package registry
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"testing"
+)
 
 type mockAuthenticator struct {
 	mockUser, mockPass string
 }
 
-func (a *mockAuthenticator) Authenticate(user string, pass string) error {
+func (a *mockAuthenticator) Authenticate(ctx context.Context, user string, pass string) error {
 	if user != a.mockUser || pass != a.mockPass {
 		return errors.New("invalid credentials")
 	}
 	return nil
 }
 
+func (a *mockAuthenticator) LookupIdentity(ctx context.Context, subject string) (*Identity, error) {
+	if subject != a.mockUser {
+		return nil, ErrUnknownUser
+	}
+	return &Identity{Subject: subject, Method: AuthMethodPassword}, nil
+}
+
 func newMockAuthenticator(user, pass string) *mockAuthenticator {
 	return &mockAuthenticator{mockUser: user, mockPass: pass}
 }
 
-//TODO(JensvandeWiel) Add tests
+func TestAdaptAuthenticator(t *testing.T) {
+	a := AdaptAuthenticator(newMockAuthenticator("jens", "secret"))
+
+	identity, err := a.AuthenticateIdentity(context.Background(), "jens", "secret")
+	if err != nil {
+		t.Errorf("AuthenticateIdentity() error = %v", err)
+		return
+	}
+
+	if identity.Subject != "jens" {
+		t.Errorf("AuthenticateIdentity() Subject = %v, want jens", identity.Subject)
+	}
+
+	if identity.Method != AuthMethodPassword {
+		t.Errorf("AuthenticateIdentity() Method = %v, want %v", identity.Method, AuthMethodPassword)
+	}
+
+	if _, err := a.AuthenticateIdentity(context.Background(), "jens", "wrong"); err == nil {
+		t.Errorf("AuthenticateIdentity() error = nil, want error")
+	}
+}
+
+func TestAdaptAuthenticatorKeepsIdentityAuthenticator(t *testing.T) {
+	dummy := NewDummyAuthenticator()
+	if a := AdaptAuthenticator(dummy); a != IdentityAuthenticator(dummy) {
+		t.Errorf("AdaptAuthenticator() = %v, want %v", a, dummy)
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	identity := &Identity{
+		Subject:    "jens",
+		Groups:     []string{"developers", "admins"},
+		Attributes: map[string]string{"email": "jens@example.com"},
+	}
+
+	if !identity.HasGroup("admins") {
+		t.Errorf("Identity.HasGroup(admins) = false, want true")
+	}
+
+	if identity.HasGroup("other") {
+		t.Errorf("Identity.HasGroup(other) = true, want false")
+	}
+
+	if got := identity.Attribute("email"); got != "jens@example.com" {
+		t.Errorf("Identity.Attribute(email) = %v, want jens@example.com", got)
+	}
+
+	if got := identity.Attribute("other"); got != "" {
+		t.Errorf("Identity.Attribute(other) = %v, want empty", got)
+	}
+}
@@ -2,16 +2,37 @@ package registry
 
 import (
 	"context"
-	"fmt"
-	"github.com/labstack/echo/v4"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
 )
 
-//TODO(JensvandeWiel) Implement real authorizer
-
 // Authorizer is an interface for authorizing requests. It is used to check if a token request is allowed to perform certain actions.
 type Authorizer interface {
-	// Authorize authorizes the request and returns the allowed actions. If one of the actions is not allowed, an error is returned. Context is used to pass extra information to the authorizer, like the request context.
-	Authorize(ctx context.Context, req *AuthorizationRequest) (ActionSet, error)
+	// Authorize authorizes a single scope of the request and returns the allowed actions for that scope. If the scope can not be authorized, an error is returned. Context is used to pass extra information to the authorizer, like the request context.
+	Authorize(ctx context.Context, req *AuthorizationRequest, scope *Scope) (ActionSet, error)
+}
+
+// AuthorizeScopes authorizes every scope of the request with the given authorizer and returns the granted scopes, each holding the actions the authorizer allowed for it, restricted to the allowed scopes of the identity of the request. Errors of the authorizer that are not an *Error are returned as ErrDenied, with the error as cause.
+func AuthorizeScopes(ctx context.Context, authorizer Authorizer, req *AuthorizationRequest) ([]*Scope, error) {
+	granted := make([]*Scope, 0, len(req.Scopes))
+	for _, scope := range req.Scopes {
+		actions, err := authorizer.Authorize(ctx, req, scope)
+		if err != nil {
+			var e *Error
+			if !errors.As(err, &e) {
+				err = ErrDenied.WithCause(err)
+			}
+			return nil, err
+		}
+		granted = append(granted, &Scope{
+			Type:    scope.Type,
+			Name:    scope.Name,
+			Actions: req.Identity.restrictActions(scope, actions),
+		})
+	}
+	return granted, nil
 }
 
 type AccessType string
@@ -35,55 +56,53 @@ func parseAccessType(accessType string) AccessType {
 type AuthorizationRequest struct {
 	Account    string
 	Service    string
-	Type       ScopeType
-	Name       string
+	Scopes     []*Scope
 	IP         string
-	Actions    ActionSet
 	ClientId   string
 	AccessType AccessType
+	// Identity is the identity of the authenticated user, it is set by the TokenHandler after authentication.
+	Identity *Identity
+}
+
+// AuthorizationRequestFromRequest parses the query parameters of a token request, as described in https://distribution.github.io/distribution/spec/auth/token/.
+func AuthorizationRequestFromRequest(r *http.Request) (*AuthorizationRequest, error) {
+	return authorizationRequestFromQuery(r.URL.Query(), true)
 }
 
-func AuthorizationRequestFromContext(ctx echo.Context) (*AuthorizationRequest, error) {
-	q := ctx.QueryParams()
+// authorizationRequestFromQuery parses the query parameters of a token request. The account is optional when requireAccount is false, for requests that are not authenticated with basic auth.
+func authorizationRequestFromQuery(q url.Values, requireAccount bool) (*AuthorizationRequest, error) {
 	req := &AuthorizationRequest{}
 	if account := q.Get("account"); account != "" {
 		req.Account = account
-	} else {
-		return nil, fmt.Errorf("account is required")
+	} else if requireAccount {
+		return nil, ErrInvalidRequest.WithDetail("account is required")
 	}
 
 	if service := q.Get("service"); service != "" {
 		req.Service = service
 	} else {
-		return nil, fmt.Errorf("service is required")
+		return nil, ErrInvalidRequest.WithDetail("service is required")
 	}
 
 	if clientId := q.Get("client_id"); clientId != "" {
 		req.ClientId = clientId
 	} else {
-		return nil, fmt.Errorf("client_id is required")
+		return nil, ErrInvalidRequest.WithDetail("client_id is required")
 	}
 
-	req.AccessType = parseAccessType(q.Get("access_type"))
-
-	if req.AccessType == AccessTypeOffline {
-		return nil, fmt.Errorf("offline access type is not yet supported")
+	// Docker clients ask for a refresh token with offline_token=true, OAuth2 clients use access_type=offline.
+	if offline, _ := strconv.ParseBool(q.Get("offline_token")); offline {
+		req.AccessType = AccessTypeOffline
+	} else {
+		req.AccessType = parseAccessType(q.Get("access_type"))
 	}
 
-	if scope := q.Get("scope"); scope != "" {
-		scope, err := ParseScope(scope)
-		if err != nil {
-			return nil, err
-		}
-		req.Type = scope.Type
-		req.Name = scope.Name
-		req.Actions = scope.Actions
-		if req.Account == "" {
-			req.Account = scope.Name
-		}
-	} else {
-		return nil, fmt.Errorf("scope is required")
+	// The scope parameter may be given multiple times, or not at all when only authentication is requested (e.g. docker login).
+	scopes, err := ParseScopes(q["scope"])
+	if err != nil {
+		return nil, err
 	}
+	req.Scopes = scopes
 
 	return req, nil
 }
@@ -96,7 +115,7 @@ func NewDummyAuthorizer() *DummyAuthorizer {
 	return &DummyAuthorizer{}
 }
 
-// Authorize always returns the request actions.
-func (a *DummyAuthorizer) Authorize(ctx context.Context, req *AuthorizationRequest) (ActionSet, error) {
-	return req.Actions, nil
+// Authorize always returns the requested actions of the scope.
+func (a *DummyAuthorizer) Authorize(ctx context.Context, req *AuthorizationRequest, scope *Scope) (ActionSet, error) {
+	return scope.Actions, nil
 }
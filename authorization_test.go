@@ -1,12 +1,11 @@
 package registry
 
 import (
+	"context"
 	"fmt"
-	"github.com/labstack/echo/v4"
 	"github.com/magiconair/properties/assert"
 	"net/http"
 	"net/http/httptest"
-	"strings"
 	"testing"
 )
 
@@ -14,73 +13,136 @@ type mockAuthorizer struct {
 	actions ActionSet
 }
 
-func (m *mockAuthorizer) Authorize(req *AuthorizationRequest) (ActionSet, error) {
-	found := m.actions.ContainsAll(req.Actions)
+func (m *mockAuthorizer) Authorize(ctx context.Context, req *AuthorizationRequest, scope *Scope) (ActionSet, error) {
+	found := m.actions.ContainsAll(scope.Actions)
 	if !found {
 		return nil, fmt.Errorf("one or more actions are not allowed")
 	}
 
-	return req.Actions, nil
+	return scope.Actions, nil
 }
 
 func TestCanParseAuthorizationRequest(t *testing.T) {
-	e := echo.New()
-	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(""))
-	rec := httptest.NewRecorder()
-	c := e.NewContext(req, rec)
-	c.QueryParams().Set("account", "test")
-	c.QueryParams().Set("service", "test")
-	c.QueryParams().Set("scope", "repository:foo/bar:pull,push")
+	req := httptest.NewRequest(http.MethodGet, "/?account=test&service=test&client_id=test&scope=repository:foo/bar:pull,push", nil)
 	want := &AuthorizationRequest{
 		Account: "test",
 		Service: "test",
-		Type:    "repository",
-		Name:    "foo/bar",
-		Actions: ActionSet{ActionPull, ActionPush},
+		Scopes: []*Scope{
+			{Type: ScopeTypeRepository, Name: "foo/bar", Actions: ActionSet{ActionPull, ActionPush}},
+		},
 	}
 
-	got, err := AuthorizationRequestFromContext(c)
+	got, err := AuthorizationRequestFromRequest(req)
 	if err != nil {
-		t.Errorf("AuthorizationRequestFromContext() error = %v", err)
+		t.Errorf("AuthorizationRequestFromRequest() error = %v", err)
 		return
 	}
 
 	if got.Account != want.Account {
-		t.Errorf("AuthorizationRequestFromContext() got.Account = %v, want %v", got.Account, want.Account)
+		t.Errorf("AuthorizationRequestFromRequest() got.Account = %v, want %v", got.Account, want.Account)
 	}
 
 	if got.Service != want.Service {
-		t.Errorf("AuthorizationRequestFromContext() got.Service = %v, want %v", got.Service, want.Service)
+		t.Errorf("AuthorizationRequestFromRequest() got.Service = %v, want %v", got.Service, want.Service)
+	}
+
+	if len(got.Scopes) != len(want.Scopes) {
+		t.Errorf("AuthorizationRequestFromRequest() got.Scopes = %v, want %v", got.Scopes, want.Scopes)
+		return
+	}
+
+	if !got.Scopes[0].Matches(want.Scopes[0]) {
+		t.Errorf("AuthorizationRequestFromRequest() got.Scopes[0] = %v, want %v", got.Scopes[0], want.Scopes[0])
+	}
+
+	if !got.Scopes[0].Actions.ContainsAll(want.Scopes[0].Actions) {
+		t.Errorf("AuthorizationRequestFromRequest() got.Scopes[0].Actions = %v, want %v", got.Scopes[0].Actions, want.Scopes[0].Actions)
+	}
+}
+
+func TestCanParseAuthorizationRequestWithMultipleScopes(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/?account=test&service=test&client_id=test&scope=repository:foo/bar:pull&scope=repository:foo/baz:pull,push", nil)
+
+	got, err := AuthorizationRequestFromRequest(req)
+	if err != nil {
+		t.Errorf("AuthorizationRequestFromRequest() error = %v", err)
+		return
+	}
+
+	if len(got.Scopes) != 2 {
+		t.Errorf("AuthorizationRequestFromRequest() got %d scopes, want 2", len(got.Scopes))
+		return
+	}
+
+	if got.Scopes[0].String() != "repository:foo/bar:pull" {
+		t.Errorf("AuthorizationRequestFromRequest() got.Scopes[0] = %v, want repository:foo/bar:pull", got.Scopes[0])
+	}
+
+	if got.Scopes[1].String() != "repository:foo/baz:pull,push" {
+		t.Errorf("AuthorizationRequestFromRequest() got.Scopes[1] = %v, want repository:foo/baz:pull,push", got.Scopes[1])
 	}
+}
 
-	if got.Type != want.Type {
-		t.Errorf("AuthorizationRequestFromContext() got.Type = %v, want %v", got.Type, want.Type)
+func TestAuthorizeScopes(t *testing.T) {
+	mock := &mockAuthorizer{actions: ActionSet{ActionPull, ActionPush}}
+	req := &AuthorizationRequest{
+		Scopes: []*Scope{
+			{Type: ScopeTypeRepository, Name: "foo/bar", Actions: ActionSet{ActionPull}},
+			{Type: ScopeTypeRepository, Name: "foo/baz", Actions: ActionSet{ActionPull, ActionPush}},
+		},
 	}
 
-	if got.Name != want.Name {
-		t.Errorf("AuthorizationRequestFromContext() got.Name = %v, want %v", got.Name, want.Name)
+	granted, err := AuthorizeScopes(context.Background(), mock, req)
+	if err != nil {
+		t.Errorf("AuthorizeScopes() error = %v", err)
+		return
 	}
 
-	if len(got.Actions) != len(want.Actions) {
-		t.Errorf("AuthorizationRequestFromContext() got.Actions = %v, want %v", got.Actions, want.Actions)
+	assert.Equal(t, len(granted), 2)
+	assert.Equal(t, granted[0].String(), "repository:foo/bar:pull")
+	assert.Equal(t, granted[1].String(), "repository:foo/baz:pull,push")
+
+	req.Scopes = append(req.Scopes, &Scope{Type: ScopeTypeRegistry, Name: "catalog", Actions: ActionSet{ActionAll}})
+	if _, err := AuthorizeScopes(context.Background(), mock, req); err == nil {
+		t.Errorf("AuthorizeScopes() error = nil, want error")
 	}
+}
 
-	if !got.Actions.ContainsAll(want.Actions) {
-		t.Errorf("AuthorizationRequestFromContext() got.Actions = %v, want %v", got.Actions, want.Actions)
+func TestAuthorizeScopesRestrictedIdentity(t *testing.T) {
+	req := &AuthorizationRequest{
+		Scopes: []*Scope{
+			{Type: ScopeTypeRepository, Name: "foo/bar", Actions: ActionSet{ActionPull, ActionPush}},
+			{Type: ScopeTypeRepository, Name: "foo/baz", Actions: ActionSet{ActionPull}},
+		},
+		Identity: &Identity{
+			Subject: "ci",
+			AllowedScopes: []*Scope{
+				{Type: ScopeTypeRepository, Name: "foo/bar", Actions: ActionSet{ActionPull}},
+			},
+		},
 	}
+
+	granted, err := AuthorizeScopes(context.Background(), NewDummyAuthorizer(), req)
+	if err != nil {
+		t.Errorf("AuthorizeScopes() error = %v", err)
+		return
+	}
+
+	assert.Equal(t, granted[0].String(), "repository:foo/bar:pull")
+	assert.Equal(t, len(granted[1].Actions), 0)
 }
 
 func TestAuth_Authorize(t *testing.T) {
 	tests := []struct {
 		name    string
 		has     ActionSet
-		req     *AuthorizationRequest
+		scope   *Scope
 		wantErr bool
 	}{
 		{
 			name: "HasAllActions",
 			has:  ActionSet{ActionPull, ActionPush, ActionCatalog, ActionAll, ActionAdmin},
-			req: &AuthorizationRequest{
+			scope: &Scope{
 				Actions: ActionSet{ActionPull, ActionPush},
 			},
 			wantErr: false,
@@ -88,7 +150,7 @@ func TestAuth_Authorize(t *testing.T) {
 		{
 			name: "HasSomeActions",
 			has:  ActionSet{ActionPull, ActionPush},
-			req: &AuthorizationRequest{
+			scope: &Scope{
 				Actions: ActionSet{ActionPull, ActionPush, ActionCatalog},
 			},
 			wantErr: true,
@@ -96,7 +158,7 @@ func TestAuth_Authorize(t *testing.T) {
 		{
 			name: "HasNoActions",
 			has:  ActionSet{},
-			req: &AuthorizationRequest{
+			scope: &Scope{
 				Actions: ActionSet{ActionPull, ActionPush, ActionCatalog, ActionAll, ActionAdmin},
 			},
 			wantErr: true,
@@ -110,7 +172,7 @@ func TestAuth_Authorize(t *testing.T) {
 				actions: tt.has,
 			}
 
-			got, err := mock.Authorize(tt.req)
+			got, err := mock.Authorize(context.Background(), &AuthorizationRequest{}, tt.scope)
 
 			if err != nil {
 				if !tt.wantErr {
@@ -119,9 +181,22 @@ func TestAuth_Authorize(t *testing.T) {
 
 				return
 			}
-			assert.Equal(t, got, tt.req.Actions)
+			assert.Equal(t, got, tt.scope.Actions)
 
 		})
 
 	}
 }
+
+func TestParseAuthorizationRequestOfflineToken(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/?account=test&service=test&client_id=test&offline_token=true", nil)
+
+	got, err := AuthorizationRequestFromRequest(req)
+	if err != nil {
+		t.Errorf("AuthorizationRequestFromRequest() error = %v", err)
+		return
+	}
+
+	assert.Equal(t, got.AccessType, AccessTypeOffline)
+	assert.Equal(t, len(got.Scopes), 0)
+}
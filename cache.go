@@ -0,0 +1,181 @@
+package registry
+
+import (
+	"container/list"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+// CacheOptions contains the options for a CachingAuthenticator.
+type CacheOptions struct {
+	// TTL is how long a successful authentication is remembered. Defaults to 5 minutes.
+	TTL time.Duration
+	// NegativeTTL is how long a failed authentication is remembered, so a client retrying with a wrong password does not hit the backend every time. Defaults to 10 seconds, a negative value disables caching failures.
+	NegativeTTL time.Duration
+	// MaxEntries is the maximum number of cached results, the least recently used result is evicted when it is reached. Defaults to 1000.
+	MaxEntries int
+}
+
+// CachingAuthenticator is an authenticator remembering the results of another authenticator, so the many token requests of a single docker pull do not all hit a slow backend. Successful authentications are cached for the TTL, failed authentications because of wrong credentials for the NegativeTTL. Other errors, like an unreachable backend, are never cached. It is safe for concurrent use.
+type CachingAuthenticator struct {
+	authenticator IdentityAuthenticator
+	options       CacheOptions
+	// key is a random key to hash the credentials with, so the cache does not hold passwords or hashes that can be cracked offline.
+	key []byte
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type cacheEntry struct {
+	key       string
+	user      string
+	identity  *Identity
+	err       error
+	expiresAt time.Time
+}
+
+// NewCachingAuthenticator creates a new CachingAuthenticator for the given authenticator. Use AdaptAuthenticator to cache an Authenticator.
+func NewCachingAuthenticator(authenticator IdentityAuthenticator, options CacheOptions) (*CachingAuthenticator, error) {
+	if options.TTL == 0 {
+		options.TTL = 5 * time.Minute
+	}
+	if options.NegativeTTL == 0 {
+		options.NegativeTTL = 10 * time.Second
+	}
+	if options.MaxEntries <= 0 {
+		options.MaxEntries = 1000
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	return &CachingAuthenticator{
+		authenticator: authenticator,
+		options:       options,
+		key:           key,
+		now:           time.Now,
+		entries:       make(map[string]*list.Element),
+		lru:           list.New(),
+	}, nil
+}
+
+// AuthenticateIdentity returns the cached result for the user and password, or authenticates with the wrapped authenticator and caches the result.
+func (a *CachingAuthenticator) AuthenticateIdentity(ctx context.Context, user string, pass string) (*Identity, error) {
+	key := a.cacheKey(user, pass)
+
+	if entry, ok := a.get(key); ok {
+		if entry.err != nil {
+			return nil, entry.err
+		}
+		// The identity is copied, so callers changing it do not change the cached identity.
+		return entry.identity.Clone(), nil
+	}
+
+	identity, err := a.authenticator.AuthenticateIdentity(ctx, user, pass)
+	switch {
+	case err == nil && identity != nil:
+		a.put(key, user, identity.Clone(), nil, a.options.TTL)
+	case errors.Is(err, ErrInvalidCredentials) && a.options.NegativeTTL > 0:
+		a.put(key, user, nil, err, a.options.NegativeTTL)
+	}
+	return identity, err
+}
+
+// LookupIdentity looks up the current identity of the user with the wrapped authenticator, see IdentityLookup. Lookups are not cached, so users that are deleted or disabled lose access right away.
+func (a *CachingAuthenticator) LookupIdentity(ctx context.Context, subject string) (*Identity, error) {
+	return lookupIdentity(ctx, a.authenticator, subject)
+}
+
+// Invalidate removes the cached results of the user, like after a password change.
+func (a *CachingAuthenticator) Invalidate(user string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for element := a.lru.Front(); element != nil; {
+		next := element.Next()
+		if element.Value.(*cacheEntry).user == user {
+			a.remove(element)
+		}
+		element = next
+	}
+}
+
+// Purge removes all cached results.
+func (a *CachingAuthenticator) Purge() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.entries = make(map[string]*list.Element)
+	a.lru.Init()
+}
+
+// Len returns the number of cached results, including expired results that have not been evicted yet.
+func (a *CachingAuthenticator) Len() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.lru.Len()
+}
+
+func (a *CachingAuthenticator) get(key string) (*cacheEntry, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	element, ok := a.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := element.Value.(*cacheEntry)
+	if !a.now().Before(entry.expiresAt) {
+		a.remove(element)
+		return nil, false
+	}
+
+	a.lru.MoveToFront(element)
+	return entry, true
+}
+
+func (a *CachingAuthenticator) put(key, user string, identity *Identity, err error, ttl time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if element, ok := a.entries[key]; ok {
+		a.remove(element)
+	}
+
+	a.entries[key] = a.lru.PushFront(&cacheEntry{
+		key:       key,
+		user:      user,
+		identity:  identity,
+		err:       err,
+		expiresAt: a.now().Add(ttl),
+	})
+
+	for a.lru.Len() > a.options.MaxEntries {
+		a.remove(a.lru.Back())
+	}
+}
+
+func (a *CachingAuthenticator) remove(element *list.Element) {
+	a.lru.Remove(element)
+	delete(a.entries, element.Value.(*cacheEntry).key)
+}
+
+func (a *CachingAuthenticator) cacheKey(user, pass string) string {
+	mac := hmac.New(sha256.New, a.key)
+	// The length prefix keeps user "ab" with password "c" apart from user "a" with password "bc".
+	_ = binary.Write(mac, binary.BigEndian, uint64(len(user)))
+	mac.Write([]byte(user))
+	mac.Write([]byte(pass))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,116 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestCachingAuthenticator(t *testing.T, backend IdentityAuthenticator, options CacheOptions) (*CachingAuthenticator, *time.Time) {
+	a, err := NewCachingAuthenticator(backend, options)
+	assert.NoError(t, err)
+
+	now := time.Now()
+	a.now = func() time.Time { return now }
+	return a, &now
+}
+
+func TestCachingAuthenticator(t *testing.T) {
+	backend := &chainTestBackend{user: "jens", pass: "secret", groups: []string{"developers"}}
+	a, now := newTestCachingAuthenticator(t, backend, CacheOptions{TTL: time.Minute, NegativeTTL: time.Second})
+
+	for i := 0; i < 3; i++ {
+		identity, err := a.AuthenticateIdentity(context.Background(), "jens", "secret")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"developers"}, identity.Groups)
+
+		// Changing the returned identity must not change the cached identity
+		identity.Groups = append(identity.Groups, "admins")
+		identity.Backend = "changed"
+	}
+	assert.Equal(t, 1, backend.calls)
+
+	// Another password is not answered from the cache
+	for i := 0; i < 3; i++ {
+		_, err := a.AuthenticateIdentity(context.Background(), "jens", "wrong")
+		assert.True(t, errors.Is(err, ErrInvalidCredentials))
+	}
+	assert.Equal(t, 2, backend.calls)
+
+	// Failures expire before successes
+	*now = now.Add(2 * time.Second)
+	_, err := a.AuthenticateIdentity(context.Background(), "jens", "wrong")
+	assert.Error(t, err)
+	_, err = a.AuthenticateIdentity(context.Background(), "jens", "secret")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, backend.calls)
+
+	*now = now.Add(time.Minute)
+	_, err = a.AuthenticateIdentity(context.Background(), "jens", "secret")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, backend.calls)
+
+	a.Invalidate("jens")
+	assert.Equal(t, 0, a.Len())
+}
+
+func TestCachingAuthenticator_BackendFailuresAreNotCached(t *testing.T) {
+	backend := &chainTestBackend{user: "jens", pass: "secret", err: ErrUnknown.WithDetail("connection refused")}
+	a, _ := newTestCachingAuthenticator(t, backend, CacheOptions{})
+
+	_, err := a.AuthenticateIdentity(context.Background(), "jens", "secret")
+	assert.True(t, errors.Is(err, ErrUnknown))
+
+	backend.err = nil
+	_, err = a.AuthenticateIdentity(context.Background(), "jens", "secret")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, backend.calls)
+}
+
+func TestCachingAuthenticator_Eviction(t *testing.T) {
+	backend := &chainTestBackend{user: "jens", pass: "secret"}
+	a, _ := newTestCachingAuthenticator(t, backend, CacheOptions{MaxEntries: 2})
+
+	_, _ = a.AuthenticateIdentity(context.Background(), "jens", "secret")
+	_, _ = a.AuthenticateIdentity(context.Background(), "jens", "first")
+	// Using the first entry again makes the second the least recently used
+	_, _ = a.AuthenticateIdentity(context.Background(), "jens", "secret")
+	_, _ = a.AuthenticateIdentity(context.Background(), "jens", "second")
+	assert.Equal(t, 2, a.Len())
+	assert.Equal(t, 3, backend.calls)
+
+	_, err := a.AuthenticateIdentity(context.Background(), "jens", "secret")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, backend.calls)
+
+	_, _ = a.AuthenticateIdentity(context.Background(), "jens", "first")
+	assert.Equal(t, 4, backend.calls)
+
+	a.Purge()
+	assert.Equal(t, 0, a.Len())
+}
+
+func TestCachingAuthenticator_Concurrent(t *testing.T) {
+	a, err := NewCachingAuthenticator(&DummyAuthenticator{}, CacheOptions{MaxEntries: 10})
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				user := fmt.Sprintf("user%d", (i+j)%15)
+				identity, err := a.AuthenticateIdentity(context.Background(), user, "secret")
+				assert.NoError(t, err)
+				assert.Equal(t, user, identity.Subject)
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.LessOrEqual(t, a.Len(), 10)
+}
@@ -0,0 +1,185 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ChainPolicy decides how the ChainAuthenticator combines the results of its backends.
+type ChainPolicy int
+
+const (
+	// ChainFirstSuccess tries the backends in order and authenticates the user with the first backend that succeeds.
+	ChainFirstSuccess ChainPolicy = iota
+	// ChainStopOnInvalidCredentials tries the backends in order like ChainFirstSuccess, but stops at the first backend the user exists in. A wrong password for a user of one backend is not tried against the next backends. Backends must return ErrUnknownUser for users they do not know.
+	ChainStopOnInvalidCredentials
+	// ChainRequireAll requires every backend to authenticate the user. The identity is the one of the first backend, with the groups and attributes of the other backends added.
+	ChainRequireAll
+)
+
+// String returns the string representation of a ChainPolicy.
+func (p ChainPolicy) String() string {
+	switch p {
+	case ChainFirstSuccess:
+		return "first_success"
+	case ChainStopOnInvalidCredentials:
+		return "stop_on_invalid_credentials"
+	case ChainRequireAll:
+		return "require_all"
+	}
+	return fmt.Sprintf("ChainPolicy(%d)", int(p))
+}
+
+// ChainBackend is a named authenticator in a ChainAuthenticator. The name is reported as the backend of the identity.
+type ChainBackend struct {
+	Name          string
+	Authenticator IdentityAuthenticator
+}
+
+// ChainAuthenticator is an authenticator combining multiple authenticators, like htpasswd robot accounts and LDAP users, on one realm. The ChainPolicy decides which backends are tried and when the chain succeeds. The name of the backend that authenticated the user is set as backend of the identity.
+type ChainAuthenticator struct {
+	policy   ChainPolicy
+	backends []ChainBackend
+}
+
+// NewChainAuthenticator creates a new ChainAuthenticator with the given policy and backends, which are tried in the given order. Every backend must have a unique name.
+func NewChainAuthenticator(policy ChainPolicy, backends ...ChainBackend) (*ChainAuthenticator, error) {
+	if policy < ChainFirstSuccess || policy > ChainRequireAll {
+		return nil, fmt.Errorf("unknown chain policy: %s", policy)
+	}
+
+	if len(backends) == 0 {
+		return nil, fmt.Errorf("chain needs at least one backend")
+	}
+
+	names := make([]string, 0, len(backends))
+	for i, backend := range backends {
+		if backend.Name == "" {
+			return nil, fmt.Errorf("backend %d has no name", i)
+		}
+		if backend.Authenticator == nil {
+			return nil, fmt.Errorf("backend %s has no authenticator", backend.Name)
+		}
+		if containsString(names, backend.Name) {
+			return nil, fmt.Errorf("backend %s is declared more than once", backend.Name)
+		}
+		names = append(names, backend.Name)
+	}
+
+	return &ChainAuthenticator{
+		policy:   policy,
+		backends: backends,
+	}, nil
+}
+
+// AuthenticateIdentity authenticates the user with the backends of the chain, according to its policy.
+func (a *ChainAuthenticator) AuthenticateIdentity(ctx context.Context, user string, pass string) (*Identity, error) {
+	return a.run(func(backend ChainBackend) (*Identity, error) {
+		return backend.Authenticator.AuthenticateIdentity(ctx, user, pass)
+	})
+}
+
+// LookupIdentity looks up the user in the backends that implement IdentityLookup, according to the policy of the chain. Backends that do not implement it do not know the user, so with ChainRequireAll they fail the lookup.
+func (a *ChainAuthenticator) LookupIdentity(ctx context.Context, subject string) (*Identity, error) {
+	return a.run(func(backend ChainBackend) (*Identity, error) {
+		lookup, ok := backend.Authenticator.(IdentityLookup)
+		if !ok {
+			return nil, ErrUnknownUser
+		}
+		return lookup.LookupIdentity(ctx, subject)
+	})
+}
+
+// run calls fn for the backends of the chain, according to its policy.
+func (a *ChainAuthenticator) run(fn func(backend ChainBackend) (*Identity, error)) (*Identity, error) {
+	if a.policy == ChainRequireAll {
+		return a.runAll(fn)
+	}
+
+	var failure error
+	for _, backend := range a.backends {
+		identity, err := a.call(backend, fn)
+		if err == nil {
+			return identity, nil
+		}
+
+		if a.policy == ChainStopOnInvalidCredentials && errors.Is(err, ErrInvalidCredentials) && !errors.Is(err, ErrUnknownUser) {
+			return nil, err
+		}
+		failure = worseChainFailure(failure, err)
+	}
+	return nil, failure
+}
+
+func (a *ChainAuthenticator) runAll(fn func(backend ChainBackend) (*Identity, error)) (*Identity, error) {
+	var combined *Identity
+	names := make([]string, 0, len(a.backends))
+	for _, backend := range a.backends {
+		identity, err := a.call(backend, fn)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, backend.Name)
+
+		if combined == nil {
+			combined = identity
+			continue
+		}
+
+		for _, group := range identity.Groups {
+			if !combined.HasGroup(group) {
+				combined.Groups = append(combined.Groups, group)
+			}
+		}
+		for name, value := range identity.Attributes {
+			if _, ok := combined.Attributes[name]; ok {
+				continue
+			}
+			if combined.Attributes == nil {
+				combined.Attributes = make(map[string]string)
+			}
+			combined.Attributes[name] = value
+		}
+	}
+
+	combined.Backend = strings.Join(names, ",")
+	return combined, nil
+}
+
+// call calls fn for a single backend and sets the backend of a copy of the identity. Backends may return an identity they keep themselves, so it is never changed in place.
+func (a *ChainAuthenticator) call(backend ChainBackend, fn func(backend ChainBackend) (*Identity, error)) (*Identity, error) {
+	identity, err := fn(backend)
+	if err != nil {
+		return nil, err
+	}
+	if identity == nil {
+		return nil, ErrUnknown.WithCause(fmt.Errorf("backend %s returned no identity", backend.Name))
+	}
+
+	identity = identity.Clone()
+	identity.Backend = backend.Name
+	return identity, nil
+}
+
+// worseChainFailure returns the failure to report when no backend authenticated the user. A backend failing for another reason than the credentials, like an unreachable server, is reported over a wrong password, which is reported over an unknown user.
+func worseChainFailure(failure, err error) error {
+	rank := func(err error) int {
+		switch {
+		case err == nil:
+			return 0
+		case errors.Is(err, ErrUnknownUser):
+			return 1
+		case errors.Is(err, ErrInvalidCredentials):
+			return 2
+		default:
+			return 3
+		}
+	}
+
+	if rank(err) > rank(failure) {
+		return err
+	}
+	return failure
+}
@@ -0,0 +1,185 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// chainTestBackend knows a single user, or fails every authentication with err if it is set.
+type chainTestBackend struct {
+	user   string
+	pass   string
+	groups []string
+	err    error
+	calls  int
+}
+
+func (b *chainTestBackend) AuthenticateIdentity(ctx context.Context, user string, pass string) (*Identity, error) {
+	b.calls++
+	switch {
+	case b.err != nil:
+		return nil, b.err
+	case user != b.user:
+		return nil, ErrUnknownUser
+	case pass != b.pass:
+		return nil, ErrInvalidCredentials
+	}
+	return &Identity{
+		Subject:    user,
+		Groups:     append([]string(nil), b.groups...),
+		Attributes: map[string]string{"backend_user": b.user},
+		Method:     AuthMethodPassword,
+	}, nil
+}
+
+func (b *chainTestBackend) LookupIdentity(ctx context.Context, subject string) (*Identity, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	return b.AuthenticateIdentity(ctx, subject, b.pass)
+}
+
+func TestChainAuthenticator_FirstSuccess(t *testing.T) {
+	robots := &chainTestBackend{user: "ci", pass: "robot"}
+	humans := &chainTestBackend{user: "jens", pass: "secret"}
+	a, err := NewChainAuthenticator(ChainFirstSuccess, ChainBackend{"htpasswd", robots}, ChainBackend{"ldap", humans})
+	assert.NoError(t, err)
+
+	identity, err := a.AuthenticateIdentity(context.Background(), "jens", "secret")
+	assert.NoError(t, err)
+	assert.Equal(t, "ldap", identity.Backend)
+
+	identity, err = a.AuthenticateIdentity(context.Background(), "ci", "robot")
+	assert.NoError(t, err)
+	assert.Equal(t, "htpasswd", identity.Backend)
+
+	// Every backend is tried, also after a wrong password
+	humans.user = "ci"
+	identity, err = a.AuthenticateIdentity(context.Background(), "ci", "secret")
+	assert.NoError(t, err)
+	assert.Equal(t, "ldap", identity.Backend)
+
+	_, err = a.AuthenticateIdentity(context.Background(), "unknown", "secret")
+	assert.True(t, errors.Is(err, ErrUnknownUser))
+
+	_, err = a.AuthenticateIdentity(context.Background(), "ci", "wrong")
+	assert.True(t, errors.Is(err, ErrInvalidCredentials))
+	assert.False(t, errors.Is(err, ErrUnknownUser))
+
+	// A failing backend is reported over the credentials
+	humans.err = ErrUnknown.WithDetail("ldap: connection refused")
+	_, err = a.AuthenticateIdentity(context.Background(), "ci", "wrong")
+	assert.True(t, errors.Is(err, ErrUnknown))
+
+	_, err = a.AuthenticateIdentity(context.Background(), "ci", "robot")
+	assert.NoError(t, err)
+}
+
+func TestChainAuthenticator_StopOnInvalidCredentials(t *testing.T) {
+	robots := &chainTestBackend{user: "jens", pass: "robot"}
+	humans := &chainTestBackend{user: "jens", pass: "secret"}
+	a, err := NewChainAuthenticator(ChainStopOnInvalidCredentials, ChainBackend{"htpasswd", robots}, ChainBackend{"ldap", humans})
+	assert.NoError(t, err)
+
+	_, err = a.AuthenticateIdentity(context.Background(), "jens", "secret")
+	assert.True(t, errors.Is(err, ErrInvalidCredentials))
+	assert.Equal(t, 0, humans.calls)
+
+	// Unknown users and failing backends fall through to the next backend
+	for _, err := range []error{ErrUnknownUser, ErrUnknown} {
+		robots.err = err
+		identity, err := a.AuthenticateIdentity(context.Background(), "jens", "secret")
+		assert.NoError(t, err)
+		assert.Equal(t, "ldap", identity.Backend)
+	}
+}
+
+func TestChainAuthenticator_RequireAll(t *testing.T) {
+	first := &chainTestBackend{user: "jens", pass: "secret", groups: []string{"developers"}}
+	second := &chainTestBackend{user: "jens", pass: "secret", groups: []string{"developers", "admins"}}
+	a, err := NewChainAuthenticator(ChainRequireAll, ChainBackend{"ldap", first}, ChainBackend{"sql", second})
+	assert.NoError(t, err)
+
+	identity, err := a.AuthenticateIdentity(context.Background(), "jens", "secret")
+	assert.NoError(t, err)
+	assert.Equal(t, "ldap,sql", identity.Backend)
+	assert.Equal(t, []string{"developers", "admins"}, identity.Groups)
+	assert.Equal(t, "jens", identity.Attribute("backend_user"))
+
+	second.pass = "other"
+	_, err = a.AuthenticateIdentity(context.Background(), "jens", "secret")
+	assert.True(t, errors.Is(err, ErrInvalidCredentials))
+}
+
+// sharedIdentityBackend returns the same identity for every authentication, like a backend caching identities.
+type sharedIdentityBackend struct {
+	identity *Identity
+}
+
+func (b *sharedIdentityBackend) AuthenticateIdentity(ctx context.Context, user string, pass string) (*Identity, error) {
+	return b.identity, nil
+}
+
+func TestChainAuthenticator_DoesNotChangeBackendIdentities(t *testing.T) {
+	first := &sharedIdentityBackend{identity: &Identity{Subject: "jens", Groups: []string{"developers"}, Attributes: map[string]string{"dn": "uid=jens"}}}
+	second := &sharedIdentityBackend{identity: &Identity{Subject: "jens", Groups: []string{"admins"}, Attributes: map[string]string{"team": "platform"}}}
+	a, err := NewChainAuthenticator(ChainRequireAll, ChainBackend{"ldap", first}, ChainBackend{"sql", second})
+	assert.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		identity, err := a.AuthenticateIdentity(context.Background(), "jens", "secret")
+		assert.NoError(t, err)
+		assert.Equal(t, "ldap,sql", identity.Backend)
+		assert.Equal(t, []string{"developers", "admins"}, identity.Groups)
+		assert.Equal(t, "platform", identity.Attribute("team"))
+	}
+
+	assert.Equal(t, &Identity{Subject: "jens", Groups: []string{"developers"}, Attributes: map[string]string{"dn": "uid=jens"}}, first.identity)
+	assert.Equal(t, &Identity{Subject: "jens", Groups: []string{"admins"}, Attributes: map[string]string{"team": "platform"}}, second.identity)
+}
+
+func TestChainAuthenticator_LookupIdentity(t *testing.T) {
+	robots := &chainTestBackend{user: "ci", pass: "robot"}
+	humans := &chainTestBackend{user: "jens", pass: "secret", groups: []string{"developers"}}
+	a, err := NewChainAuthenticator(ChainFirstSuccess, ChainBackend{"htpasswd", robots}, ChainBackend{"ldap", humans})
+	assert.NoError(t, err)
+
+	identity, err := a.LookupIdentity(context.Background(), "jens")
+	assert.NoError(t, err)
+	assert.Equal(t, "ldap", identity.Backend)
+	assert.Equal(t, []string{"developers"}, identity.Groups)
+
+	_, err = a.LookupIdentity(context.Background(), "unknown")
+	assert.True(t, errors.Is(err, ErrUnknownUser))
+
+	// With require all, backends that can not look up users fail the lookup
+	a, err = NewChainAuthenticator(ChainRequireAll, ChainBackend{"ldap", humans}, ChainBackend{"static", AdaptAuthenticator(newMockAuthenticator("jens", "secret"))})
+	assert.NoError(t, err)
+	_, err = a.LookupIdentity(context.Background(), "jens")
+	assert.True(t, errors.Is(err, ErrUnknownUser))
+}
+
+func TestNewChainAuthenticatorInvalid(t *testing.T) {
+	backend := &chainTestBackend{}
+
+	tests := []struct {
+		name     string
+		policy   ChainPolicy
+		backends []ChainBackend
+	}{
+		{"TestNoBackends", ChainFirstSuccess, nil},
+		{"TestUnknownPolicy", ChainPolicy(42), []ChainBackend{{"a", backend}}},
+		{"TestNoName", ChainFirstSuccess, []ChainBackend{{"", backend}}},
+		{"TestNoAuthenticator", ChainFirstSuccess, []ChainBackend{{"a", nil}}},
+		{"TestDuplicateName", ChainFirstSuccess, []ChainBackend{{"a", backend}, {"a", backend}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewChainAuthenticator(tt.policy, tt.backends...)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,281 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// CertificateAccountField is the field of a client certificate the account is taken from.
+type CertificateAccountField string
+
+const (
+	// CertificateCommonName takes the account from the common name of the subject.
+	CertificateCommonName CertificateAccountField = "cn"
+	// CertificateDNSName takes the account from the DNS names of the subject alternative name extension.
+	CertificateDNSName CertificateAccountField = "dns"
+	// CertificateEmailAddress takes the account from the email addresses of the subject alternative name extension.
+	CertificateEmailAddress CertificateAccountField = "email"
+	// CertificateURI takes the account from the URIs of the subject alternative name extension, like SPIFFE IDs.
+	CertificateURI CertificateAccountField = "uri"
+)
+
+// ClientCertificateOptions contains the options for a ClientCertificateAuthenticator.
+type ClientCertificateOptions struct {
+	// Roots are the CAs that issue client certificates, required.
+	Roots *x509.CertPool
+	// Intermediates are intermediate CAs that clients do not send along with their certificate.
+	Intermediates *x509.CertPool
+	// CRLFile is a PEM or DER encoded file with the certificate revocation lists of the CAs. It is loaded again when it changes on disk. If empty, revocation is not checked.
+	CRLFile string
+	// AllowMissingCRLs accepts certificates whose issuer has no revocation list in the CRLFile. By default they are rejected, so a CA missing from the file does not silently turn off revocation checking for its certificates.
+	AllowMissingCRLs bool
+	// AccountField is the field of the certificate the account is taken from. Defaults to CertificateCommonName.
+	AccountField CertificateAccountField
+	// Accounts maps names in the AccountField to accounts. If nil, the name is used as account. Otherwise certificates with none of the names in the map are rejected, and the first name of the certificate in the map is used.
+	Accounts map[string]string
+	// OrganizationalUnitGroups uses the organizational units of the subject as groups of the identity.
+	OrganizationalUnitGroups bool
+}
+
+// ClientCertificateAuthenticator authenticates TLS client certificates issued by trusted CAs. The certificate is verified again, so it does not matter if the TLS server verified it with other CAs or did not verify it at all; the server only has to request a client certificate, with tls.RequestClientCert or tls.VerifyClientCertIfGiven. Use the ClientCertificates option of the TokenHandler to authenticate token requests with it.
+type ClientCertificateAuthenticator struct {
+	options  ClientCertificateOptions
+	reloader *fileReloader
+	now      func() time.Time
+
+	mu   sync.RWMutex
+	crls []*x509.RevocationList
+}
+
+// NewClientCertificateAuthenticator creates a new ClientCertificateAuthenticator with the given options. If the CRL file can not be loaded, an error is returned.
+func NewClientCertificateAuthenticator(options ClientCertificateOptions) (*ClientCertificateAuthenticator, error) {
+	if options.Roots == nil {
+		return nil, fmt.Errorf("client certificate authenticator has no roots")
+	}
+	if options.AccountField == "" {
+		options.AccountField = CertificateCommonName
+	}
+	switch options.AccountField {
+	case CertificateCommonName, CertificateDNSName, CertificateEmailAddress, CertificateURI:
+	default:
+		return nil, fmt.Errorf("unknown certificate account field %s", options.AccountField)
+	}
+
+	a := &ClientCertificateAuthenticator{options: options, now: time.Now}
+	if options.CRLFile != "" {
+		a.reloader = newFileReloader(options.CRLFile, a.loadCRLs)
+		if err := a.reloader.reload(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// LoadCertificatePool loads the PEM encoded certificates in the file at the given path into a new pool.
+func LoadCertificatePool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// ParseCRLs parses PEM encoded certificate revocation lists, or a single DER encoded one.
+func ParseCRLs(data []byte) ([]*x509.RevocationList, error) {
+	if !bytes.Contains(data, []byte("-----BEGIN")) {
+		crl, err := x509.ParseRevocationList(data)
+		if err != nil {
+			return nil, err
+		}
+		return []*x509.RevocationList{crl}, nil
+	}
+
+	var crls []*x509.RevocationList
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "X509 CRL" {
+			continue
+		}
+
+		crl, err := x509.ParseRevocationList(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		crls = append(crls, crl)
+	}
+	if len(crls) == 0 {
+		return nil, fmt.Errorf("no certificate revocation lists found")
+	}
+	return crls, nil
+}
+
+func (a *ClientCertificateAuthenticator) loadCRLs(data []byte) error {
+	crls, err := ParseCRLs(data)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.crls = crls
+	return nil
+}
+
+// AuthenticateConnection authenticates the client certificate of a TLS connection, as found in http.Request.TLS.
+func (a *ClientCertificateAuthenticator) AuthenticateConnection(ctx context.Context, state *tls.ConnectionState) (*Identity, error) {
+	if state == nil {
+		return nil, ErrUnauthorized
+	}
+	return a.AuthenticateCertificates(ctx, state.PeerCertificates)
+}
+
+// AuthenticateCertificates authenticates the client certificate, the first of the certificates, with the others as intermediates. Certificates that do not verify, are revoked or have no account are rejected with ErrInvalidCredentials. The identity has the certificate_subject, certificate_issuer and certificate_serial attributes.
+func (a *ClientCertificateAuthenticator) AuthenticateCertificates(ctx context.Context, certs []*x509.Certificate) (*Identity, error) {
+	if len(certs) == 0 {
+		return nil, ErrUnauthorized
+	}
+	cert := certs[0]
+
+	intermediates := x509.NewCertPool()
+	if a.options.Intermediates != nil {
+		intermediates = a.options.Intermediates.Clone()
+	}
+	for _, intermediate := range certs[1:] {
+		intermediates.AddCert(intermediate)
+	}
+
+	chains, err := cert.Verify(x509.VerifyOptions{
+		Roots:         a.options.Roots,
+		Intermediates: intermediates,
+		CurrentTime:   a.now(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return nil, ErrInvalidCredentials.WithDetail(err.Error())
+	}
+
+	if err := a.checkRevocation(chains); err != nil {
+		return nil, err
+	}
+
+	account, err := a.account(cert)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []string
+	if a.options.OrganizationalUnitGroups {
+		groups = append(groups, cert.Subject.OrganizationalUnit...)
+	}
+
+	return &Identity{
+		Subject: account,
+		Groups:  groups,
+		Attributes: map[string]string{
+			"certificate_subject": cert.Subject.String(),
+			"certificate_issuer":  cert.Issuer.String(),
+			"certificate_serial":  cert.SerialNumber.Text(16),
+		},
+		Method: AuthMethodCertificate,
+	}, nil
+}
+
+// SetErrorLog sets the logger for failures to reload the CRL file on authentication. If nil, the standard logger of the log package is used.
+func (a *ClientCertificateAuthenticator) SetErrorLog(logger *log.Logger) {
+	if a.reloader != nil {
+		a.reloader.setErrorLog(logger)
+	}
+}
+
+// checkRevocation checks the certificates of the verified chains against the CRLs, which are reloaded when the file changes. If the file can not be reloaded, the previously loaded CRLs are used and the error is logged. It succeeds if one of the chains has no revoked certificates.
+func (a *ClientCertificateAuthenticator) checkRevocation(chains [][]*x509.Certificate) error {
+	if a.reloader == nil {
+		return nil
+	}
+	a.reloader.refresh()
+
+	a.mu.RLock()
+	crls := a.crls
+	a.mu.RUnlock()
+
+	var err error
+	for _, chain := range chains {
+		if err = a.checkChain(chain, crls); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (a *ClientCertificateAuthenticator) checkChain(chain []*x509.Certificate, crls []*x509.RevocationList) error {
+	now := a.now()
+	// The root is trusted as is, every other certificate is checked against the CRL of its issuer
+	for i := 0; i < len(chain)-1; i++ {
+		cert, issuer := chain[i], chain[i+1]
+		checked := false
+		for _, crl := range crls {
+			if !bytes.Equal(crl.RawIssuer, issuer.RawSubject) || crl.CheckSignatureFrom(issuer) != nil {
+				continue
+			}
+			if !crl.NextUpdate.IsZero() && now.After(crl.NextUpdate) {
+				return ErrUnknown.WithCause(fmt.Errorf("certificate revocation list of %s is expired", issuer.Subject))
+			}
+			checked = true
+			for _, revoked := range crl.RevokedCertificateEntries {
+				if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+					return ErrInvalidCredentials.WithDetail("certificate " + cert.Subject.String() + " is revoked")
+				}
+			}
+		}
+		if !checked && !a.options.AllowMissingCRLs {
+			return ErrUnknown.WithCause(fmt.Errorf("no certificate revocation list of %s", issuer.Subject))
+		}
+	}
+	return nil
+}
+
+// account returns the account of the certificate.
+func (a *ClientCertificateAuthenticator) account(cert *x509.Certificate) (string, error) {
+	var names []string
+	switch a.options.AccountField {
+	case CertificateCommonName:
+		if cert.Subject.CommonName != "" {
+			names = []string{cert.Subject.CommonName}
+		}
+	case CertificateDNSName:
+		names = cert.DNSNames
+	case CertificateEmailAddress:
+		names = cert.EmailAddresses
+	case CertificateURI:
+		for _, uri := range cert.URIs {
+			names = append(names, uri.String())
+		}
+	}
+
+	for _, name := range names {
+		if a.options.Accounts == nil {
+			return name, nil
+		}
+		if account, ok := a.options.Accounts[name]; ok {
+			return account, nil
+		}
+	}
+	return "", ErrInvalidCredentials.WithDetail(fmt.Sprintf("certificate has no %s that maps to an account", a.options.AccountField))
+}
@@ -0,0 +1,286 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA is an in-memory CA issuing client certificates and revocation lists.
+type testCA struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	serial int64
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return &testCA{cert: cert, key: key, serial: 1}
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// issue issues a client certificate, modify can change the template before it is signed.
+func (ca *testCA) issue(t *testing.T, modify func(template *x509.Certificate)) *x509.Certificate {
+	cert, _ := ca.issueWithKey(t, modify)
+	return cert
+}
+
+func (ca *testCA) issueWithKey(t *testing.T, modify func(template *x509.Certificate)) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	ca.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: "builder-1", OrganizationalUnit: []string{"ci"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if modify != nil {
+		modify(template)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return cert, key
+}
+
+// crl returns a PEM encoded revocation list revoking the certificates.
+func (ca *testCA) crl(t *testing.T, nextUpdate time.Time, revoked ...*x509.Certificate) []byte {
+	var entries []x509.RevocationListEntry
+	for _, cert := range revoked {
+		entries = append(entries, x509.RevocationListEntry{SerialNumber: cert.SerialNumber, RevocationTime: time.Now()})
+	}
+
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(time.Now().UnixNano()),
+		ThisUpdate:                time.Now().Add(-time.Minute),
+		NextUpdate:                nextUpdate,
+		RevokedCertificateEntries: entries,
+	}, ca.cert, ca.key)
+	assert.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+}
+
+func TestClientCertificateAuthenticator(t *testing.T) {
+	ca := newTestCA(t, "Build CA")
+	a, err := NewClientCertificateAuthenticator(ClientCertificateOptions{Roots: ca.pool(), OrganizationalUnitGroups: true})
+	assert.NoError(t, err)
+
+	cert := ca.issue(t, nil)
+	identity, err := a.AuthenticateCertificates(context.Background(), []*x509.Certificate{cert})
+	assert.NoError(t, err)
+	assert.Equal(t, "builder-1", identity.Subject)
+	assert.Equal(t, []string{"ci"}, identity.Groups)
+	assert.Equal(t, AuthMethodCertificate, identity.Method)
+	assert.Equal(t, "CN=Build CA", identity.Attribute("certificate_issuer"))
+	assert.Equal(t, cert.SerialNumber.Text(16), identity.Attribute("certificate_serial"))
+
+	other := newTestCA(t, "Other CA")
+	tests := []struct {
+		name string
+		cert *x509.Certificate
+	}{
+		{"TestOtherCA", other.issue(t, nil)},
+		{"TestExpired", ca.issue(t, func(c *x509.Certificate) { c.NotAfter = time.Now().Add(-time.Minute) })},
+		{"TestServerCertificate", ca.issue(t, func(c *x509.Certificate) { c.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth} })},
+		{"TestNoCommonName", ca.issue(t, func(c *x509.Certificate) { c.Subject.CommonName = "" })},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := a.AuthenticateCertificates(context.Background(), []*x509.Certificate{tt.cert})
+			assert.True(t, errors.Is(err, ErrInvalidCredentials), "error = %v", err)
+		})
+	}
+
+	_, err = a.AuthenticateConnection(context.Background(), nil)
+	assert.True(t, errors.Is(err, ErrUnauthorized))
+}
+
+func TestClientCertificateAuthenticator_Accounts(t *testing.T) {
+	ca := newTestCA(t, "Build CA")
+	spiffe, _ := url.Parse("spiffe://example.com/ci/builder")
+
+	a, err := NewClientCertificateAuthenticator(ClientCertificateOptions{
+		Roots:        ca.pool(),
+		AccountField: CertificateURI,
+		Accounts:     map[string]string{"spiffe://example.com/ci/builder": "ci-builder"},
+	})
+	assert.NoError(t, err)
+
+	identity, err := a.AuthenticateCertificates(context.Background(), []*x509.Certificate{ca.issue(t, func(c *x509.Certificate) {
+		c.URIs = append(c.URIs, spiffe)
+	})})
+	assert.NoError(t, err)
+	assert.Equal(t, "ci-builder", identity.Subject)
+	assert.Empty(t, identity.Groups)
+
+	// Certificates with names that are not mapped are rejected
+	_, err = a.AuthenticateCertificates(context.Background(), []*x509.Certificate{ca.issue(t, nil)})
+	assert.True(t, errors.Is(err, ErrInvalidCredentials))
+
+	_, err = NewClientCertificateAuthenticator(ClientCertificateOptions{Roots: ca.pool(), AccountField: "serial"})
+	assert.Error(t, err)
+	_, err = NewClientCertificateAuthenticator(ClientCertificateOptions{})
+	assert.Error(t, err)
+}
+
+func TestClientCertificateAuthenticator_CRL(t *testing.T) {
+	ca := newTestCA(t, "Build CA")
+	other := newTestCA(t, "Other CA")
+	revoked := ca.issue(t, nil)
+	valid := ca.issue(t, nil)
+
+	// The CRL of another CA with the same serial must not revoke the certificate
+	otherRevoked := other.issue(t, func(c *x509.Certificate) { c.SerialNumber = valid.SerialNumber })
+
+	path := filepath.Join(t.TempDir(), "crl.pem")
+	crls := append(ca.crl(t, time.Now().Add(10*time.Minute), revoked), other.crl(t, time.Now().Add(time.Hour), otherRevoked)...)
+	assert.NoError(t, os.WriteFile(path, crls, 0600))
+
+	a, err := NewClientCertificateAuthenticator(ClientCertificateOptions{Roots: ca.pool(), CRLFile: path})
+	assert.NoError(t, err)
+
+	_, err = a.AuthenticateCertificates(context.Background(), []*x509.Certificate{valid})
+	assert.NoError(t, err)
+	_, err = a.AuthenticateCertificates(context.Background(), []*x509.Certificate{revoked})
+	assert.True(t, errors.Is(err, ErrInvalidCredentials))
+
+	// An expired CRL fails closed
+	a.now = func() time.Time { return time.Now().Add(30 * time.Minute) }
+	_, err = a.AuthenticateCertificates(context.Background(), []*x509.Certificate{valid})
+	assert.True(t, errors.Is(err, ErrUnknown))
+
+	// A CA without a CRL fails closed, unless missing CRLs are allowed
+	third := newTestCA(t, "Third CA")
+	roots := ca.pool()
+	roots.AddCert(third.cert)
+	for _, allow := range []bool{false, true} {
+		a, err = NewClientCertificateAuthenticator(ClientCertificateOptions{Roots: roots, CRLFile: path, AllowMissingCRLs: allow})
+		assert.NoError(t, err)
+		_, err = a.AuthenticateCertificates(context.Background(), []*x509.Certificate{valid})
+		assert.NoError(t, err)
+		_, err = a.AuthenticateCertificates(context.Background(), []*x509.Certificate{third.issue(t, nil)})
+		if allow {
+			assert.NoError(t, err)
+		} else {
+			assert.True(t, errors.Is(err, ErrUnknown), "error = %v", err)
+		}
+	}
+
+	// A broken CRL file keeps the previously loaded CRLs, and is logged
+	var logs bytes.Buffer
+	a.SetErrorLog(log.New(&logs, "", 0))
+	writeTestFile(t, path, "garbage")
+	_, err = a.AuthenticateCertificates(context.Background(), []*x509.Certificate{revoked})
+	assert.True(t, errors.Is(err, ErrInvalidCredentials))
+	assert.Contains(t, logs.String(), "reloading "+path+" failed")
+
+	// A broken CRL file is rejected on creation
+	_, err = NewClientCertificateAuthenticator(ClientCertificateOptions{Roots: ca.pool(), CRLFile: path})
+	assert.Error(t, err)
+}
+
+func TestTokenHandler_ClientCertificate(t *testing.T) {
+	ca := newTestCA(t, "Build CA")
+	certs, err := NewClientCertificateAuthenticator(ClientCertificateOptions{Roots: ca.pool()})
+	assert.NoError(t, err)
+
+	h := newTestTokenHandler(t, NewDummyAuthorizer())
+	h.options.ClientCertificates = certs
+
+	request := func(query string, cert *x509.Certificate) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/?"+query, nil)
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	cert := ca.issue(t, nil)
+	rec := request("service=registry&client_id=docker&scope=repository:ci/app:pull", cert)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	_, tok := decodeToken(t, rec)
+	assert.Equal(t, "builder-1", tok.Claims.Subject)
+
+	rec = request("account=builder-1&service=registry&client_id=docker", cert)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = request("account=jens&service=registry&client_id=docker", cert)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// Refresh tokens would outlive the checks of the certificate
+	rec = request("service=registry&client_id=docker&offline_token=true", cert)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "unsupported access type")
+
+	// Refresh tokens that were issued for a certificate anyway are revoked
+	refreshToken, err := h.options.RefreshTokens.Issue(context.Background(), &AuthorizationRequest{
+		Account:  "builder-1",
+		Service:  "registry",
+		ClientId: "docker",
+		Identity: &Identity{Subject: "builder-1", Method: AuthMethodCertificate},
+	})
+	assert.NoError(t, err)
+	form := url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refreshToken}, "service": {"registry"}, "client_id": {"docker"}}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, newFormRequest(form))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	_, err = h.options.RefreshTokens.Validate(context.Background(), refreshToken, &AuthorizationRequest{Service: "registry", ClientId: "docker"})
+	assert.True(t, errors.Is(err, ErrInvalidRefreshToken))
+
+	rec = request("service=registry&client_id=docker", newTestCA(t, "Other CA").issue(t, nil))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	// Basic auth takes precedence over the certificate
+	req := httptest.NewRequest(http.MethodGet, "/?account=jens&service=registry&client_id=docker", nil)
+	req.SetBasicAuth("jens", "secret")
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	_, tok = decodeToken(t, rec)
+	assert.Equal(t, "jens", tok.Claims.Subject)
+}
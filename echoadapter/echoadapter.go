@@ -0,0 +1,22 @@
+// Package echoadapter contains thin wrappers to use the registry token endpoint with the echo framework.
+package echoadapter
+
+import (
+	registry "github.com/JensvandeWiel/docker-reg-auth"
+	"github.com/labstack/echo/v4"
+)
+
+// Handler wraps a TokenHandler into an echo.HandlerFunc.
+func Handler(h *registry.TokenHandler) echo.HandlerFunc {
+	return echo.WrapHandler(h)
+}
+
+// AuthorizationRequestFromContext parses the query parameters of the request in the echo context, see registry.AuthorizationRequestFromRequest.
+func AuthorizationRequestFromContext(ctx echo.Context) (*registry.AuthorizationRequest, error) {
+	return registry.AuthorizationRequestFromRequest(ctx.Request())
+}
+
+// TokenRequestFromContext parses the form of the request in the echo context, see registry.TokenRequestFromRequest.
+func TokenRequestFromContext(ctx echo.Context) (*registry.TokenRequest, error) {
+	return registry.TokenRequestFromRequest(ctx.Request())
+}
@@ -0,0 +1,45 @@
+package echoadapter
+
+import (
+	registry "github.com/JensvandeWiel/docker-reg-auth"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	g, err := registry.NewDefaultTokenGenerator("../.devcerts/RootCA.crt", "../.devcerts/RootCA.key")
+	assert.NoError(t, err)
+
+	h := registry.NewTokenHandler(registry.NewDummyAuthenticator(), registry.NewDummyAuthorizer(), g, &registry.TokenHandlerOptions{
+		TokenOptions: registry.TokenOptions{
+			ExpiresIn: 3600,
+			Issuer:    "test",
+			Audience:  "registry",
+		},
+	})
+
+	e := echo.New()
+	e.GET("/auth", Handler(h))
+
+	req := httptest.NewRequest(http.MethodGet, "/auth?account=jens&service=registry&client_id=docker&scope=repository:foo/bar:pull", nil)
+	req.SetBasicAuth("jens", "secret")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "access_token")
+}
+
+func TestAuthorizationRequestFromContext(t *testing.T) {
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/?account=jens&service=registry&client_id=docker&scope=repository:foo/bar:pull", nil)
+	c := e.NewContext(req, httptest.NewRecorder())
+
+	got, err := AuthorizationRequestFromContext(c)
+	assert.NoError(t, err)
+	assert.Equal(t, "jens", got.Account)
+	assert.Len(t, got.Scopes, 1)
+}
@@ -0,0 +1,136 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Error is an error returned by the token endpoint. It is written to the client in the error format of the registry, see WriteError.
+type Error struct {
+	// Code is the error code, like UNAUTHORIZED or DENIED.
+	Code string
+	// Message is a human readable description of the error.
+	Message string
+	// Detail contains additional information about the error, it is optional.
+	Detail interface{}
+	// Status is the HTTP status code the error is written with.
+	Status int
+	// RetryAfter is how long the client should wait before trying again, it is written as Retry-After header. Zero means no header is written.
+	RetryAfter time.Duration
+
+	// cause is the internal error behind the error. It is logged, but never written to the client.
+	cause error
+	// unknownUser marks ErrUnknownUser, which is written to the client as ErrInvalidCredentials.
+	unknownUser bool
+}
+
+var (
+	ErrUnauthorized          = &Error{Code: "UNAUTHORIZED", Message: "authentication required", Status: http.StatusUnauthorized}
+	ErrInvalidCredentials    = &Error{Code: "UNAUTHORIZED", Message: "invalid username or password", Status: http.StatusUnauthorized}
+	ErrInvalidRefreshToken   = &Error{Code: "UNAUTHORIZED", Message: "invalid refresh token", Status: http.StatusUnauthorized}
+	ErrDenied                = &Error{Code: "DENIED", Message: "requested access to the resource is denied", Status: http.StatusForbidden}
+	ErrInvalidRequest        = &Error{Code: "INVALID_REQUEST", Message: "invalid token request", Status: http.StatusBadRequest}
+	ErrInvalidScope          = &Error{Code: "INVALID_SCOPE", Message: "invalid scope", Status: http.StatusBadRequest}
+	ErrUnsupportedAccessType = &Error{Code: "UNSUPPORTED", Message: "unsupported access type", Status: http.StatusBadRequest}
+	ErrUnsupportedGrantType  = &Error{Code: "UNSUPPORTED", Message: "unsupported grant type", Status: http.StatusBadRequest}
+	ErrMethodNotAllowed      = &Error{Code: "UNSUPPORTED", Message: "method not allowed", Status: http.StatusMethodNotAllowed}
+	ErrLockedOut             = &Error{Code: "TOOMANYREQUESTS", Message: "too many failed authentication attempts", Status: http.StatusTooManyRequests}
+	ErrTooManyRequests       = &Error{Code: "TOOMANYREQUESTS", Message: "too many requests", Status: http.StatusTooManyRequests}
+	ErrUnknown               = &Error{Code: "UNKNOWN", Message: "unknown error", Status: http.StatusInternalServerError}
+)
+
+// ErrUnknownUser is returned by authenticators when the user does not exist in their backend, as opposed to ErrInvalidCredentials for a user that exists but gave the wrong password. It is a kind of ErrInvalidCredentials and written to the client as such, so it can not be used to find out which users exist.
+var ErrUnknownUser = &Error{Code: "UNAUTHORIZED", Message: "invalid username or password", Status: http.StatusUnauthorized, unknownUser: true}
+
+// Error returns the message of the error, followed by the detail and the cause if there are any.
+func (e *Error) Error() string {
+	msg := e.Message
+	if e.Detail != nil {
+		msg = fmt.Sprintf("%s: %v", msg, e.Detail)
+	}
+	if e.cause != nil {
+		msg = fmt.Sprintf("%s: %v", msg, e.cause)
+	}
+	return msg
+}
+
+// Unwrap returns the cause of the error, if it has one.
+func (e *Error) Unwrap() error {
+	return e.cause
+}
+
+// WithDetail returns a copy of the error with the given detail.
+func (e *Error) WithDetail(detail interface{}) *Error {
+	err := *e
+	err.Detail = detail
+	return &err
+}
+
+// WithCause returns a copy of the error with the given internal cause, like the error of a backend. Unlike the detail, the cause is never written to the client, so it can hold internal information like addresses and queries.
+func (e *Error) WithCause(cause error) *Error {
+	err := *e
+	err.cause = cause
+	return &err
+}
+
+// WithRetryAfter returns a copy of the error with the given retry after duration.
+func (e *Error) WithRetryAfter(retryAfter time.Duration) *Error {
+	err := *e
+	err.RetryAfter = retryAfter
+	return &err
+}
+
+// Is reports whether the target is the same kind of error, ignoring the detail. This makes errors.Is(err, ErrDenied) work for errors created with WithDetail. ErrUnknownUser is ErrInvalidCredentials, but not the other way around.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	if !ok {
+		return false
+	}
+	if t.unknownUser && !e.unknownUser {
+		return false
+	}
+	return e.Code == t.Code && e.Message == t.Message
+}
+
+type errorEnvelope struct {
+	Errors []errorBody `json:"errors"`
+}
+
+type errorBody struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Detail  interface{} `json:"detail,omitempty"`
+}
+
+// WriteError writes the error in the error format of the registry: {"errors":[{"code":...,"message":...,"detail":...}]}. Errors that are not an *Error are written as ErrUnknown. The cause of an error, and the detail of server errors like ErrUnknown, is not written, as it can expose internals to unauthenticated clients; log the error before writing it. For 401 responses a WWW-Authenticate header with the given realm is set, so clients know to retry with basic auth. If the error has a RetryAfter, a Retry-After header is set in whole seconds.
+func WriteError(w http.ResponseWriter, realm string, err error) {
+	var e *Error
+	if !errors.As(err, &e) {
+		e = ErrUnknown
+	}
+
+	detail := e.Detail
+	if e.Status >= http.StatusInternalServerError {
+		detail = nil
+	}
+
+	if e.Status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", realm))
+	}
+
+	if e.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(e.RetryAfter.Seconds()))))
+	}
+
+	writeJSON(w, e.Status, errorEnvelope{
+		Errors: []errorBody{{
+			Code:    e.Code,
+			Message: e.Message,
+			Detail:  detail,
+		}},
+	})
+}
@@ -0,0 +1,111 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestError_Is(t *testing.T) {
+	err := ErrDenied.WithDetail("foo/bar")
+
+	assert.True(t, errors.Is(err, ErrDenied))
+	assert.True(t, errors.Is(fmt.Errorf("wrapped: %w", err), ErrDenied))
+	assert.False(t, errors.Is(err, ErrInvalidCredentials))
+	assert.False(t, errors.Is(ErrInvalidCredentials, ErrUnauthorized))
+
+	// An unknown user is a kind of invalid credentials, but not the other way around
+	assert.True(t, errors.Is(ErrUnknownUser, ErrInvalidCredentials))
+	assert.False(t, errors.Is(ErrInvalidCredentials, ErrUnknownUser))
+
+	// WithDetail must not modify the original error
+	assert.Nil(t, ErrDenied.Detail)
+	assert.Equal(t, "requested access to the resource is denied: foo/bar", err.Error())
+
+	// The cause is part of the error message and can be unwrapped
+	cause := errors.New("connection refused")
+	err = ErrUnknown.WithCause(fmt.Errorf("ldap: %w", cause))
+	assert.True(t, errors.Is(err, ErrUnknown))
+	assert.True(t, errors.Is(err, cause))
+	assert.Equal(t, "unknown error: ldap: connection refused", err.Error())
+}
+
+func TestWriteError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantBody   string
+		wantHeader string
+	}{
+		{
+			"TestUnauthorized",
+			ErrInvalidCredentials,
+			http.StatusUnauthorized,
+			`{"errors":[{"code":"UNAUTHORIZED","message":"invalid username or password"}]}`,
+			`Basic realm="test"`,
+		},
+		{
+			"TestDenied",
+			ErrDenied.WithDetail("foo/bar"),
+			http.StatusForbidden,
+			`{"errors":[{"code":"DENIED","message":"requested access to the resource is denied","detail":"foo/bar"}]}`,
+			"",
+		},
+		{
+			"TestInvalidScope",
+			ErrInvalidScope.WithDetail("repository:foo"),
+			http.StatusBadRequest,
+			`{"errors":[{"code":"INVALID_SCOPE","message":"invalid scope","detail":"repository:foo"}]}`,
+			"",
+		},
+		{
+			"TestLockedOut",
+			ErrLockedOut.WithRetryAfter(1500 * time.Millisecond),
+			http.StatusTooManyRequests,
+			`{"errors":[{"code":"TOOMANYREQUESTS","message":"too many failed authentication attempts"}]}`,
+			"",
+		},
+		{
+			"TestUnknown",
+			errors.New("boom"),
+			http.StatusInternalServerError,
+			`{"errors":[{"code":"UNKNOWN","message":"unknown error"}]}`,
+			"",
+		},
+		{
+			"TestUnknownDetail",
+			ErrUnknown.WithDetail("ldap: dial tcp 10.0.0.1:389: connection refused"),
+			http.StatusInternalServerError,
+			`{"errors":[{"code":"UNKNOWN","message":"unknown error"}]}`,
+			"",
+		},
+		{
+			"TestCause",
+			ErrDenied.WithCause(errors.New("sql: connection refused")),
+			http.StatusForbidden,
+			`{"errors":[{"code":"DENIED","message":"requested access to the resource is denied"}]}`,
+			"",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			WriteError(rec, "test", tt.err)
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			assert.JSONEq(t, tt.wantBody, rec.Body.String())
+			assert.Equal(t, tt.wantHeader, rec.Header().Get("WWW-Authenticate"))
+			if e, ok := tt.err.(*Error); ok && e.RetryAfter > 0 {
+				assert.Equal(t, "2", rec.Header().Get("Retry-After"))
+			} else {
+				assert.Empty(t, rec.Header().Get("Retry-After"))
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	registry "github.com/JensvandeWiel/docker-reg-auth"
+	"github.com/JensvandeWiel/docker-reg-auth/echoadapter"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 )
@@ -12,12 +13,30 @@ func main() {
 		panic(err)
 	}
 
-	h := NewRegistryAuthHandler(registry.NewDummyAuthenticator(), registry.NewDummyAuthorizer(), gen)
+	refreshTokens := registry.NewRefreshTokenManager(registry.NewInMemoryRefreshTokenStore(), 0)
+
+	// Everyone may pull the images in library/, without credentials
+	authorizer, err := registry.NewPublicAuthorizer(registry.NewDummyAuthorizer(), "library/*")
+	if err != nil {
+		panic(err)
+	}
+
+	h := registry.NewTokenHandler(registry.NewDummyAuthenticator(), authorizer, gen, &registry.TokenHandlerOptions{
+		TokenOptions: registry.TokenOptions{
+			ExpiresIn:    3600,
+			Issuer:       "test",
+			Audience:     "test",
+			PartialGrant: true,
+		},
+		RefreshTokens:  refreshTokens,
+		AllowAnonymous: true,
+	})
 
 	e := echo.New()
 	e.Use(middleware.Logger())
 
-	e.GET("v1/registry/auth", h.AuthHandle)
+	e.GET("v1/registry/auth", echoadapter.Handler(h))
+	e.POST("v1/registry/auth", echoadapter.Handler(h))
 
 	e.Logger.Fatal(e.Start(":8080"))
 }
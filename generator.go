@@ -20,6 +20,8 @@ type TokenOptions struct {
 	ExpiresIn int64
 	Issuer    string
 	Audience  string
+	// PartialGrant makes the generator issue a token containing only the intersection of the requested and granted actions, instead of failing when not all requested actions are granted. Scopes for which nothing is granted are left out of the access list.
+	PartialGrant bool
 }
 
 // Token represents a token and an access token.
@@ -29,11 +31,24 @@ type Token struct {
 	IssuedAt     int64  `json:"issued_at"`
 	ExpiresIn    int64  `json:"expires_in"`
 	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+}
+
+// MarshalJSON marshals the token with issued_at formatted as RFC3339, as the token spec requires.
+func (t Token) MarshalJSON() ([]byte, error) {
+	type alias Token
+	return json.Marshal(&struct {
+		alias
+		IssuedAt string `json:"issued_at"`
+	}{
+		alias:    alias(t),
+		IssuedAt: time.Unix(t.IssuedAt, 0).UTC().Format(time.RFC3339),
+	})
 }
 
 // TokenGenerator is an interface for generating tokens.
 type TokenGenerator interface {
-	GenerateToken(req *AuthorizationRequest, actions ActionSet, options *TokenOptions) (*Token, error)
+	GenerateToken(req *AuthorizationRequest, granted []*Scope, options *TokenOptions) (*Token, error)
 }
 
 // DefaultTokenGenerator is a default implementation of the TokenGenerator interface.
@@ -54,8 +69,8 @@ func NewDefaultTokenGenerator(certPath, keyPath string) (*DefaultTokenGenerator,
 	}, nil
 }
 
-// GenerateToken generates a token for the given request and actions with the given options.
-func (g *DefaultTokenGenerator) GenerateToken(req *AuthorizationRequest, actions ActionSet, tokenOptions *TokenOptions) (*Token, error) {
+// GenerateToken generates a token for the given request and granted scopes with the given options. The token contains one access entry per requested scope.
+func (g *DefaultTokenGenerator) GenerateToken(req *AuthorizationRequest, granted []*Scope, tokenOptions *TokenOptions) (*Token, error) {
 	if g.privKey == nil || g.pubKey == nil {
 		return nil, fmt.Errorf("private or public key is nil")
 	}
@@ -87,12 +102,30 @@ func (g *DefaultTokenGenerator) GenerateToken(req *AuthorizationRequest, actions
 	now := time.Now().Unix()
 
 	if req.Service != tokenOptions.Audience {
-		return nil, fmt.Errorf("service does not match audience")
+		return nil, ErrInvalidRequest.WithDetail("service does not match audience")
 	}
 
-	// Check if the all requested actions are allowed
-	if !actions.ContainsAll(req.Actions) {
-		return nil, fmt.Errorf("request actions do not match allowed actions")
+	access := make([]*token.ResourceActions, 0, len(req.Scopes))
+	scopes := make([]string, 0, len(req.Scopes))
+	for _, scope := range req.Scopes {
+		actions := grantedActions(granted, scope)
+
+		if tokenOptions.PartialGrant {
+			actions = scope.Actions.Intersect(actions)
+			if len(actions) == 0 {
+				continue
+			}
+		} else if !actions.ContainsAll(scope.Actions) {
+			// Check if the all requested actions are allowed
+			return nil, ErrDenied.WithDetail(fmt.Sprintf("request actions do not match allowed actions for scope %s", scope))
+		}
+
+		access = append(access, &token.ResourceActions{
+			Type:    scope.Type.String(),
+			Name:    scope.Name,
+			Actions: actions.ToStrings(),
+		})
+		scopes = append(scopes, (&Scope{Type: scope.Type, Name: scope.Name, Actions: actions}).String())
 	}
 
 	claim := token.ClaimSet{
@@ -103,15 +136,9 @@ func (g *DefaultTokenGenerator) GenerateToken(req *AuthorizationRequest, actions
 		NotBefore:  now - 10,
 		IssuedAt:   now,
 		JWTID:      fmt.Sprintf("%d", rand.Int63()),
-		Access:     make([]*token.ResourceActions, 0), //[]*token.ResourceActions{}
+		Access:     access,
 	}
 
-	claim.Access = append(claim.Access, &token.ResourceActions{
-		Type:    req.Type.String(),
-		Name:    req.Name,
-		Actions: actions.ToStrings(),
-	})
-
 	claimJson, err := json.Marshal(claim)
 
 	payload := fmt.Sprintf("%s%s%s", encodeBase64(headerJson), token.TokenSeparator, encodeBase64(claimJson))
@@ -128,9 +155,26 @@ func (g *DefaultTokenGenerator) GenerateToken(req *AuthorizationRequest, actions
 		AccessToken: tok,
 		IssuedAt:    now,
 		ExpiresIn:   tokenOptions.ExpiresIn,
+		Scope:       strings.Join(scopes, " "),
 	}, nil
 }
 
+// grantedActions returns the actions granted for the resource of the given scope, without duplicates when the resource is granted more than once.
+func grantedActions(granted []*Scope, scope *Scope) ActionSet {
+	actions := make(ActionSet, 0)
+	for _, g := range granted {
+		if !g.Matches(scope) {
+			continue
+		}
+		for _, action := range g.Actions {
+			if !actions.Contains(action) {
+				actions = append(actions, action)
+			}
+		}
+	}
+	return actions
+}
+
 func encodeBase64(data []byte) string {
 	return strings.TrimRight(base64.URLEncoding.EncodeToString(data), "=")
 }
@@ -1,9 +1,11 @@
 package registry
 
 import (
+	"encoding/json"
 	"github.com/distribution/distribution/registry/auth/token"
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 )
 
 func TestDefaultTokenGenerator_GenerateToken(t *testing.T) {
@@ -14,13 +16,12 @@ func TestDefaultTokenGenerator_GenerateToken(t *testing.T) {
 		Audience:  "registry",
 		ExpiresIn: 3600,
 	}
+	scopes := []*Scope{{Type: ScopeTypeRegistry, Name: "catalog", Actions: ActionSet{ActionAll}}}
 	rawToken, err := g.GenerateToken(&AuthorizationRequest{
 		Account: "jens",
 		Service: "registry",
-		Type:    ScopeTypeRegistry,
-		Name:    "catalog",
-		Actions: ActionSet{ActionAll},
-	}, ActionSet{ActionAll}, tokOpt)
+		Scopes:  scopes,
+	}, scopes, tokOpt)
 	if err != nil {
 		t.Errorf("GenerateToken() error = %v", err)
 		return
@@ -72,3 +73,110 @@ func TestDefaultTokenGenerator_GenerateToken(t *testing.T) {
 		t.Errorf("GenerateToken() Actions = %v, want *", tok.Claims.Access[0].Actions[0])
 	}
 }
+
+func TestDefaultTokenGenerator_GenerateTokenMultipleScopes(t *testing.T) {
+	g, err := NewDefaultTokenGenerator(".devcerts/RootCA.crt", ".devcerts/RootCA.key")
+	assert.NoError(t, err)
+	tokOpt := &TokenOptions{
+		Issuer:    "paca-node",
+		Audience:  "registry",
+		ExpiresIn: 3600,
+	}
+	req := &AuthorizationRequest{
+		Account: "jens",
+		Service: "registry",
+		Scopes: []*Scope{
+			{Type: ScopeTypeRepository, Name: "foo/bar", Actions: ActionSet{ActionPull}},
+			{Type: ScopeTypeRepository, Name: "foo/baz", Actions: ActionSet{ActionPull, ActionPush}},
+		},
+	}
+
+	rawToken, err := g.GenerateToken(req, req.Scopes, tokOpt)
+	assert.NoError(t, err)
+
+	tok, err := token.NewToken(rawToken.Token)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "repository:foo/bar:pull repository:foo/baz:pull,push", rawToken.Scope)
+
+	assert.Len(t, tok.Claims.Access, 2)
+	assert.Equal(t, "foo/bar", tok.Claims.Access[0].Name)
+	assert.Equal(t, []string{"pull"}, tok.Claims.Access[0].Actions)
+	assert.Equal(t, "foo/baz", tok.Claims.Access[1].Name)
+	assert.Equal(t, []string{"pull", "push"}, tok.Claims.Access[1].Actions)
+
+	// Missing grant for the second scope
+	_, err = g.GenerateToken(req, req.Scopes[:1], tokOpt)
+	assert.Error(t, err)
+
+	// A resource granted more than once has its actions listed once
+	granted := append(req.Scopes, &Scope{Type: ScopeTypeRepository, Name: "foo/baz", Actions: ActionSet{ActionPush, ActionPull}})
+	rawToken, err = g.GenerateToken(req, granted, tokOpt)
+	assert.NoError(t, err)
+	tok, err = token.NewToken(rawToken.Token)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"pull", "push"}, tok.Claims.Access[1].Actions)
+}
+
+func TestDefaultTokenGenerator_GenerateTokenPartialGrant(t *testing.T) {
+	g, err := NewDefaultTokenGenerator(".devcerts/RootCA.crt", ".devcerts/RootCA.key")
+	assert.NoError(t, err)
+	tokOpt := &TokenOptions{
+		Issuer:       "paca-node",
+		Audience:     "registry",
+		ExpiresIn:    3600,
+		PartialGrant: true,
+	}
+	req := &AuthorizationRequest{
+		Account: "jens",
+		Service: "registry",
+		Scopes: []*Scope{
+			{Type: ScopeTypeRepository, Name: "foo/bar", Actions: ActionSet{ActionPull, ActionPush}},
+			{Type: ScopeTypeRepository, Name: "foo/baz", Actions: ActionSet{ActionPush}},
+		},
+	}
+	granted := []*Scope{
+		{Type: ScopeTypeRepository, Name: "foo/bar", Actions: ActionSet{ActionPull}},
+		{Type: ScopeTypeRepository, Name: "foo/baz", Actions: ActionSet{ActionPull}},
+	}
+
+	rawToken, err := g.GenerateToken(req, granted, tokOpt)
+	assert.NoError(t, err)
+
+	tok, err := token.NewToken(rawToken.Token)
+	assert.NoError(t, err)
+
+	// Only pull on foo/bar is both requested and granted
+	assert.Len(t, tok.Claims.Access, 1)
+	assert.Equal(t, "foo/bar", tok.Claims.Access[0].Name)
+	assert.Equal(t, []string{"pull"}, tok.Claims.Access[0].Actions)
+
+	rawToken, err = g.GenerateToken(req, nil, tokOpt)
+	assert.NoError(t, err)
+
+	tok, err = token.NewToken(rawToken.Token)
+	assert.NoError(t, err)
+	assert.Empty(t, tok.Claims.Access)
+}
+
+func TestToken_MarshalJSON(t *testing.T) {
+	tok := &Token{
+		Token:        "token",
+		AccessToken:  "token",
+		IssuedAt:     time.Date(2024, 5, 20, 12, 0, 0, 0, time.UTC).Unix(),
+		ExpiresIn:    3600,
+		RefreshToken: "refresh",
+		Scope:        "repository:foo/bar:pull",
+	}
+
+	data, err := json.Marshal(tok)
+	assert.NoError(t, err)
+
+	var got map[string]interface{}
+	assert.NoError(t, json.Unmarshal(data, &got))
+	assert.Equal(t, "token", got["access_token"])
+	assert.Equal(t, "2024-05-20T12:00:00Z", got["issued_at"])
+	assert.Equal(t, float64(3600), got["expires_in"])
+	assert.Equal(t, "refresh", got["refresh_token"])
+	assert.Equal(t, "repository:foo/bar:pull", got["scope"])
+}
@@ -0,0 +1,374 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+)
+
+// TokenHandlerOptions contains the options for a TokenHandler.
+type TokenHandlerOptions struct {
+	// TokenOptions are the options used to generate the tokens.
+	TokenOptions TokenOptions
+	// RefreshTokens issues and validates refresh tokens. If nil, requests for offline access and the refresh_token grant type are rejected.
+	RefreshTokens *RefreshTokenManager
+	// Identities looks up the current identity of the subject of a refresh token on every use, so users that are deleted or disabled can not use their refresh tokens anymore and get their current groups. If nil, the authenticator is used if it implements IdentityLookup. Without either, the refresh_token grant type is rejected.
+	Identities IdentityLookup
+	// AccessTokens checks the access token a refresh token was obtained with on every use of the refresh token, so revoking an access token revokes the refresh tokens obtained with it as well. If nil, the authenticator is used if it is an AccessTokenAuthenticator. Without either, refresh tokens obtained with an access token are rejected.
+	AccessTokens *AccessTokenAuthenticator
+	// Realm is the realm sent in the WWW-Authenticate header of 401 responses. Defaults to "registry".
+	Realm string
+	// TrustedProxies are the proxies whose X-Forwarded-For and X-Real-IP headers are used to determine the client IP, see ClientIP.
+	TrustedProxies []*net.IPNet
+	// RateLimiter limits the rate of token requests, before the credentials are checked. If nil, requests are not limited.
+	RateLimiter *RateLimiter
+	// ClientCertificates authenticates requests of the token flow without basic auth with their TLS client certificate. The account parameter is optional for these requests, and must be the account of the certificate if given. If nil, basic auth is required.
+	ClientCertificates *ClientCertificateAuthenticator
+	// AllowAnonymous allows requests of the token flow without credentials, like the first token request of a docker pull of a public image. They are authorized with AnonymousIdentity as identity and get a token without subject, so the Authorizer must only grant public access to it, see PublicAuthorizer.
+	AllowAnonymous bool
+	// ErrorLog logs the errors of the backends and other internal errors, which are not written to the client. If nil, the standard logger of the log package is used.
+	ErrorLog *log.Logger
+}
+
+// TokenHandler is an http.Handler implementing the token endpoint of the registry. It serves the token flow (GET with basic auth) and the OAuth2 flow (POST with a form encoded body), using the IdentityAuthenticator, Authorizer and TokenGenerator it was created with.
+type TokenHandler struct {
+	authenticator  IdentityAuthenticator
+	authorizer     Authorizer
+	tokenGenerator TokenGenerator
+	options        TokenHandlerOptions
+}
+
+// NewTokenHandler creates a new TokenHandler. Use AdaptAuthenticator to pass an Authenticator. If options is nil, the zero value of TokenHandlerOptions is used.
+func NewTokenHandler(authenticator IdentityAuthenticator, authorizer Authorizer, tokenGenerator TokenGenerator, options *TokenHandlerOptions) *TokenHandler {
+	h := &TokenHandler{
+		authenticator:  authenticator,
+		authorizer:     authorizer,
+		tokenGenerator: tokenGenerator,
+	}
+	if options != nil {
+		h.options = *options
+	}
+	return h
+}
+
+// ServeHTTP serves a token request. The context of the request, holding the RequestMetadata, is passed on to the Authenticator and Authorizer. Requests exceeding the limits of the RateLimiter are rejected with ErrTooManyRequests.
+func (h *TokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	md := NewRequestMetadata(r, h.options.TrustedProxies)
+	r = r.WithContext(WithRequestMetadata(r.Context(), md))
+
+	if h.options.RateLimiter != nil {
+		if err := h.options.RateLimiter.Allow(md.IP, requestAccount(r), r.FormValue("client_id")); err != nil {
+			h.writeError(w, err)
+			return
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		h.serveToken(w, r)
+	case http.MethodPost:
+		h.serveOAuthToken(w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		h.writeError(w, ErrMethodNotAllowed.WithDetail(r.Method))
+	}
+}
+
+// serveToken serves the token flow, where the credentials are passed with basic auth and the request in the query parameters.
+func (h *TokenHandler) serveToken(w http.ResponseWriter, r *http.Request) {
+	usr, passwd, ok := r.BasicAuth()
+	if !ok {
+		if h.options.ClientCertificates != nil && r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			h.serveCertificateToken(w, r)
+			return
+		}
+		if h.options.AllowAnonymous {
+			h.serveAnonymousToken(w, r)
+			return
+		}
+		h.writeError(w, ErrUnauthorized)
+		return
+	}
+
+	identity, err := h.authenticate(r, usr, passwd)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	req, err := AuthorizationRequestFromRequest(r)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+	req.Identity = identity
+
+	if req.Account != usr {
+		h.writeError(w, ErrInvalidRequest.WithDetail("account does not match authenticated user"))
+		return
+	}
+	// The authenticator may map the username to another subject, which the token is issued to
+	req.Account = identity.Subject
+
+	h.issueToken(w, r, req, "")
+}
+
+// serveCertificateToken serves the token flow for a request authenticated with a TLS client certificate instead of basic auth.
+func (h *TokenHandler) serveCertificateToken(w http.ResponseWriter, r *http.Request) {
+	identity, err := h.options.ClientCertificates.AuthenticateConnection(r.Context(), r.TLS)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	req, err := authorizationRequestFromQuery(r.URL.Query(), false)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+	req.Identity = identity
+
+	if req.Account == "" {
+		req.Account = identity.Subject
+	} else if req.Account != identity.Subject {
+		h.writeError(w, ErrInvalidRequest.WithDetail("account does not match authenticated certificate"))
+		return
+	}
+	// A refresh token would bypass the expiry and revocation checks of the certificate, which need the connection it is presented on
+	if req.AccessType == AccessTypeOffline {
+		h.writeError(w, ErrUnsupportedAccessType.WithDetail("offline access is not supported for client certificates"))
+		return
+	}
+
+	h.issueToken(w, r, req, "")
+}
+
+// serveAnonymousToken serves the token flow for a request without credentials. The account is left empty, so the token has no subject.
+func (h *TokenHandler) serveAnonymousToken(w http.ResponseWriter, r *http.Request) {
+	req, err := authorizationRequestFromQuery(r.URL.Query(), false)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	// Clients only send an account when they have credentials for it
+	if req.Account != "" {
+		h.writeError(w, ErrUnauthorized)
+		return
+	}
+	if req.AccessType == AccessTypeOffline {
+		h.writeError(w, ErrUnsupportedAccessType.WithDetail("offline access requires authentication"))
+		return
+	}
+	req.Identity = AnonymousIdentity()
+
+	h.issueToken(w, r, req, "")
+}
+
+// serveOAuthToken serves the OAuth2 flow, where the credentials or refresh token and the request are posted as a form.
+func (h *TokenHandler) serveOAuthToken(w http.ResponseWriter, r *http.Request) {
+	tokenReq, err := TokenRequestFromRequest(r)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+	req := tokenReq.Request
+
+	switch tokenReq.GrantType {
+	case GrantTypePassword:
+		identity, err := h.authenticate(r, tokenReq.Username, tokenReq.Password)
+		if err != nil {
+			h.writeError(w, err)
+			return
+		}
+		req.Account = identity.Subject
+		req.Identity = identity
+	case GrantTypeRefreshToken:
+		if h.options.RefreshTokens == nil {
+			h.writeError(w, ErrUnsupportedGrantType.WithDetail(GrantTypeRefreshToken.String()))
+			return
+		}
+		info, err := h.options.RefreshTokens.Validate(r.Context(), tokenReq.RefreshToken, req)
+		if err != nil {
+			h.writeError(w, err)
+			return
+		}
+		identity, err := h.refreshIdentity(r, info)
+		if err != nil {
+			h.writeError(w, err)
+			return
+		}
+		req.Account = info.Account
+		req.Identity = identity
+	}
+
+	h.issueToken(w, r, req, tokenReq.RefreshToken)
+}
+
+// refreshIdentity looks up the current identity of the subject of the refresh token, or of the access token it was obtained with. It keeps the method, attributes and allowed scopes of the identity the refresh token was issued to, so a refresh token is never granted more than the login it was issued for. Refresh tokens of users and access tokens that do not exist anymore, and of client certificates, are revoked.
+func (h *TokenHandler) refreshIdentity(r *http.Request, info *RefreshTokenInfo) (*Identity, error) {
+	issued := info.Identity
+	if issued == nil {
+		issued = &Identity{Subject: info.Account}
+	}
+
+	var current *Identity
+	var err error
+	switch issued.Method {
+	case AuthMethodCertificate:
+		// Certificates can not be checked again without the connection, so refresh tokens are never valid for them
+		err = ErrUnknownUser
+	case AuthMethodAccessToken:
+		current, err = h.lookupAccessToken(r, issued)
+	default:
+		current, err = h.lookupIdentity(r, issued)
+	}
+	if errors.Is(err, ErrUnknownUser) {
+		_ = h.options.RefreshTokens.Revoke(r.Context(), r.FormValue("refresh_token"))
+		return nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if current == nil {
+		return nil, ErrUnknown.WithCause(errors.New("identity lookup returned no identity"))
+	}
+
+	identity := current.restrictScopes(issued.AllowedScopes)
+	identity.Method = issued.Method
+	for name, value := range issued.Attributes {
+		if identity.Attributes == nil {
+			identity.Attributes = make(map[string]string, len(issued.Attributes))
+		}
+		identity.Attributes[name] = value
+	}
+	return identity, nil
+}
+
+// lookupIdentity looks up the current identity of the subject of the identity with the Identities option, or the authenticator if it implements IdentityLookup.
+func (h *TokenHandler) lookupIdentity(r *http.Request, issued *Identity) (*Identity, error) {
+	identities := h.options.Identities
+	if identities == nil {
+		lookup, ok := h.authenticator.(IdentityLookup)
+		if !ok {
+			return nil, ErrUnsupportedGrantType.WithDetail(GrantTypeRefreshToken.String()).WithCause(errors.New("refresh tokens need an IdentityLookup to check their subject"))
+		}
+		identities = lookup
+	}
+
+	identity, err := identities.LookupIdentity(r.Context(), issued.Subject)
+	if errors.Is(err, ErrNoIdentityLookup) {
+		return nil, ErrUnsupportedGrantType.WithDetail(GrantTypeRefreshToken.String()).WithCause(err)
+	}
+	return identity, err
+}
+
+// lookupAccessToken looks up the current identity of the access token the identity was authenticated with, with the AccessTokens option or the authenticator if it is an AccessTokenAuthenticator.
+func (h *TokenHandler) lookupAccessToken(r *http.Request, issued *Identity) (*Identity, error) {
+	tokens := h.options.AccessTokens
+	if tokens == nil {
+		authenticator, ok := h.authenticator.(*AccessTokenAuthenticator)
+		if !ok {
+			return nil, ErrInvalidRefreshToken.WithCause(errors.New("refresh tokens obtained with an access token need an AccessTokenAuthenticator to check it"))
+		}
+		tokens = authenticator
+	}
+	return tokens.LookupAccessToken(r.Context(), issued.Subject, issued.Attribute("access_token_id"))
+}
+
+// requestAccount returns the account a token is requested for, without validating the request: the basic auth username, or the account or username parameter. For requests with a refresh token it is empty.
+func requestAccount(r *http.Request) string {
+	if user, _, ok := r.BasicAuth(); ok {
+		return user
+	}
+	if account := r.FormValue("account"); account != "" {
+		return account
+	}
+	return r.FormValue("username")
+}
+
+// issueToken authorizes the request and writes the generated token. If a refresh token was used to authenticate, it is returned again for offline access instead of issuing a new one.
+func (h *TokenHandler) issueToken(w http.ResponseWriter, r *http.Request, req *AuthorizationRequest, refreshToken string) {
+	if md, ok := RequestMetadataFromContext(r.Context()); ok {
+		req.IP = md.IP
+	}
+
+	if req.AccessType == AccessTypeOffline && h.options.RefreshTokens == nil {
+		h.writeError(w, ErrUnsupportedAccessType.WithDetail(AccessTypeOffline))
+		return
+	}
+
+	granted, err := AuthorizeScopes(r.Context(), h.authorizer, req)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	token, err := h.tokenGenerator.GenerateToken(req, granted, &h.options.TokenOptions)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	if token == nil {
+		h.writeError(w, ErrUnknown.WithCause(errors.New("failed to generate token")))
+		return
+	}
+
+	if req.AccessType == AccessTypeOffline {
+		if refreshToken == "" {
+			refreshToken, err = h.options.RefreshTokens.Issue(r.Context(), req)
+			if err != nil {
+				h.writeError(w, err)
+				return
+			}
+		}
+		token.RefreshToken = refreshToken
+	}
+
+	writeJSON(w, http.StatusOK, token)
+}
+
+// authenticate authenticates the user with the authenticator of the handler and returns the identity of the user. Errors of the authenticator that are not an *Error are returned as ErrInvalidCredentials, without exposing the cause to the client.
+func (h *TokenHandler) authenticate(r *http.Request, user, pass string) (*Identity, error) {
+	identity, err := h.authenticator.AuthenticateIdentity(r.Context(), user, pass)
+	if err == nil {
+		if identity == nil {
+			return nil, ErrUnknown.WithCause(errors.New("authenticator returned no identity"))
+		}
+		return identity, nil
+	}
+
+	var e *Error
+	if !errors.As(err, &e) {
+		return nil, ErrInvalidCredentials
+	}
+	return nil, err
+}
+
+// writeError writes the error to the client. Server errors and errors with an internal cause are logged first, as WriteError leaves out their details.
+func (h *TokenHandler) writeError(w http.ResponseWriter, err error) {
+	var e *Error
+	if !errors.As(err, &e) || e.Status >= http.StatusInternalServerError || e.cause != nil {
+		logger := h.options.ErrorLog
+		if logger == nil {
+			logger = log.Default()
+		}
+		logger.Printf("registry: token request failed: %v", err)
+	}
+
+	realm := h.options.Realm
+	if realm == "" {
+		realm = "registry"
+	}
+	WriteError(w, realm, err)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	// The header has already been written, so an encoding error can not be reported anymore.
+	_ = json.NewEncoder(w).Encode(v)
+}
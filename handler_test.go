@@ -0,0 +1,460 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/distribution/distribution/registry/auth/token"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func newTestTokenHandler(t *testing.T, authorizer Authorizer) *TokenHandler {
+	g, err := NewDefaultTokenGenerator(".devcerts/RootCA.crt", ".devcerts/RootCA.key")
+	assert.NoError(t, err)
+
+	authenticator := newMockAuthenticator("jens", "secret")
+	return NewTokenHandler(AdaptAuthenticator(authenticator), authorizer, g, &TokenHandlerOptions{
+		TokenOptions: TokenOptions{
+			ExpiresIn: 3600,
+			Issuer:    "test",
+			Audience:  "registry",
+		},
+		RefreshTokens: NewRefreshTokenManager(NewInMemoryRefreshTokenStore(), 0),
+		Identities:    authenticator,
+		ErrorLog:      log.New(io.Discard, "", 0),
+	})
+}
+
+func decodeToken(t *testing.T, rec *httptest.ResponseRecorder) (map[string]interface{}, *token.Token) {
+	var body map[string]interface{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+
+	tok, err := token.NewToken(body["access_token"].(string))
+	assert.NoError(t, err)
+	return body, tok
+}
+
+func TestTokenHandler_Get(t *testing.T) {
+	h := newTestTokenHandler(t, NewDummyAuthorizer())
+
+	req := httptest.NewRequest(http.MethodGet, "/?account=jens&service=registry&client_id=docker&scope=repository:foo/bar:pull", nil)
+	req.SetBasicAuth("jens", "secret")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	body, tok := decodeToken(t, rec)
+	assert.Nil(t, body["refresh_token"])
+	assert.Equal(t, "jens", tok.Claims.Subject)
+	assert.Len(t, tok.Claims.Access, 1)
+	assert.Equal(t, "foo/bar", tok.Claims.Access[0].Name)
+}
+
+func TestTokenHandler_GetFails(t *testing.T) {
+	h := newTestTokenHandler(t, &mockAuthorizer{actions: ActionSet{ActionPull}})
+
+	tests := []struct {
+		name     string
+		query    string
+		user     string
+		pass     string
+		wantCode int
+	}{
+		{"TestNoBasicAuth", "account=jens&service=registry&client_id=docker", "", "", http.StatusUnauthorized},
+		{"TestInvalidPassword", "account=jens&service=registry&client_id=docker", "jens", "wrong", http.StatusUnauthorized},
+		{"TestOtherAccount", "account=other&service=registry&client_id=docker", "jens", "secret", http.StatusBadRequest},
+		{"TestInvalidScope", "account=jens&service=registry&client_id=docker&scope=repository:foo", "jens", "secret", http.StatusBadRequest},
+		{"TestDenied", "account=jens&service=registry&client_id=docker&scope=repository:foo/bar:push", "jens", "secret", http.StatusForbidden},
+		{"TestOtherService", "account=jens&service=other&client_id=docker", "jens", "secret", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/?"+tt.query, nil)
+			if tt.user != "" {
+				req.SetBasicAuth(tt.user, tt.pass)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.wantCode, rec.Code)
+
+			var body errorEnvelope
+			assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+			assert.Len(t, body.Errors, 1)
+		})
+	}
+}
+
+func TestTokenHandler_Unauthorized(t *testing.T) {
+	h := newTestTokenHandler(t, NewDummyAuthorizer())
+
+	req := httptest.NewRequest(http.MethodGet, "/?account=jens&service=registry&client_id=docker", nil)
+	req.SetBasicAuth("jens", "wrong")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, `Basic realm="registry"`, rec.Header().Get("WWW-Authenticate"))
+	assert.JSONEq(t, `{"errors":[{"code":"UNAUTHORIZED","message":"invalid username or password"}]}`, rec.Body.String())
+}
+
+type failingAuthorizer struct{}
+
+func (a *failingAuthorizer) Authorize(ctx context.Context, req *AuthorizationRequest, scope *Scope) (ActionSet, error) {
+	return nil, errors.New("sql: dial tcp 10.0.0.5:5432: connection refused")
+}
+
+func TestTokenHandler_LogsInternalErrors(t *testing.T) {
+	h := newTestTokenHandler(t, &failingAuthorizer{})
+	var logs bytes.Buffer
+	h.options.ErrorLog = log.New(&logs, "", 0)
+
+	req := httptest.NewRequest(http.MethodGet, "/?account=jens&service=registry&client_id=docker&scope=repository:foo/bar:pull", nil)
+	req.SetBasicAuth("jens", "secret")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	// The cause is logged, but not written to the client
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.JSONEq(t, `{"errors":[{"code":"DENIED","message":"requested access to the resource is denied"}]}`, rec.Body.String())
+	assert.Contains(t, logs.String(), "10.0.0.5:5432")
+}
+
+func TestTokenHandler_PostPasswordAndRefreshToken(t *testing.T) {
+	h := newTestTokenHandler(t, NewDummyAuthorizer())
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, newFormRequest(url.Values{
+		"grant_type":  {"password"},
+		"username":    {"jens"},
+		"password":    {"secret"},
+		"service":     {"registry"},
+		"client_id":   {"docker"},
+		"access_type": {"offline"},
+	}))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	body, tok := decodeToken(t, rec)
+	refreshToken, ok := body["refresh_token"].(string)
+	assert.True(t, ok)
+	assert.NotEmpty(t, refreshToken)
+	assert.Equal(t, "jens", tok.Claims.Subject)
+	assert.Empty(t, tok.Claims.Access)
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, newFormRequest(url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+		"service":       {"registry"},
+		"client_id":     {"docker"},
+		"scope":         {"repository:foo/bar:pull,push"},
+	}))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	body, tok = decodeToken(t, rec)
+	assert.Equal(t, "repository:foo/bar:pull,push", body["scope"])
+	assert.Nil(t, body["refresh_token"])
+	assert.Equal(t, "jens", tok.Claims.Subject)
+	assert.Len(t, tok.Claims.Access, 1)
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, newFormRequest(url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {"unknown"},
+		"service":       {"registry"},
+		"client_id":     {"docker"},
+	}))
+
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+// scopedAuthenticator authenticates jens with a restriction to pull foo/bar.
+type scopedAuthenticator struct{}
+
+func (a *scopedAuthenticator) AuthenticateIdentity(ctx context.Context, user string, pass string) (*Identity, error) {
+	return &Identity{Subject: user, Method: AuthMethodPassword, AllowedScopes: []*Scope{{Type: ScopeTypeRepository, Name: "foo/bar", Actions: ActionSet{ActionPull}}}}, nil
+}
+
+func TestTokenHandler_RefreshTokenChecksSubject(t *testing.T) {
+	h := newTestTokenHandler(t, NewDummyAuthorizer())
+	h.authenticator = &scopedAuthenticator{}
+	h.options.TokenOptions.PartialGrant = true
+	identities := newMockAuthenticator("jens", "secret")
+	h.options.Identities = identities
+
+	refresh := func(refreshToken string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, newFormRequest(url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {refreshToken},
+			"service":       {"registry"},
+			"client_id":     {"docker"},
+			"scope":         {"repository:foo/bar:pull,push"},
+		}))
+		return rec
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, newFormRequest(url.Values{
+		"grant_type":  {"password"},
+		"username":    {"jens"},
+		"password":    {"drat_token"},
+		"service":     {"registry"},
+		"client_id":   {"docker"},
+		"access_type": {"offline"},
+	}))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	body, _ := decodeToken(t, rec)
+	refreshToken := body["refresh_token"].(string)
+
+	// The refresh token keeps the restrictions of the login it was issued for
+	rec = refresh(refreshToken)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	body, _ = decodeToken(t, rec)
+	assert.Equal(t, "repository:foo/bar:pull", body["scope"])
+
+	// Without a way to look up the subject, refresh tokens can not be used
+	h.options.Identities = nil
+	assert.Equal(t, http.StatusBadRequest, refresh(refreshToken).Code)
+	h.options.Identities = identities
+
+	// Refresh tokens of users that do not exist anymore are rejected and revoked
+	identities.mockUser = "other"
+	assert.Equal(t, http.StatusUnauthorized, refresh(refreshToken).Code)
+	identities.mockUser = "jens"
+	assert.Equal(t, http.StatusUnauthorized, refresh(refreshToken).Code)
+}
+
+func TestTokenHandler_MethodNotAllowed(t *testing.T) {
+	h := newTestTokenHandler(t, NewDummyAuthorizer())
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/", nil))
+
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	assert.Equal(t, "GET, POST", rec.Header().Get("Allow"))
+}
+
+type recordingAuthorizer struct {
+	ctx context.Context
+	req *AuthorizationRequest
+}
+
+func (a *recordingAuthorizer) Authorize(ctx context.Context, req *AuthorizationRequest, scope *Scope) (ActionSet, error) {
+	a.ctx = ctx
+	a.req = req
+	return scope.Actions, nil
+}
+
+func TestTokenHandler_PropagatesRequestContext(t *testing.T) {
+	authorizer := &recordingAuthorizer{}
+	h := newTestTokenHandler(t, authorizer)
+	h.options.TrustedProxies, _ = ParseTrustedProxies([]string{"10.0.0.0/8"})
+
+	type ctxKey struct{}
+	req := httptest.NewRequest(http.MethodGet, "/?account=jens&service=registry&client_id=docker&scope=repository:foo/bar:pull", nil)
+	req = req.WithContext(context.WithValue(req.Context(), ctxKey{}, "value"))
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "5.6.7.8")
+	req.Header.Set("User-Agent", "docker/24.0.0")
+	req.SetBasicAuth("jens", "secret")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "5.6.7.8", authorizer.req.IP)
+	assert.Equal(t, "value", authorizer.ctx.Value(ctxKey{}))
+
+	md, ok := RequestMetadataFromContext(authorizer.ctx)
+	assert.True(t, ok)
+	assert.Equal(t, "5.6.7.8", md.IP)
+	assert.Equal(t, "docker/24.0.0", md.UserAgent)
+}
+
+type groupAuthenticator struct {
+	groups  []string
+	removed bool
+}
+
+func (a *groupAuthenticator) AuthenticateIdentity(ctx context.Context, user string, pass string) (*Identity, error) {
+	return a.LookupIdentity(ctx, user)
+}
+
+func (a *groupAuthenticator) LookupIdentity(ctx context.Context, subject string) (*Identity, error) {
+	if a.removed {
+		return nil, ErrUnknownUser
+	}
+	return &Identity{Subject: subject, Groups: a.groups, Method: AuthMethodPassword}, nil
+}
+
+func TestTokenHandler_PassesIdentity(t *testing.T) {
+	authorizer := &recordingAuthorizer{}
+	h := newTestTokenHandler(t, authorizer)
+	authenticator := &groupAuthenticator{groups: []string{"developers"}}
+	h.authenticator = authenticator
+	h.options.Identities = nil
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, newFormRequest(url.Values{
+		"grant_type":  {"password"},
+		"username":    {"jens"},
+		"password":    {"secret"},
+		"service":     {"registry"},
+		"client_id":   {"docker"},
+		"access_type": {"offline"},
+		"scope":       {"repository:foo/bar:pull"},
+	}))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotNil(t, authorizer.req.Identity)
+	assert.True(t, authorizer.req.Identity.HasGroup("developers"))
+
+	body, _ := decodeToken(t, rec)
+	authorizer.req = nil
+	authenticator.groups = []string{"developers", "maintainers"}
+
+	// The current identity is looked up for requests made with the refresh token
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, newFormRequest(url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {body["refresh_token"].(string)},
+		"service":       {"registry"},
+		"client_id":     {"docker"},
+		"scope":         {"repository:foo/bar:pull"},
+	}))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotNil(t, authorizer.req.Identity)
+	assert.True(t, authorizer.req.Identity.HasGroup("maintainers"))
+}
+
+func TestTokenHandler_RefreshTokenThroughWrappedAuthenticator(t *testing.T) {
+	tests := []struct {
+		name string
+		wrap func(t *testing.T, authenticator IdentityAuthenticator) IdentityAuthenticator
+	}{
+		{"TestCaching", func(t *testing.T, authenticator IdentityAuthenticator) IdentityAuthenticator {
+			a, err := NewCachingAuthenticator(authenticator, CacheOptions{})
+			assert.NoError(t, err)
+			return a
+		}},
+		{"TestLockout", func(t *testing.T, authenticator IdentityAuthenticator) IdentityAuthenticator {
+			return NewLockoutAuthenticator(authenticator, LockoutOptions{})
+		}},
+		{"TestTOTP", func(t *testing.T, authenticator IdentityAuthenticator) IdentityAuthenticator {
+			a, err := NewTOTPAuthenticator(authenticator, TOTPAuthenticatorOptions{Store: NewInMemoryTOTPStore()})
+			assert.NoError(t, err)
+			return a
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authorizer := &recordingAuthorizer{}
+			h := newTestTokenHandler(t, authorizer)
+			users := &groupAuthenticator{groups: []string{"developers"}}
+			h.authenticator = tt.wrap(t, users)
+			h.options.Identities = nil
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, newFormRequest(url.Values{
+				"grant_type":  {"password"},
+				"username":    {"jens"},
+				"password":    {"secret"},
+				"service":     {"registry"},
+				"client_id":   {"docker"},
+				"access_type": {"offline"},
+			}))
+			assert.Equal(t, http.StatusOK, rec.Code)
+			body, _ := decodeToken(t, rec)
+
+			// The lookup of the wrapped authenticator is used, so the current groups apply
+			users.groups = []string{"maintainers"}
+			rec = httptest.NewRecorder()
+			h.ServeHTTP(rec, newFormRequest(url.Values{
+				"grant_type":    {"refresh_token"},
+				"refresh_token": {body["refresh_token"].(string)},
+				"service":       {"registry"},
+				"client_id":     {"docker"},
+				"scope":         {"repository:foo/bar:pull"},
+			}))
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.True(t, authorizer.req.Identity.HasGroup("maintainers"))
+		})
+	}
+
+	// Wrapping an authenticator without lookup does not make refresh tokens usable
+	h := newTestTokenHandler(t, NewDummyAuthorizer())
+	a, err := NewCachingAuthenticator(&scopedAuthenticator{}, CacheOptions{})
+	assert.NoError(t, err)
+	h.authenticator = a
+	h.options.Identities = nil
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, newFormRequest(url.Values{
+		"grant_type":  {"password"},
+		"username":    {"jens"},
+		"password":    {"secret"},
+		"service":     {"registry"},
+		"client_id":   {"docker"},
+		"access_type": {"offline"},
+	}))
+	body, _ := decodeToken(t, rec)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, newFormRequest(url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {body["refresh_token"].(string)},
+		"service":       {"registry"},
+		"client_id":     {"docker"},
+	}))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestTokenHandler_Anonymous(t *testing.T) {
+	authorizer, err := NewPublicAuthorizer(NewDummyAuthorizer(), "library/*")
+	assert.NoError(t, err)
+	h := newTestTokenHandler(t, authorizer)
+
+	request := func(query string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?"+query, nil))
+		return rec
+	}
+
+	// Anonymous requests are rejected unless allowed
+	rec := request("service=registry&client_id=docker&scope=repository:library/alpine:pull")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	h.options.AllowAnonymous = true
+	rec = request("service=registry&client_id=docker&scope=repository:library/alpine:pull")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	_, tok := decodeToken(t, rec)
+	assert.Equal(t, "", tok.Claims.Subject)
+	assert.Len(t, tok.Claims.Access, 1)
+	assert.Equal(t, []string{"pull"}, tok.Claims.Access[0].Actions)
+
+	rec = request("service=registry&client_id=docker&scope=repository:acme/app:pull")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	// An account requires credentials, as does offline access
+	rec = request("account=jens&service=registry&client_id=docker&scope=repository:library/alpine:pull")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	rec = request("service=registry&client_id=docker&offline_token=true")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// Requests with credentials are still authenticated
+	req := httptest.NewRequest(http.MethodGet, "/?account=jens&service=registry&client_id=docker", nil)
+	req.SetBasicAuth("jens", "wrong")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
@@ -0,0 +1,114 @@
+package registry
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// HtpasswdAuthenticator is an authenticator for users in an Apache htpasswd file, like the one used by the htpasswd auth of the registry itself. Passwords are verified with VerifyPassword, so bcrypt and the legacy SHA1 and APR1 formats are supported. The file is loaded again when it changes on disk.
+type HtpasswdAuthenticator struct {
+	reloader *fileReloader
+
+	mu    sync.RWMutex
+	users map[string]string
+}
+
+// NewHtpasswdAuthenticator creates a new HtpasswdAuthenticator for the htpasswd file at the given path. If the file can not be loaded, an error is returned.
+func NewHtpasswdAuthenticator(path string) (*HtpasswdAuthenticator, error) {
+	a := &HtpasswdAuthenticator{}
+	a.reloader = newFileReloader(path, a.load)
+	if err := a.reloader.reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// ParseHtpasswd parses the contents of an htpasswd file into a map of usernames to password hashes. Empty lines and lines starting with # are ignored.
+func ParseHtpasswd(data []byte) (map[string]string, error) {
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		user, hash, ok := strings.Cut(entry, ":")
+		if !ok || user == "" || hash == "" {
+			return nil, fmt.Errorf("invalid htpasswd entry on line %d", line)
+		}
+		users[user] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (a *HtpasswdAuthenticator) load(data []byte) error {
+	users, err := ParseHtpasswd(data)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.users = users
+	return nil
+}
+
+// Reload loads the htpasswd file if it has changed. This is done on every authentication as well, calling it is only needed to check for errors in the file. If the file can not be loaded, the previously loaded users are kept.
+func (a *HtpasswdAuthenticator) Reload() error {
+	return a.reloader.reload()
+}
+
+// SetErrorLog sets the logger for failures to reload the htpasswd file on authentication. If nil, the standard logger of the log package is used.
+func (a *HtpasswdAuthenticator) SetErrorLog(logger *log.Logger) {
+	a.reloader.setErrorLog(logger)
+}
+
+// AuthenticateIdentity authenticates the user against the htpasswd file. If the file can not be reloaded, the previously loaded users are used and the error is logged.
+func (a *HtpasswdAuthenticator) AuthenticateIdentity(ctx context.Context, user string, pass string) (*Identity, error) {
+	a.reloader.refresh()
+
+	a.mu.RLock()
+	hash, ok := a.users[user]
+	a.mu.RUnlock()
+
+	if !ok {
+		spendPasswordVerification(pass)
+		return nil, ErrUnknownUser
+	}
+
+	// An unsupported hash format is a problem of the file, not something to report to the client.
+	if valid, err := VerifyPassword(hash, pass); err != nil || !valid {
+		return nil, ErrInvalidCredentials
+	}
+
+	return &Identity{
+		Subject: user,
+		Method:  AuthMethodPassword,
+	}, nil
+}
+
+// LookupIdentity returns the identity of the user if it is in the htpasswd file.
+func (a *HtpasswdAuthenticator) LookupIdentity(ctx context.Context, subject string) (*Identity, error) {
+	a.reloader.refresh()
+
+	a.mu.RLock()
+	_, ok := a.users[subject]
+	a.mu.RUnlock()
+
+	if !ok {
+		return nil, ErrUnknownUser
+	}
+	return &Identity{
+		Subject: subject,
+		Method:  AuthMethodPassword,
+	}, nil
+}
@@ -0,0 +1,112 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testHtpasswd = `# registry users
+jens:$2a$10$J12IkNnVv6Cmm5KPzMrFL.ya4IB6Uz7.0C71unneN9.ikZW0Ot8M.
+legacy-sha:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=
+legacy-md5:$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0
+
+plain:secret
+`
+
+func writeTestFile(t *testing.T, path, contents string) {
+	assert.NoError(t, os.WriteFile(path, []byte(contents), 0600))
+	// Make sure the modification time changes, even on file systems with a coarse resolution
+	modTime := time.Now().Add(time.Duration(len(contents)) * time.Second)
+	assert.NoError(t, os.Chtimes(path, modTime, modTime))
+}
+
+func TestParseHtpasswd(t *testing.T) {
+	users, err := ParseHtpasswd([]byte(testHtpasswd))
+	assert.NoError(t, err)
+	assert.Len(t, users, 4)
+	assert.Equal(t, "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", users["legacy-sha"])
+
+	_, err = ParseHtpasswd([]byte("jens\n"))
+	assert.Error(t, err)
+
+	_, err = ParseHtpasswd([]byte(":hash\n"))
+	assert.Error(t, err)
+}
+
+func TestHtpasswdAuthenticator(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	writeTestFile(t, path, testHtpasswd)
+
+	a, err := NewHtpasswdAuthenticator(path)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		user    string
+		pass    string
+		wantErr bool
+	}{
+		{"TestBcrypt", "jens", "secret", false},
+		{"TestSHA", "legacy-sha", "secret", false},
+		{"TestAPR1", "legacy-md5", "secret", false},
+		{"TestWrongPassword", "jens", "wrong", true},
+		{"TestUnknownUser", "unknown", "secret", true},
+		{"TestUnsupportedHash", "plain", "secret", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, err := a.AuthenticateIdentity(context.Background(), tt.user, tt.pass)
+			if tt.wantErr {
+				assert.True(t, errors.Is(err, ErrInvalidCredentials))
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.user, identity.Subject)
+			assert.Equal(t, AuthMethodPassword, identity.Method)
+		})
+	}
+
+	// Wrong passwords can be told apart from unknown users, for the ChainAuthenticator
+	_, err = a.AuthenticateIdentity(context.Background(), "unknown", "secret")
+	assert.True(t, errors.Is(err, ErrUnknownUser))
+	_, err = a.AuthenticateIdentity(context.Background(), "jens", "wrong")
+	assert.False(t, errors.Is(err, ErrUnknownUser))
+}
+
+func TestHtpasswdAuthenticator_Reload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	writeTestFile(t, path, "jens:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n")
+
+	a, err := NewHtpasswdAuthenticator(path)
+	assert.NoError(t, err)
+
+	_, err = a.AuthenticateIdentity(context.Background(), "legacy-md5", "secret")
+	assert.Error(t, err)
+
+	writeTestFile(t, path, testHtpasswd)
+
+	_, err = a.AuthenticateIdentity(context.Background(), "legacy-md5", "secret")
+	assert.NoError(t, err)
+
+	// A broken file keeps the previously loaded users, and is logged
+	var logs bytes.Buffer
+	a.SetErrorLog(log.New(&logs, "", 0))
+	writeTestFile(t, path, "broken")
+	_, err = a.AuthenticateIdentity(context.Background(), "legacy-md5", "secret")
+	assert.NoError(t, err)
+	assert.Contains(t, logs.String(), "invalid htpasswd entry on line 1")
+	assert.Error(t, a.Reload())
+}
+
+func TestNewHtpasswdAuthenticatorMissingFile(t *testing.T) {
+	_, err := NewHtpasswdAuthenticator(filepath.Join(t.TempDir(), "missing"))
+	assert.Error(t, err)
+}
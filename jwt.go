@@ -0,0 +1,481 @@
+package registry
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jwtToken is a parsed, not yet verified, JSON Web Token.
+type jwtToken struct {
+	header       jwtHeader
+	claims       jwtClaims
+	signingInput string
+	signature    []byte
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// jwtClaims are the claims of a JSON Web Token, numbers are decoded as json.Number.
+type jwtClaims map[string]interface{}
+
+// looksLikeJWT checks if the password has the form of a JWT, so other passwords can be left to other authenticators.
+func looksLikeJWT(password string) bool {
+	return strings.Count(password, ".") == 2 && strings.HasPrefix(password, "eyJ")
+}
+
+func parseJWT(raw string) (*jwtToken, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("jwt must have 3 parts")
+	}
+
+	token := &jwtToken{signingInput: parts[0] + "." + parts[1]}
+
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid jwt header: %w", err)
+	}
+	if err := json.Unmarshal(header, &token.header); err != nil {
+		return nil, fmt.Errorf("invalid jwt header: %w", err)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid jwt payload: %w", err)
+	}
+	decoder := json.NewDecoder(strings.NewReader(string(payload)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&token.claims); err != nil {
+		return nil, fmt.Errorf("invalid jwt payload: %w", err)
+	}
+
+	if token.signature, err = base64.RawURLEncoding.DecodeString(parts[2]); err != nil {
+		return nil, fmt.Errorf("invalid jwt signature: %w", err)
+	}
+	return token, nil
+}
+
+// minRSAKeyBits is the minimum size of RSA keys tokens are accepted from, smaller keys can be factored.
+const minRSAKeyBits = 2048
+
+// verify verifies the signature of the token with the given key. Only asymmetric algorithms are supported, so a public key can never be used as HMAC secret.
+func (t *jwtToken) verify(key crypto.PublicKey) error {
+	var hash crypto.Hash
+	switch t.header.Alg {
+	case "RS256", "ES256", "PS256":
+		hash = crypto.SHA256
+	case "RS384", "ES384", "PS384":
+		hash = crypto.SHA384
+	case "RS512", "ES512", "PS512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported jwt algorithm: %s", t.header.Alg)
+	}
+
+	h := hash.New()
+	h.Write([]byte(t.signingInput))
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if k.N.BitLen() < minRSAKeyBits {
+			return fmt.Errorf("jwt rsa key is smaller than %d bits", minRSAKeyBits)
+		}
+		if strings.HasPrefix(t.header.Alg, "RS") {
+			return rsa.VerifyPKCS1v15(k, hash, digest, t.signature)
+		}
+		if strings.HasPrefix(t.header.Alg, "PS") {
+			return rsa.VerifyPSS(k, hash, digest, t.signature, nil)
+		}
+	case *ecdsa.PublicKey:
+		bits := k.Curve.Params().BitSize
+		size := (bits + 7) / 8
+		if t.header.Alg == map[int]string{256: "ES256", 384: "ES384", 521: "ES512"}[bits] && len(t.signature) == 2*size {
+			r := new(big.Int).SetBytes(t.signature[:size])
+			s := new(big.Int).SetBytes(t.signature[size:])
+			if ecdsa.Verify(k, digest, r, s) {
+				return nil
+			}
+			return fmt.Errorf("invalid jwt signature")
+		}
+	}
+	return fmt.Errorf("jwt algorithm %s does not match the key", t.header.Alg)
+}
+
+// validateTime checks the exp, nbf and iat claims at the given time, allowing the given clock skew. The exp claim is required.
+func (c jwtClaims) validateTime(now time.Time, skew time.Duration) error {
+	exp, ok := c.time("exp")
+	if !ok {
+		return fmt.Errorf("jwt has no expiry")
+	}
+	if !now.Add(-skew).Before(exp) {
+		return fmt.Errorf("jwt has expired")
+	}
+	if nbf, ok := c.time("nbf"); ok && now.Add(skew).Before(nbf) {
+		return fmt.Errorf("jwt is not valid yet")
+	}
+	if iat, ok := c.time("iat"); ok && now.Add(skew).Before(iat) {
+		return fmt.Errorf("jwt is issued in the future")
+	}
+	return nil
+}
+
+// hasAudience checks if the aud claim, which is a string or an array of strings, contains one of the given audiences.
+func (c jwtClaims) hasAudience(audiences []string) bool {
+	var aud []string
+	switch v := c["aud"].(type) {
+	case string:
+		aud = []string{v}
+	case []interface{}:
+		for _, a := range v {
+			if s, ok := a.(string); ok {
+				aud = append(aud, s)
+			}
+		}
+	}
+
+	for _, a := range aud {
+		if containsString(audiences, a) {
+			return true
+		}
+	}
+	return false
+}
+
+// string returns a claim as string. Strings are returned as is, other values as JSON.
+func (c jwtClaims) string(name string) string {
+	switch v := c[name].(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+}
+
+// strings returns a claim that is a string or an array of strings.
+func (c jwtClaims) strings(name string) []string {
+	switch v := c[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, value := range v {
+			if s, ok := value.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func (c jwtClaims) time(name string) (time.Time, bool) {
+	n, ok := c[name].(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(f), 0), true
+}
+
+// validateJWT verifies the signature of the token with the key set, and checks that it is not expired and issued for one of the audiences. Failures are returned as ErrInvalidCredentials, failing to get the keys as ErrUnknown.
+func validateJWT(ctx context.Context, token *jwtToken, keys *jwksKeySet, audiences []string, now time.Time, skew time.Duration) error {
+	key, err := keys.key(ctx, token.header.Kid)
+	if errors.Is(err, errUnknownKeyID) {
+		return ErrInvalidCredentials.WithDetail(err.Error())
+	}
+	if err != nil {
+		return ErrUnknown.WithCause(fmt.Errorf("jwt: %w", err))
+	}
+
+	if err := token.verify(key); err != nil {
+		return ErrInvalidCredentials.WithDetail(err.Error())
+	}
+
+	if err := token.claims.validateTime(now, skew); err != nil {
+		return ErrInvalidCredentials.WithDetail(err.Error())
+	}
+
+	if !token.claims.hasAudience(audiences) {
+		return ErrInvalidCredentials.WithDetail("jwt is not issued for this audience")
+	}
+	return nil
+}
+
+// jwk is a JSON Web Key, only the fields of RSA and EC public keys are decoded.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS parses a JSON Web Key Set into its public signing keys by key ID. Keys of unsupported types and curves, and RSA keys smaller than 2048 bits, are skipped.
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid jwks: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("invalid jwk %s: %w", k.Kid, err)
+		}
+		if key != nil {
+			keys[k.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if key.N.BitLen() < minRSAKeyBits {
+			return nil, nil
+		}
+		return key, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, nil
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("point is not on curve %s", k.Crv)
+		}
+		return key, nil
+	}
+	return nil, nil
+}
+
+// errUnknownKeyID is returned by the jwksKeySet when a token is signed with a key that is not in the set.
+var errUnknownKeyID = errors.New("unknown jwt key id")
+
+// jwksKeySet is a JSON Web Key Set fetched from a URL or read from a file. Keys are cached for the TTL, and fetched again when a token has an unknown key ID, so rotated keys are picked up without waiting for the TTL.
+type jwksKeySet struct {
+	url  string
+	file string
+	// discover returns the URL of the set, it is called on the first fetch when there is no URL or file.
+	discover func(ctx context.Context) (string, error)
+	client   *http.Client
+	ttl      time.Duration
+	// minRefresh is the minimum time between fetches for unknown key IDs and after a failed fetch, so tokens with random key IDs or an unavailable issuer can not make the server hammer the issuer.
+	minRefresh time.Duration
+	now        func() time.Time
+
+	mu          sync.Mutex
+	keys        map[string]crypto.PublicKey
+	fetchedAt   time.Time
+	attemptedAt time.Time
+	// err is the error of the last fetch, returned without fetching again within minRefresh.
+	err error
+	// fetching is closed when the fetch in progress is done, it is nil when there is none. The fetch is done without holding mu, so a slow issuer does not block tokens signed with known keys.
+	fetching chan struct{}
+}
+
+// key returns the key with the given key ID. An empty key ID matches the only key of a set with a single key.
+func (s *jwksKeySet) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	// Stale keys are used while they are being fetched again, and when they can not be fetched, so a slow or unavailable issuer does not reject tokens signed with known keys.
+	if s.keys == nil || (now.Sub(s.fetchedAt) >= s.ttl && s.fetching == nil) {
+		if err := s.refresh(ctx, now); err != nil && s.keys == nil {
+			return nil, err
+		}
+	}
+
+	if key, ok := s.lookup(kid); ok {
+		return key, nil
+	}
+
+	if s.fetching != nil || now.Sub(s.attemptedAt) >= s.minRefresh {
+		if err := s.refresh(ctx, now); err != nil {
+			return nil, err
+		}
+		if key, ok := s.lookup(kid); ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", errUnknownKeyID, kid)
+}
+
+func (s *jwksKeySet) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(s.keys) == 1 {
+		for _, key := range s.keys {
+			return key, true
+		}
+	}
+	key, ok := s.keys[kid]
+	return key, ok
+}
+
+// refresh fetches the keys, or waits for the fetch in progress. Within minRefresh of a failed fetch, its error is returned instead. It must be called with mu held, which is released during the fetch.
+func (s *jwksKeySet) refresh(ctx context.Context, now time.Time) error {
+	if fetching := s.fetching; fetching != nil {
+		s.mu.Unlock()
+		select {
+		case <-fetching:
+		case <-ctx.Done():
+		}
+		s.mu.Lock()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return s.err
+	}
+
+	if s.err != nil && now.Sub(s.attemptedAt) < s.minRefresh {
+		return s.err
+	}
+
+	fetching := make(chan struct{})
+	s.fetching = fetching
+	url := s.url
+	s.mu.Unlock()
+
+	// The fetch is shared with the requests waiting for it, so it is not canceled with the request starting it. The timeout of the client bounds it.
+	keys, url, err := s.fetch(context.WithoutCancel(ctx), url)
+
+	s.mu.Lock()
+	s.fetching = nil
+	close(fetching)
+	s.url = url
+	s.attemptedAt = now
+	s.err = err
+	if err == nil {
+		s.keys = keys
+		s.fetchedAt = now
+	}
+	return err
+}
+
+// fetch loads the keys from the file or the URL, discovering the URL if there is neither. The URL is returned, so it is only discovered once.
+func (s *jwksKeySet) fetch(ctx context.Context, url string) (map[string]crypto.PublicKey, string, error) {
+	var data []byte
+	var err error
+	if s.file == "" && url == "" && s.discover != nil {
+		if url, err = s.discover(ctx); err != nil {
+			return nil, "", err
+		}
+	}
+
+	if s.file != "" {
+		data, err = os.ReadFile(s.file)
+	} else {
+		data, err = httpGet(ctx, s.client, url)
+	}
+	if err != nil {
+		return nil, url, fmt.Errorf("failed to load jwks: %w", err)
+	}
+
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return nil, url, err
+	}
+	return keys, url, nil
+}
+
+// httpGet gets the body of the URL, responses other than 200 OK are an error. At most 1 MiB of the body is read.
+func httpGet(ctx context.Context, client *http.Client, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+// discoverJWKSURL reads the jwks_uri from the OpenID configuration of the issuer.
+func discoverJWKSURL(ctx context.Context, client *http.Client, issuer string) (string, error) {
+	data, err := httpGet(ctx, client, strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration")
+	if err != nil {
+		return "", err
+	}
+
+	var configuration struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := json.Unmarshal(data, &configuration); err != nil {
+		return "", fmt.Errorf("invalid openid configuration: %w", err)
+	}
+
+	// The configuration must be of the issuer itself, see https://openid.net/specs/openid-connect-discovery-1_0.html#ProviderConfigurationValidation.
+	if configuration.Issuer != issuer {
+		return "", fmt.Errorf("openid configuration is for issuer %s", configuration.Issuer)
+	}
+	if configuration.JWKSURI == "" {
+		return "", fmt.Errorf("openid configuration has no jwks_uri")
+	}
+	return configuration.JWKSURI, nil
+}
@@ -0,0 +1,296 @@
+package registry
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testJWTIssuer is an httptest stand-in for an OIDC issuer, serving the OpenID configuration and the keys, and signing tokens.
+type testJWTIssuer struct {
+	server *httptest.Server
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+
+	mu        sync.Mutex
+	jwksCalls int
+}
+
+func newTestJWTIssuer(t *testing.T) *testJWTIssuer {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	i := &testJWTIssuer{rsaKey: rsaKey, ecKey: ecKey}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"issuer": i.url(), "jwks_uri": i.url() + "/keys"})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		i.mu.Lock()
+		i.jwksCalls++
+		i.mu.Unlock()
+		writeJSON(w, http.StatusOK, i.jwks())
+	})
+	i.server = httptest.NewServer(mux)
+	t.Cleanup(i.server.Close)
+	return i
+}
+
+func (i *testJWTIssuer) url() string {
+	return i.server.URL
+}
+
+func (i *testJWTIssuer) jwks() map[string]interface{} {
+	encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	return map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "use": "sig", "n": encode(i.rsaKey.N.Bytes()), "e": encode(big.NewInt(int64(i.rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": encode(i.ecKey.X.FillBytes(make([]byte, 32))), "y": encode(i.ecKey.Y.FillBytes(make([]byte, 32)))},
+		{"kty": "oct", "kid": "hmac", "k": encode([]byte("secret"))},
+	}}
+}
+
+// sign signs the claims with the RSA key for RS256 and the EC key for ES256. The iss, iat and exp claims are set when missing.
+func (i *testJWTIssuer) sign(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	now := time.Now().Unix()
+	defaults := map[string]interface{}{"iss": i.url(), "iat": now, "exp": now + 300}
+	for name, value := range defaults {
+		if _, ok := claims[name]; !ok {
+			claims[name] = value
+		}
+	}
+
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	assert.NoError(t, err)
+	payload, err := json.Marshal(claims)
+	assert.NoError(t, err)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	digest := sha256.Sum256([]byte(signingInput))
+	var signature []byte
+	switch alg {
+	case "RS256":
+		signature, err = rsa.SignPKCS1v15(rand.Reader, i.rsaKey, crypto.SHA256, digest[:])
+		assert.NoError(t, err)
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, i.ecKey, digest[:])
+		assert.NoError(t, err)
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestJWTVerify(t *testing.T) {
+	issuer := newTestJWTIssuer(t)
+	keys, err := parseJWKS(mustMarshal(t, issuer.jwks()))
+	assert.NoError(t, err)
+	assert.Len(t, keys, 2)
+
+	for _, tt := range []struct{ alg, kid string }{{"RS256", "rsa"}, {"ES256", "ec"}} {
+		token, err := parseJWT(issuer.sign(t, tt.alg, tt.kid, map[string]interface{}{"sub": "jens"}))
+		assert.NoError(t, err)
+		assert.Equal(t, "jens", token.claims.string("sub"))
+		assert.NoError(t, token.verify(keys[tt.kid]))
+
+		// A key of another type is rejected
+		other := map[string]string{"rsa": "ec", "ec": "rsa"}[tt.kid]
+		assert.Error(t, token.verify(keys[other]))
+
+		// As is a token with another algorithm, like none or an HMAC using the public key as secret
+		for _, alg := range []string{"none", "HS256"} {
+			token.header.Alg = alg
+			assert.Error(t, token.verify(keys[tt.kid]))
+		}
+	}
+
+	token, err := parseJWT(issuer.sign(t, "RS256", "rsa", map[string]interface{}{"sub": "jens"}))
+	assert.NoError(t, err)
+	token.signingInput += "x"
+	assert.Error(t, token.verify(keys["rsa"]))
+
+	_, err = parseJWT("not.a.jwt")
+	assert.Error(t, err)
+}
+
+func TestJWTClaims(t *testing.T) {
+	now := time.Now()
+	claims := jwtClaims{
+		"exp":    json.Number("100"),
+		"nbf":    json.Number("50"),
+		"aud":    []interface{}{"registry", "other"},
+		"groups": []interface{}{"developers", "admins"},
+		"run":    json.Number("42"),
+	}
+
+	assert.NoError(t, claims.validateTime(time.Unix(60, 0), 0))
+	assert.Error(t, claims.validateTime(time.Unix(100, 0), 0))
+	assert.NoError(t, claims.validateTime(time.Unix(100, 0), time.Minute))
+	assert.Error(t, claims.validateTime(time.Unix(40, 0), 0))
+	assert.Error(t, jwtClaims{}.validateTime(now, 0))
+
+	assert.True(t, claims.hasAudience([]string{"registry"}))
+	assert.False(t, claims.hasAudience([]string{"something"}))
+	assert.True(t, jwtClaims{"aud": "registry"}.hasAudience([]string{"registry"}))
+
+	assert.Equal(t, []string{"developers", "admins"}, claims.strings("groups"))
+	assert.Equal(t, "42", claims.string("run"))
+	assert.Equal(t, "", claims.string("missing"))
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	data, err := json.Marshal(v)
+	assert.NoError(t, err)
+	return data
+}
+
+func TestJWTVerify_AlgorithmConfusion(t *testing.T) {
+	issuer := newTestJWTIssuer(t)
+	keys, err := parseJWKS(mustMarshal(t, issuer.jwks()))
+	assert.NoError(t, err)
+
+	claims := base64.RawURLEncoding.EncodeToString(mustMarshal(t, map[string]interface{}{"sub": "jens", "exp": time.Now().Unix() + 300}))
+	sign := func(alg, kid string, secret []byte) string {
+		header := base64.RawURLEncoding.EncodeToString(mustMarshal(t, map[string]string{"alg": alg, "kid": kid}))
+		if secret == nil {
+			return header + "." + claims + "."
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(header + "." + claims))
+		return header + "." + claims + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	}
+
+	publicKey, err := x509.MarshalPKIXPublicKey(&issuer.rsaKey.PublicKey)
+	assert.NoError(t, err)
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKey})
+
+	for name, raw := range map[string]string{
+		"TestHMACWithPublicKey":    sign("HS256", "rsa", pemKey),
+		"TestHMACWithPublicKeyDER": sign("HS256", "rsa", publicKey),
+		"TestHMACWithOctKey":       sign("HS256", "hmac", []byte("secret")),
+		"TestNone":                 sign("none", "rsa", nil),
+		"TestNoneUppercase":        sign("NONE", "rsa", nil),
+	} {
+		t.Run(name, func(t *testing.T) {
+			token, err := parseJWT(raw)
+			assert.NoError(t, err)
+			// The oct key is never part of the key set, so it can not be used as HMAC secret either
+			if key, ok := keys[token.header.Kid]; ok {
+				assert.Error(t, token.verify(key))
+			}
+		})
+	}
+	assert.NotContains(t, keys, "hmac")
+
+	// An RS256 token is not accepted with the EC key, and an ES256 token not with the RSA key
+	rs256, err := parseJWT(issuer.sign(t, "RS256", "ec", map[string]interface{}{"sub": "jens"}))
+	assert.NoError(t, err)
+	assert.Error(t, rs256.verify(keys["ec"]))
+	es256, err := parseJWT(issuer.sign(t, "ES256", "rsa", map[string]interface{}{"sub": "jens"}))
+	assert.NoError(t, err)
+	assert.Error(t, es256.verify(keys["rsa"]))
+}
+
+func TestJWTVerify_SmallRSAKey(t *testing.T) {
+	issuer := newTestJWTIssuer(t)
+	small, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(t, err)
+
+	encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	keys, err := parseJWKS(mustMarshal(t, map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "small", "n": encode(small.N.Bytes()), "e": encode(big.NewInt(int64(small.E)).Bytes())},
+	}}))
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+
+	issuer.rsaKey = small
+	token, err := parseJWT(issuer.sign(t, "RS256", "small", map[string]interface{}{"sub": "jens"}))
+	assert.NoError(t, err)
+	assert.Error(t, token.verify(&small.PublicKey))
+}
+
+func TestJWKSKeySet_FetchesWithoutBlocking(t *testing.T) {
+	issuer := newTestJWTIssuer(t)
+	release := make(chan struct{})
+	var calls int
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		call := calls
+		mu.Unlock()
+		if call > 1 {
+			<-release
+		}
+		writeJSON(w, http.StatusOK, issuer.jwks())
+	}))
+	t.Cleanup(server.Close)
+
+	now := time.Now()
+	keys := &jwksKeySet{url: server.URL, client: server.Client(), ttl: time.Hour, minRefresh: time.Minute, now: func() time.Time { return now }}
+	_, err := keys.key(context.Background(), "rsa")
+	assert.NoError(t, err)
+
+	// While the expired keys are fetched again, they are still used, and unknown key IDs wait for the fetch
+	now = now.Add(time.Hour)
+	fetched := make(chan error, 2)
+	go func() {
+		_, err := keys.key(context.Background(), "rsa")
+		fetched <- err
+	}()
+	assert.Eventually(t, func() bool {
+		keys.mu.Lock()
+		defer keys.mu.Unlock()
+		return keys.fetching != nil
+	}, time.Second, time.Millisecond)
+
+	_, err = keys.key(context.Background(), "ec")
+	assert.NoError(t, err)
+	go func() {
+		_, err := keys.key(context.Background(), "rotated")
+		fetched <- err
+	}()
+
+	close(release)
+	assert.NoError(t, <-fetched)
+	assert.ErrorIs(t, <-fetched, errUnknownKeyID)
+	assert.Equal(t, 2, calls)
+}
+
+func TestJWKSKeySet_FailureBackoff(t *testing.T) {
+	var calls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(server.Close)
+
+	now := time.Now()
+	keys := &jwksKeySet{url: server.URL, client: server.Client(), ttl: time.Hour, minRefresh: time.Minute, now: func() time.Time { return now }}
+	for i := 0; i < 3; i++ {
+		_, err := keys.key(context.Background(), "rsa")
+		assert.Error(t, err)
+	}
+	assert.Equal(t, 1, calls)
+
+	now = now.Add(time.Minute)
+	_, err := keys.key(context.Background(), "rsa")
+	assert.Error(t, err)
+	assert.Equal(t, 2, calls)
+}
@@ -0,0 +1,298 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const kubernetesServiceAccountPrefix = "system:serviceaccount:"
+
+// KubernetesOptions contains the options for a KubernetesAuthenticator. Tokens are validated offline against the keys of the Issuer, unless APIServerURL is set, in which case they are validated with the TokenReview API.
+type KubernetesOptions struct {
+	// Issuer is the service account issuer of the cluster (the --service-account-issuer of the API server), like https://kubernetes.default.svc.cluster.local. Required for offline validation.
+	Issuer string
+	// JWKSURL is the URL of the keys of the cluster. Defaults to the jwks_uri of the OpenID configuration of the issuer.
+	JWKSURL string
+	// JWKSFile is a local JSON Web Key Set file with the keys of the cluster, as served by the API server at /openid/v1/jwks.
+	JWKSFile string
+	// Audiences are the accepted audiences of the tokens, at least one is required. Use a dedicated audience for the registry in the projected volume, so tokens for the API server can not be used with the registry and the other way around.
+	Audiences []string
+
+	// APIServerURL is the URL of the API server, like https://kubernetes.default.svc. If set, tokens are validated with the TokenReview API, which also rejects tokens of deleted pods and service accounts.
+	APIServerURL string
+	// APIServerToken is the bearer token used to create token reviews, the service account of the registry needs permission to create tokenreviews.
+	APIServerToken string
+	// APIServerTokenFile is a file the bearer token is read from for every review, like /var/run/secrets/kubernetes.io/serviceaccount/token, so rotated tokens are picked up. Overrides APIServerToken.
+	APIServerTokenFile string
+	// APIServerCAFile is the CA certificate of the API server, like /var/run/secrets/kubernetes.io/serviceaccount/ca.crt. Ignored if HTTPClient is set.
+	APIServerCAFile string
+
+	// HTTPClient is used to fetch the keys and call the API server. Defaults to a client with a 10 second timeout.
+	HTTPClient *http.Client
+	// JWKSCacheTTL is how long the keys of the cluster are cached. Defaults to 1 hour.
+	JWKSCacheTTL time.Duration
+	// ClockSkew is the clock difference with the cluster that is allowed when checking the expiry of tokens. Defaults to 1 minute.
+	ClockSkew time.Duration
+}
+
+// KubernetesAuthenticator is an authenticator accepting a projected Kubernetes service account token as password, so pods can pull images without static secrets. The username must be the service account, as system:serviceaccount:<namespace>:<name>. The identity has the namespace and serviceaccount attributes, and the pod attribute if the token is bound to a pod. Token reviews are not cached, wrap the authenticator in a CachingAuthenticator to not call the API server for every token request.
+type KubernetesAuthenticator struct {
+	options KubernetesOptions
+	keys    *jwksKeySet
+	now     func() time.Time
+}
+
+// NewKubernetesAuthenticator creates a new KubernetesAuthenticator with the given options.
+func NewKubernetesAuthenticator(options KubernetesOptions) (*KubernetesAuthenticator, error) {
+	if options.JWKSCacheTTL <= 0 {
+		options.JWKSCacheTTL = time.Hour
+	}
+	if options.ClockSkew == 0 {
+		options.ClockSkew = time.Minute
+	}
+	if len(options.Audiences) == 0 {
+		return nil, fmt.Errorf("kubernetes authenticator has no audiences")
+	}
+
+	if options.HTTPClient == nil {
+		options.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+		if options.APIServerCAFile != "" {
+			data, err := os.ReadFile(options.APIServerCAFile)
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("no certificates found in %s", options.APIServerCAFile)
+			}
+			options.HTTPClient.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+		}
+	}
+
+	a := &KubernetesAuthenticator{options: options, now: time.Now}
+	if options.APIServerURL != "" {
+		if options.APIServerToken == "" && options.APIServerTokenFile == "" {
+			return nil, fmt.Errorf("kubernetes authenticator has no api server token")
+		}
+		return a, nil
+	}
+
+	if options.Issuer == "" {
+		return nil, fmt.Errorf("kubernetes authenticator needs an issuer or api server url")
+	}
+	a.keys = &jwksKeySet{
+		url:  options.JWKSURL,
+		file: options.JWKSFile,
+		discover: func(ctx context.Context) (string, error) {
+			return discoverJWKSURL(ctx, options.HTTPClient, options.Issuer)
+		},
+		client:     options.HTTPClient,
+		ttl:        options.JWKSCacheTTL,
+		minRefresh: time.Minute,
+		now:        time.Now,
+	}
+	return a, nil
+}
+
+// AuthenticateIdentity authenticates the service account with the token passed as password. Passwords that are not a JWT are rejected with ErrUnknownUser, as are tokens of other issuers when validating offline, so the authenticator can be chained with other authenticators.
+func (a *KubernetesAuthenticator) AuthenticateIdentity(ctx context.Context, user string, pass string) (*Identity, error) {
+	if !looksLikeJWT(pass) {
+		return nil, ErrUnknownUser
+	}
+
+	var account *kubernetesServiceAccount
+	var err error
+	if a.keys != nil {
+		account, err = a.validate(ctx, pass)
+	} else {
+		account, err = a.review(ctx, pass)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if account.username() != user {
+		return nil, ErrInvalidCredentials.WithDetail("username must be the service account of the token")
+	}
+
+	attributes := map[string]string{
+		"namespace":      account.namespace,
+		"serviceaccount": account.name,
+	}
+	if account.pod != "" {
+		attributes["pod"] = account.pod
+	}
+
+	return &Identity{
+		Subject:    user,
+		Groups:     account.groups,
+		Attributes: attributes,
+		Method:     AuthMethodKubernetes,
+	}, nil
+}
+
+type kubernetesServiceAccount struct {
+	namespace string
+	name      string
+	pod       string
+	groups    []string
+}
+
+func (s *kubernetesServiceAccount) username() string {
+	return kubernetesServiceAccountPrefix + s.namespace + ":" + s.name
+}
+
+// parseKubernetesServiceAccount parses a username like system:serviceaccount:<namespace>:<name>.
+func parseKubernetesServiceAccount(username string) (*kubernetesServiceAccount, error) {
+	namespace, name, ok := strings.Cut(strings.TrimPrefix(username, kubernetesServiceAccountPrefix), ":")
+	if !strings.HasPrefix(username, kubernetesServiceAccountPrefix) || !ok || namespace == "" || name == "" || strings.Contains(name, ":") {
+		return nil, fmt.Errorf("%s is not a service account", username)
+	}
+	return &kubernetesServiceAccount{namespace: namespace, name: name}, nil
+}
+
+// validate validates the token offline with the keys of the cluster.
+func (a *KubernetesAuthenticator) validate(ctx context.Context, pass string) (*kubernetesServiceAccount, error) {
+	token, err := parseJWT(pass)
+	if err != nil {
+		return nil, ErrInvalidCredentials.WithDetail(err.Error())
+	}
+	if token.claims.string("iss") != a.options.Issuer {
+		return nil, ErrUnknownUser
+	}
+
+	if err := validateJWT(ctx, token, a.keys, a.options.Audiences, a.now(), a.options.ClockSkew); err != nil {
+		return nil, err
+	}
+
+	account, err := parseKubernetesServiceAccount(token.claims.string("sub"))
+	if err != nil {
+		return nil, ErrInvalidCredentials.WithDetail(err.Error())
+	}
+
+	// Projected tokens have the namespace and the pod they are bound to in the kubernetes.io claim
+	var private struct {
+		Namespace string `json:"namespace"`
+		Pod       struct {
+			Name string `json:"name"`
+		} `json:"pod"`
+	}
+	if claim, ok := token.claims["kubernetes.io"]; ok {
+		data, err := json.Marshal(claim)
+		if err == nil {
+			err = json.Unmarshal(data, &private)
+		}
+		if err != nil || private.Namespace != account.namespace {
+			return nil, ErrInvalidCredentials.WithDetail("jwt has an invalid kubernetes.io claim")
+		}
+	}
+	account.pod = private.Pod.Name
+	account.groups = []string{"system:serviceaccounts", "system:serviceaccounts:" + account.namespace}
+	return account, nil
+}
+
+type tokenReview struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Spec       tokenReviewSpec   `json:"spec"`
+	Status     tokenReviewStatus `json:"status"`
+}
+
+type tokenReviewSpec struct {
+	Token     string   `json:"token"`
+	Audiences []string `json:"audiences,omitempty"`
+}
+
+type tokenReviewStatus struct {
+	Authenticated bool     `json:"authenticated"`
+	Audiences     []string `json:"audiences,omitempty"`
+	Error         string   `json:"error,omitempty"`
+	User          struct {
+		Username string              `json:"username"`
+		Groups   []string            `json:"groups"`
+		Extra    map[string][]string `json:"extra"`
+	} `json:"user"`
+}
+
+// review validates the token with the TokenReview API of the API server.
+func (a *KubernetesAuthenticator) review(ctx context.Context, pass string) (*kubernetesServiceAccount, error) {
+	bearer := a.options.APIServerToken
+	if a.options.APIServerTokenFile != "" {
+		data, err := os.ReadFile(a.options.APIServerTokenFile)
+		if err != nil {
+			return nil, ErrUnknown.WithCause(fmt.Errorf("kubernetes: %w", err))
+		}
+		bearer = strings.TrimSpace(string(data))
+	}
+
+	body, err := json.Marshal(tokenReview{
+		APIVersion: "authentication.k8s.io/v1",
+		Kind:       "TokenReview",
+		Spec:       tokenReviewSpec{Token: pass, Audiences: a.options.Audiences},
+	})
+	if err != nil {
+		return nil, ErrUnknown.WithCause(fmt.Errorf("kubernetes: %w", err))
+	}
+
+	url := strings.TrimSuffix(a.options.APIServerURL, "/") + "/apis/authentication.k8s.io/v1/tokenreviews"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, ErrUnknown.WithCause(fmt.Errorf("kubernetes: %w", err))
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "Bearer "+bearer)
+
+	resp, err := a.options.HTTPClient.Do(req)
+	if err != nil {
+		return nil, ErrUnknown.WithCause(fmt.Errorf("kubernetes: %w", err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return nil, ErrUnknown.WithCause(fmt.Errorf("kubernetes: POST %s: %s", url, resp.Status))
+	}
+
+	var result tokenReview
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&result); err != nil {
+		return nil, ErrUnknown.WithCause(fmt.Errorf("kubernetes: %w", err))
+	}
+
+	status := result.Status
+	if !status.Authenticated {
+		if status.Error != "" {
+			return nil, ErrInvalidCredentials.WithDetail(status.Error)
+		}
+		return nil, ErrInvalidCredentials
+	}
+
+	// The API server returns the audiences of the token that intersect with the requested ones
+	if len(status.Audiences) > 0 {
+		matched := false
+		for _, audience := range status.Audiences {
+			matched = matched || containsString(a.options.Audiences, audience)
+		}
+		if !matched {
+			return nil, ErrInvalidCredentials.WithDetail("jwt is not issued for this audience")
+		}
+	}
+
+	account, err := parseKubernetesServiceAccount(status.User.Username)
+	if err != nil {
+		return nil, ErrInvalidCredentials.WithDetail(err.Error())
+	}
+	if pods := status.User.Extra["authentication.kubernetes.io/pod-name"]; len(pods) > 0 {
+		account.pod = pods[0]
+	}
+	account.groups = status.User.Groups
+	return account, nil
+}
@@ -0,0 +1,195 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKubernetesAuthenticator_Offline(t *testing.T) {
+	issuer := newTestJWTIssuer(t)
+	a, err := NewKubernetesAuthenticator(KubernetesOptions{Issuer: issuer.url(), Audiences: []string{"registry"}})
+	assert.NoError(t, err)
+
+	claims := func() map[string]interface{} {
+		return map[string]interface{}{
+			"sub": "system:serviceaccount:ci:builder",
+			"aud": []string{"registry"},
+			"kubernetes.io": map[string]interface{}{
+				"namespace":      "ci",
+				"pod":            map[string]string{"name": "builder-7d9f", "uid": "1"},
+				"serviceaccount": map[string]string{"name": "builder", "uid": "2"},
+			},
+		}
+	}
+
+	identity, err := a.AuthenticateIdentity(context.Background(), "system:serviceaccount:ci:builder", issuer.sign(t, "ES256", "ec", claims()))
+	assert.NoError(t, err)
+	assert.Equal(t, "system:serviceaccount:ci:builder", identity.Subject)
+	assert.Equal(t, AuthMethodKubernetes, identity.Method)
+	assert.Equal(t, "ci", identity.Attribute("namespace"))
+	assert.Equal(t, "builder", identity.Attribute("serviceaccount"))
+	assert.Equal(t, "builder-7d9f", identity.Attribute("pod"))
+	assert.Equal(t, []string{"system:serviceaccounts", "system:serviceaccounts:ci"}, identity.Groups)
+
+	tests := []struct {
+		name   string
+		user   string
+		modify func(claims map[string]interface{})
+	}{
+		{"TestOtherUser", "system:serviceaccount:ci:other", func(c map[string]interface{}) {}},
+		{"TestOtherAudience", "system:serviceaccount:ci:builder", func(c map[string]interface{}) { c["aud"] = "https://kubernetes.default.svc" }},
+		{"TestNotServiceAccount", "jens", func(c map[string]interface{}) { c["sub"] = "jens" }},
+		{"TestNamespaceMismatch", "system:serviceaccount:ci:builder", func(c map[string]interface{}) {
+			c["kubernetes.io"] = map[string]interface{}{"namespace": "prod"}
+		}},
+		{"TestNoExpiry", "system:serviceaccount:ci:builder", func(c map[string]interface{}) { c["exp"] = nil }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := claims()
+			tt.modify(c)
+			_, err := a.AuthenticateIdentity(context.Background(), tt.user, issuer.sign(t, "RS256", "rsa", c))
+			assert.True(t, errors.Is(err, ErrInvalidCredentials), "error = %v", err)
+			assert.False(t, errors.Is(err, ErrUnknownUser))
+		})
+	}
+
+	// Tokens of other issuers and passwords are left to other authenticators
+	c := claims()
+	c["iss"] = "https://other.example.com"
+	_, err = a.AuthenticateIdentity(context.Background(), "system:serviceaccount:ci:builder", issuer.sign(t, "RS256", "rsa", c))
+	assert.True(t, errors.Is(err, ErrUnknownUser))
+	_, err = a.AuthenticateIdentity(context.Background(), "jens", "secret")
+	assert.True(t, errors.Is(err, ErrUnknownUser))
+}
+
+func TestKubernetesAuthenticator_JWKSFile(t *testing.T) {
+	issuer := newTestJWTIssuer(t)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	assert.NoError(t, os.WriteFile(path, mustMarshal(t, issuer.jwks()), 0600))
+
+	a, err := NewKubernetesAuthenticator(KubernetesOptions{Issuer: "https://kubernetes.default.svc.cluster.local", JWKSFile: path, Audiences: []string{"registry"}})
+	assert.NoError(t, err)
+
+	// Tokens without the kubernetes.io claim are accepted as well
+	token := issuer.sign(t, "RS256", "rsa", map[string]interface{}{
+		"iss": "https://kubernetes.default.svc.cluster.local",
+		"sub": "system:serviceaccount:default:puller",
+		"aud": "registry",
+	})
+	identity, err := a.AuthenticateIdentity(context.Background(), "system:serviceaccount:default:puller", token)
+	assert.NoError(t, err)
+	assert.Equal(t, "default", identity.Attribute("namespace"))
+	assert.Equal(t, "", identity.Attribute("pod"))
+	assert.Equal(t, 0, issuer.jwksCalls)
+}
+
+// newTestAPIServer returns an httptest stand-in for the TokenReview API, accepting a token with the payload "valid" for the builder service account.
+func newTestAPIServer(t *testing.T) (*httptest.Server, *int) {
+	reviews := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/apis/authentication.k8s.io/v1/tokenreviews" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer registry-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		reviews++
+
+		var review tokenReview
+		if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		assert.Equal(t, []string{"registry"}, review.Spec.Audiences)
+
+		if review.Spec.Token == "eyJhbGciOiJSUzI1NiJ9.valid.signature" {
+			review.Status.Authenticated = true
+			review.Status.Audiences = []string{"registry"}
+			review.Status.User.Username = "system:serviceaccount:ci:builder"
+			review.Status.User.Groups = []string{"system:serviceaccounts", "system:serviceaccounts:ci", "system:authenticated"}
+			review.Status.User.Extra = map[string][]string{"authentication.kubernetes.io/pod-name": {"builder-7d9f"}}
+		} else {
+			review.Status.Error = "invalid bearer token"
+		}
+		writeJSON(w, http.StatusCreated, review)
+	}))
+	t.Cleanup(server.Close)
+	return server, &reviews
+}
+
+func TestKubernetesAuthenticator_TokenReview(t *testing.T) {
+	server, reviews := newTestAPIServer(t)
+	a, err := NewKubernetesAuthenticator(KubernetesOptions{APIServerURL: server.URL, APIServerToken: "registry-token", Audiences: []string{"registry"}})
+	assert.NoError(t, err)
+
+	identity, err := a.AuthenticateIdentity(context.Background(), "system:serviceaccount:ci:builder", "eyJhbGciOiJSUzI1NiJ9.valid.signature")
+	assert.NoError(t, err)
+	assert.Equal(t, "ci", identity.Attribute("namespace"))
+	assert.Equal(t, "builder", identity.Attribute("serviceaccount"))
+	assert.Equal(t, "builder-7d9f", identity.Attribute("pod"))
+	assert.Contains(t, identity.Groups, "system:serviceaccounts:ci")
+
+	_, err = a.AuthenticateIdentity(context.Background(), "system:serviceaccount:ci:other", "eyJhbGciOiJSUzI1NiJ9.valid.signature")
+	assert.True(t, errors.Is(err, ErrInvalidCredentials))
+
+	_, err = a.AuthenticateIdentity(context.Background(), "system:serviceaccount:ci:builder", "eyJhbGciOiJSUzI1NiJ9.revoked.signature")
+	assert.True(t, errors.Is(err, ErrInvalidCredentials))
+	assert.False(t, errors.Is(err, ErrUnknownUser))
+
+	// Passwords are not sent to the API server
+	_, err = a.AuthenticateIdentity(context.Background(), "jens", "secret")
+	assert.True(t, errors.Is(err, ErrUnknownUser))
+	assert.Equal(t, 3, *reviews)
+}
+
+func TestKubernetesAuthenticator_TokenReviewFailure(t *testing.T) {
+	server, _ := newTestAPIServer(t)
+	path := filepath.Join(t.TempDir(), "token")
+	assert.NoError(t, os.WriteFile(path, []byte("wrong-token\n"), 0600))
+
+	a, err := NewKubernetesAuthenticator(KubernetesOptions{APIServerURL: server.URL, APIServerTokenFile: path, Audiences: []string{"registry"}})
+	assert.NoError(t, err)
+
+	// The API server refusing the review is not the fault of the user
+	_, err = a.AuthenticateIdentity(context.Background(), "system:serviceaccount:ci:builder", "eyJhbGciOiJSUzI1NiJ9.valid.signature")
+	assert.True(t, errors.Is(err, ErrUnknown))
+
+	// The token file is read for every review, so a rotated token is picked up
+	assert.NoError(t, os.WriteFile(path, []byte("registry-token\n"), 0600))
+	_, err = a.AuthenticateIdentity(context.Background(), "system:serviceaccount:ci:builder", "eyJhbGciOiJSUzI1NiJ9.valid.signature")
+	assert.NoError(t, err)
+
+	server.Close()
+	_, err = a.AuthenticateIdentity(context.Background(), "system:serviceaccount:ci:builder", "eyJhbGciOiJSUzI1NiJ9.valid.signature")
+	assert.True(t, errors.Is(err, ErrUnknown))
+}
+
+func TestNewKubernetesAuthenticatorInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		options KubernetesOptions
+	}{
+		{"TestNoAudiences", KubernetesOptions{Issuer: "https://kubernetes.default.svc.cluster.local"}},
+		{"TestNoIssuer", KubernetesOptions{Audiences: []string{"registry"}}},
+		{"TestNoAPIServerToken", KubernetesOptions{APIServerURL: "https://kubernetes.default.svc", Audiences: []string{"registry"}}},
+		{"TestMissingCAFile", KubernetesOptions{APIServerURL: "https://kubernetes.default.svc", APIServerToken: "token", APIServerCAFile: "/does/not/exist", Audiences: []string{"registry"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewKubernetesAuthenticator(tt.options)
+			assert.Error(t, err)
+		})
+	}
+}
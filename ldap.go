@@ -0,0 +1,386 @@
+package registry
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// LDAPConn is the part of an LDAP connection used by the LDAPAuthenticator. It is implemented by *ldap.Conn, other implementations can be used for testing.
+type LDAPConn interface {
+	Bind(username, password string) error
+	Search(req *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close() error
+}
+
+// LDAPOptions contains the options for an LDAPAuthenticator.
+type LDAPOptions struct {
+	// URL is the URL of the LDAP server, like ldap://ldap.example.com:389 or ldaps://ldap.example.com:636.
+	URL string
+	// StartTLS upgrades ldap:// connections to TLS with the StartTLS command.
+	StartTLS bool
+	// TLSConfig is used for ldaps:// and StartTLS. Defaults to verifying the host of the URL.
+	TLSConfig *tls.Config
+	// Timeout is the timeout for connecting and for every request. Defaults to 10 seconds. A shorter deadline of the context of an authentication is honored as well.
+	Timeout time.Duration
+	// Dial opens a connection to the LDAP server. Defaults to dialing URL, it can be replaced to use an in-process LDAP server for testing.
+	Dial func(ctx context.Context) (LDAPConn, error)
+	// PoolSize is the maximum number of idle connections kept open. Defaults to 4.
+	PoolSize int
+
+	// BindDN and BindPassword are the credentials of the service account used to search for users and groups.
+	BindDN       string
+	BindPassword string
+
+	// BaseDN is the DN to search for users in.
+	BaseDN string
+	// UserFilter is the filter to find a user by username, the escaped username replaces %s. Defaults to (uid=%s), use (sAMAccountName=%s) for Active Directory.
+	UserFilter string
+	// UsernameAttribute is the attribute holding the username, which is the subject of the identity. Directories match usernames case-insensitively, so the subject is taken from the entry to have the same spelling however the user typed it. Defaults to the attribute of a user filter like (uid=%s), it is required for other filters.
+	UsernameAttribute string
+	// DisplayNameAttribute is the attribute holding the display name of a user. Defaults to cn.
+	DisplayNameAttribute string
+
+	// GroupAttribute is the attribute of a user listing the DNs of its groups, like memberOf. If empty, groups are not read from the user.
+	GroupAttribute string
+	// GroupFilter is the filter to search the groups of a user with, the escaped DN of the user replaces %s, like (member=%s). If empty, groups are not searched for.
+	GroupFilter string
+	// GroupBaseDN is the DN to search for groups in. Defaults to BaseDN.
+	GroupBaseDN string
+	// GroupNameAttribute is the attribute holding the name of a group. Defaults to cn.
+	GroupNameAttribute string
+}
+
+// ldapAttributeFilter matches a filter comparing a single attribute to the username.
+var ldapAttributeFilter = regexp.MustCompile(`^\(([a-zA-Z][a-zA-Z0-9-]*)=%s\)$`)
+
+// LDAPAuthenticator is an authenticator for users in an LDAP directory, like Active Directory. It searches the user with a service account, binds as the user to verify the password, and resolves the groups of the user from a memberOf like attribute or with a group search. Connections are kept in a pool. When the context of an authentication is done, its connection is closed to abort the pending request.
+type LDAPAuthenticator struct {
+	options LDAPOptions
+	pool    chan LDAPConn
+}
+
+// NewLDAPAuthenticator creates a new LDAPAuthenticator with the given options. No connection is opened until the first authentication.
+func NewLDAPAuthenticator(options LDAPOptions) (*LDAPAuthenticator, error) {
+	if options.Timeout == 0 {
+		options.Timeout = 10 * time.Second
+	}
+	if options.PoolSize == 0 {
+		options.PoolSize = 4
+	}
+	if options.UserFilter == "" {
+		options.UserFilter = "(uid=%s)"
+	}
+	if options.DisplayNameAttribute == "" {
+		options.DisplayNameAttribute = "cn"
+	}
+	if options.GroupBaseDN == "" {
+		options.GroupBaseDN = options.BaseDN
+	}
+	if options.GroupNameAttribute == "" {
+		options.GroupNameAttribute = "cn"
+	}
+
+	if options.BaseDN == "" {
+		return nil, fmt.Errorf("ldap base DN is required")
+	}
+	if options.BindDN == "" {
+		return nil, fmt.Errorf("ldap bind DN is required")
+	}
+	if strings.Count(options.UserFilter, "%s") != 1 {
+		return nil, fmt.Errorf("ldap user filter must contain %%s exactly once")
+	}
+	if options.GroupFilter != "" && strings.Count(options.GroupFilter, "%s") != 1 {
+		return nil, fmt.Errorf("ldap group filter must contain %%s exactly once")
+	}
+	if options.UsernameAttribute == "" {
+		match := ldapAttributeFilter.FindStringSubmatch(options.UserFilter)
+		if match == nil {
+			return nil, fmt.Errorf("ldap username attribute is required for the user filter %s", options.UserFilter)
+		}
+		options.UsernameAttribute = match[1]
+	}
+
+	if options.Dial == nil {
+		u, err := url.Parse(options.URL)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid ldap url: %s", options.URL)
+		}
+		if options.TLSConfig == nil {
+			options.TLSConfig = &tls.Config{ServerName: u.Hostname()}
+		}
+	}
+
+	return &LDAPAuthenticator{
+		options: options,
+		pool:    make(chan LDAPConn, options.PoolSize),
+	}, nil
+}
+
+// dial opens a new connection with the Dial option, or to the URL if it is not set.
+func (a *LDAPAuthenticator) dial(ctx context.Context) (LDAPConn, error) {
+	if a.options.Dial != nil {
+		return a.options.Dial(ctx)
+	}
+
+	timeout := a.options.Timeout
+	if deadline, ok := ctx.Deadline(); ok {
+		if remaining := time.Until(deadline); remaining < timeout {
+			timeout = remaining
+		}
+	}
+	if timeout <= 0 {
+		return nil, context.DeadlineExceeded
+	}
+
+	conn, err := ldap.DialURL(a.options.URL, ldap.DialWithTLSConfig(a.options.TLSConfig), ldap.DialWithDialer(&net.Dialer{Timeout: timeout}))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(timeout)
+
+	if a.options.StartTLS {
+		if err := conn.StartTLS(a.options.TLSConfig); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	conn.SetTimeout(a.options.Timeout)
+
+	return conn, nil
+}
+
+// AuthenticateIdentity authenticates the user with a bind to the LDAP server. The subject of the identity is the username of the entry, and the identity has the DN of the user as dn attribute.
+func (a *LDAPAuthenticator) AuthenticateIdentity(ctx context.Context, user string, pass string) (*Identity, error) {
+	// Most servers accept a bind without password as an anonymous bind, which must never authenticate a user.
+	if user == "" || pass == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	identity, err := a.do(ctx, func(conn LDAPConn) (*Identity, error) {
+		return a.authenticate(conn, user, pass)
+	})
+	if err != nil && !errors.Is(err, ErrInvalidCredentials) {
+		return nil, ErrUnknown.WithCause(fmt.Errorf("ldap: %w", err))
+	}
+	return identity, err
+}
+
+func (a *LDAPAuthenticator) authenticate(conn LDAPConn, user, pass string) (*Identity, error) {
+	entry, err := a.search(conn, user)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.Bind(entry.DN, pass); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, err
+	}
+
+	return a.identity(conn, entry)
+}
+
+// LookupIdentity searches the user with the service account and returns its current identity, without binding as the user.
+func (a *LDAPAuthenticator) LookupIdentity(ctx context.Context, subject string) (*Identity, error) {
+	if subject == "" {
+		return nil, ErrUnknownUser
+	}
+
+	identity, err := a.do(ctx, func(conn LDAPConn) (*Identity, error) {
+		return a.lookup(conn, subject)
+	})
+	if errors.Is(err, ErrInvalidCredentials) {
+		return nil, ErrUnknownUser
+	}
+	if err != nil {
+		return nil, ErrUnknown.WithCause(fmt.Errorf("ldap: %w", err))
+	}
+	return identity, nil
+}
+
+// do runs fn with a connection from the pool. The connection is closed when ctx is done before fn returns, and when fn fails with another error than ErrInvalidCredentials, because its state is unknown then. A pooled connection may have been closed by the server while it was idle, which is only noticed when using it, so fn is retried once on a new connection after a network error.
+func (a *LDAPAuthenticator) do(ctx context.Context, fn func(conn LDAPConn) (*Identity, error)) (*Identity, error) {
+	for retried := false; ; retried = true {
+		conn, pooled, err := a.get(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+		identity, err := fn(conn)
+		if !stop() {
+			// The connection is closed already, so the error of fn is a result of that.
+			return nil, ctx.Err()
+		}
+
+		if err == nil || errors.Is(err, ErrInvalidCredentials) {
+			a.put(conn)
+			return identity, err
+		}
+
+		_ = conn.Close()
+		if !pooled || retried || !ldap.IsErrorWithCode(err, ldap.ErrorNetwork) {
+			return nil, err
+		}
+	}
+}
+
+func (a *LDAPAuthenticator) lookup(conn LDAPConn, subject string) (*Identity, error) {
+	entry, err := a.search(conn, subject)
+	if err != nil {
+		return nil, err
+	}
+	return a.identity(conn, entry)
+}
+
+// search binds as the service account and searches the entry of the user. An unknown user is ErrUnknownUser, a filter matching several users ErrInvalidCredentials.
+func (a *LDAPAuthenticator) search(conn LDAPConn, user string) (*ldap.Entry, error) {
+	if err := conn.Bind(a.options.BindDN, a.options.BindPassword); err != nil {
+		return nil, err
+	}
+
+	attributes := []string{a.options.UsernameAttribute, a.options.DisplayNameAttribute}
+	if a.options.GroupAttribute != "" {
+		attributes = append(attributes, a.options.GroupAttribute)
+	}
+
+	result, err := conn.Search(ldap.NewSearchRequest(
+		a.options.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(a.options.Timeout.Seconds()), false,
+		fmt.Sprintf(a.options.UserFilter, ldap.EscapeFilter(user)),
+		attributes, nil,
+	))
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, err
+	}
+
+	if result == nil || len(result.Entries) == 0 {
+		return nil, ErrUnknownUser
+	}
+	// An ambiguous filter must not authenticate whichever user happens to be first.
+	if len(result.Entries) != 1 {
+		return nil, ErrInvalidCredentials
+	}
+	return result.Entries[0], nil
+}
+
+// identity returns the identity of the user with the given entry.
+func (a *LDAPAuthenticator) identity(conn LDAPConn, entry *ldap.Entry) (*Identity, error) {
+	subject := entry.GetAttributeValue(a.options.UsernameAttribute)
+	if subject == "" {
+		return nil, fmt.Errorf("user %s has no %s attribute", entry.DN, a.options.UsernameAttribute)
+	}
+
+	groups, err := a.groups(conn, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Identity{
+		Subject:     subject,
+		DisplayName: entry.GetAttributeValue(a.options.DisplayNameAttribute),
+		Groups:      groups,
+		Attributes:  map[string]string{"dn": entry.DN},
+		Method:      AuthMethodPassword,
+	}, nil
+}
+
+// groups resolves the group names of the user, from the group attribute of the user and with the group search.
+func (a *LDAPAuthenticator) groups(conn LDAPConn, entry *ldap.Entry) ([]string, error) {
+	var groups []string
+	if a.options.GroupAttribute != "" {
+		for _, dn := range entry.GetAttributeValues(a.options.GroupAttribute) {
+			if name := groupNameFromDN(dn); name != "" {
+				groups = append(groups, name)
+			}
+		}
+	}
+
+	if a.options.GroupFilter == "" {
+		return groups, nil
+	}
+
+	// The connection is bound as the user now, which may not be allowed to search for groups.
+	if err := conn.Bind(a.options.BindDN, a.options.BindPassword); err != nil {
+		return nil, err
+	}
+
+	result, err := conn.Search(ldap.NewSearchRequest(
+		a.options.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, int(a.options.Timeout.Seconds()), false,
+		fmt.Sprintf(a.options.GroupFilter, ldap.EscapeFilter(entry.DN)),
+		[]string{a.options.GroupNameAttribute}, nil,
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, group := range result.Entries {
+		name := group.GetAttributeValue(a.options.GroupNameAttribute)
+		if name != "" && !containsString(groups, name) {
+			groups = append(groups, name)
+		}
+	}
+	return groups, nil
+}
+
+// get returns an idle connection from the pool, or opens a new one. pooled reports whether the connection was taken from the pool.
+func (a *LDAPAuthenticator) get(ctx context.Context) (conn LDAPConn, pooled bool, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+
+	select {
+	case conn := <-a.pool:
+		return conn, true, nil
+	default:
+		conn, err := a.dial(ctx)
+		return conn, false, err
+	}
+}
+
+// put returns a connection to the pool, or closes it when the pool is full.
+func (a *LDAPAuthenticator) put(conn LDAPConn) {
+	select {
+	case a.pool <- conn:
+	default:
+		_ = conn.Close()
+	}
+}
+
+// Close closes the idle connections in the pool.
+func (a *LDAPAuthenticator) Close() error {
+	for {
+		select {
+		case conn := <-a.pool:
+			_ = conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// groupNameFromDN returns the value of the first RDN of a group DN, like developers for cn=developers,ou=groups,dc=example,dc=com.
+func groupNameFromDN(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) == 0 || len(parsed.RDNs[0].Attributes) == 0 {
+		return ""
+	}
+	return parsed.RDNs[0].Attributes[0].Value
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
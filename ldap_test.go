@@ -0,0 +1,348 @@
+package registry
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/stretchr/testify/assert"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeLDAPDirectory is an in-process stand-in for an LDAP server. It supports simple binds and searches with a single equality filter.
+type fakeLDAPDirectory struct {
+	mu        sync.Mutex
+	entries   []*ldap.Entry
+	passwords map[string]string
+	dials     int
+	closed    int
+	// hang makes binds on new connections block until the connection is closed.
+	hang bool
+}
+
+func newFakeLDAPDirectory() *fakeLDAPDirectory {
+	d := &fakeLDAPDirectory{passwords: map[string]string{
+		"cn=service,dc=example,dc=com": "service-secret",
+	}}
+	d.add("uid=jens,ou=people,dc=example,dc=com", "secret", map[string][]string{
+		"uid":      {"jens"},
+		"cn":       {"Jens"},
+		"memberOf": {"cn=developers,ou=groups,dc=example,dc=com"},
+	})
+	d.add("uid=dup,ou=people,dc=example,dc=com", "secret", map[string][]string{"uid": {"dup"}})
+	d.add("uid=dup,ou=other,dc=example,dc=com", "secret", map[string][]string{"uid": {"dup"}})
+	d.add("cn=admins,ou=groups,dc=example,dc=com", "", map[string][]string{
+		"cn":     {"admins"},
+		"member": {"uid=jens,ou=people,dc=example,dc=com"},
+	})
+	d.add("cn=developers,ou=groups,dc=example,dc=com", "", map[string][]string{
+		"cn":     {"developers"},
+		"member": {"uid=jens,ou=people,dc=example,dc=com"},
+	})
+	return d
+}
+
+func (d *fakeLDAPDirectory) add(dn, password string, attributes map[string][]string) {
+	d.entries = append(d.entries, ldap.NewEntry(dn, attributes))
+	if password != "" {
+		d.passwords[dn] = password
+	}
+}
+
+func (d *fakeLDAPDirectory) dial(ctx context.Context) (LDAPConn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dials++
+	return &fakeLDAPConn{directory: d, hang: d.hang, done: make(chan struct{})}, nil
+}
+
+type fakeLDAPConn struct {
+	directory *fakeLDAPDirectory
+	boundDN   string
+	hang      bool
+	// broken makes every request fail with a network error, like a connection closed by the server.
+	broken    bool
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+var fakeLDAPFilter = regexp.MustCompile(`^\(([a-zA-Z]+)=(.*)\)$`)
+var fakeLDAPEscape = regexp.MustCompile(`\\([0-9a-fA-F]{2})`)
+
+func (c *fakeLDAPConn) Bind(username, password string) error {
+	if c.hang {
+		<-c.done
+	}
+	if c.broken {
+		return ldap.NewError(ldap.ErrorNetwork, errors.New("connection closed"))
+	}
+	if expected, ok := c.directory.passwords[username]; !ok || password == "" || expected != password {
+		return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+	}
+	c.boundDN = username
+	return nil
+}
+
+func (c *fakeLDAPConn) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	if c.boundDN != "cn=service,dc=example,dc=com" {
+		return nil, ldap.NewError(ldap.LDAPResultInsufficientAccessRights, errors.New("insufficient access"))
+	}
+
+	match := fakeLDAPFilter.FindStringSubmatch(req.Filter)
+	if match == nil {
+		return nil, ldap.NewError(ldap.LDAPResultFilterError, fmt.Errorf("unsupported filter: %s", req.Filter))
+	}
+	value := fakeLDAPEscape.ReplaceAllStringFunc(match[2], func(s string) string {
+		b, _ := hex.DecodeString(s[1:])
+		return string(b)
+	})
+
+	result := &ldap.SearchResult{}
+	for _, entry := range c.directory.entries {
+		if !strings.HasSuffix(entry.DN, req.BaseDN) {
+			continue
+		}
+		for _, v := range entry.GetAttributeValues(match[1]) {
+			if strings.EqualFold(v, value) {
+				result.Entries = append(result.Entries, entry)
+				break
+			}
+		}
+	}
+
+	if req.SizeLimit > 0 && len(result.Entries) > req.SizeLimit {
+		result.Entries = result.Entries[:req.SizeLimit]
+		return result, ldap.NewError(ldap.LDAPResultSizeLimitExceeded, errors.New("size limit exceeded"))
+	}
+	return result, nil
+}
+
+func (c *fakeLDAPConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.directory.mu.Lock()
+		defer c.directory.mu.Unlock()
+		c.directory.closed++
+		c.broken = true
+		close(c.done)
+	})
+	return nil
+}
+
+func newTestLDAPAuthenticator(t *testing.T, directory *fakeLDAPDirectory, options LDAPOptions) *LDAPAuthenticator {
+	options.Dial = directory.dial
+	options.BindDN = "cn=service,dc=example,dc=com"
+	options.BindPassword = "service-secret"
+	options.BaseDN = "dc=example,dc=com"
+	a, err := NewLDAPAuthenticator(options)
+	assert.NoError(t, err)
+	return a
+}
+
+func TestLDAPAuthenticator_MemberOf(t *testing.T) {
+	directory := newFakeLDAPDirectory()
+	a := newTestLDAPAuthenticator(t, directory, LDAPOptions{GroupAttribute: "memberOf"})
+
+	identity, err := a.AuthenticateIdentity(context.Background(), "jens", "secret")
+	assert.NoError(t, err)
+	assert.Equal(t, "jens", identity.Subject)
+	assert.Equal(t, "Jens", identity.DisplayName)
+	assert.Equal(t, []string{"developers"}, identity.Groups)
+	assert.Equal(t, "uid=jens,ou=people,dc=example,dc=com", identity.Attribute("dn"))
+}
+
+func TestLDAPAuthenticator_CanonicalSubject(t *testing.T) {
+	directory := newFakeLDAPDirectory()
+	a := newTestLDAPAuthenticator(t, directory, LDAPOptions{GroupAttribute: "memberOf"})
+
+	// The directory matches the username case-insensitively, the subject is spelled like in the directory
+	identity, err := a.AuthenticateIdentity(context.Background(), "JENS", "secret")
+	assert.NoError(t, err)
+	assert.Equal(t, "jens", identity.Subject)
+
+	identity, err = a.LookupIdentity(context.Background(), "Jens")
+	assert.NoError(t, err)
+	assert.Equal(t, "jens", identity.Subject)
+
+	// With another user filter, the subject is taken from the username attribute
+	a = newTestLDAPAuthenticator(t, directory, LDAPOptions{UserFilter: "(cn=%s)", UsernameAttribute: "uid"})
+	identity, err = a.AuthenticateIdentity(context.Background(), "jens", "secret")
+	assert.NoError(t, err)
+	assert.Equal(t, "jens", identity.Subject)
+
+	// Entries without the username attribute can not be used
+	a = newTestLDAPAuthenticator(t, directory, LDAPOptions{UsernameAttribute: "mail"})
+	_, err = a.AuthenticateIdentity(context.Background(), "jens", "secret")
+	assert.True(t, errors.Is(err, ErrUnknown))
+}
+
+func TestLDAPAuthenticator_GroupSearch(t *testing.T) {
+	directory := newFakeLDAPDirectory()
+	a := newTestLDAPAuthenticator(t, directory, LDAPOptions{
+		GroupAttribute: "memberOf",
+		GroupFilter:    "(member=%s)",
+		GroupBaseDN:    "ou=groups,dc=example,dc=com",
+	})
+
+	identity, err := a.AuthenticateIdentity(context.Background(), "jens", "secret")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"developers", "admins"}, identity.Groups)
+}
+
+func TestLDAPAuthenticator_LookupIdentity(t *testing.T) {
+	directory := newFakeLDAPDirectory()
+	a := newTestLDAPAuthenticator(t, directory, LDAPOptions{GroupAttribute: "memberOf"})
+
+	identity, err := a.LookupIdentity(context.Background(), "jens")
+	assert.NoError(t, err)
+	assert.Equal(t, "Jens", identity.DisplayName)
+	assert.Equal(t, []string{"developers"}, identity.Groups)
+
+	for _, subject := range []string{"unknown", "dup", ""} {
+		_, err = a.LookupIdentity(context.Background(), subject)
+		assert.True(t, errors.Is(err, ErrUnknownUser), subject)
+	}
+}
+
+func TestLDAPAuthenticator_InvalidCredentials(t *testing.T) {
+	directory := newFakeLDAPDirectory()
+	a := newTestLDAPAuthenticator(t, directory, LDAPOptions{})
+
+	tests := []struct {
+		name string
+		user string
+		pass string
+	}{
+		{"TestWrongPassword", "jens", "wrong"},
+		{"TestEmptyPassword", "jens", ""},
+		{"TestUnknownUser", "unknown", "secret"},
+		{"TestAmbiguousUser", "dup", "secret"},
+		{"TestFilterInjection", "*", "secret"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := a.AuthenticateIdentity(context.Background(), tt.user, tt.pass)
+			assert.True(t, errors.Is(err, ErrInvalidCredentials), "error = %v", err)
+		})
+	}
+
+	_, err := a.AuthenticateIdentity(context.Background(), "unknown", "secret")
+	assert.True(t, errors.Is(err, ErrUnknownUser))
+	_, err = a.AuthenticateIdentity(context.Background(), "dup", "secret")
+	assert.False(t, errors.Is(err, ErrUnknownUser))
+}
+
+func TestLDAPAuthenticator_Pool(t *testing.T) {
+	directory := newFakeLDAPDirectory()
+	a := newTestLDAPAuthenticator(t, directory, LDAPOptions{PoolSize: 1})
+
+	for i := 0; i < 3; i++ {
+		_, err := a.AuthenticateIdentity(context.Background(), "jens", "secret")
+		assert.NoError(t, err)
+	}
+	_, err := a.AuthenticateIdentity(context.Background(), "jens", "wrong")
+	assert.Error(t, err)
+
+	// The connection is reused, also after a failed login
+	assert.Equal(t, 1, directory.dials)
+
+	// A connection in an unknown state is closed instead of reused
+	a.options.BindPassword = "wrong"
+	_, err = a.AuthenticateIdentity(context.Background(), "jens", "secret")
+	assert.True(t, errors.Is(err, ErrUnknown))
+	assert.Equal(t, 1, directory.closed)
+
+	a.options.BindPassword = "service-secret"
+	_, err = a.AuthenticateIdentity(context.Background(), "jens", "secret")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, directory.dials)
+
+	assert.NoError(t, a.Close())
+	assert.Equal(t, 2, directory.closed)
+}
+
+func TestLDAPAuthenticator_RetriesBrokenPooledConnection(t *testing.T) {
+	directory := newFakeLDAPDirectory()
+	a := newTestLDAPAuthenticator(t, directory, LDAPOptions{PoolSize: 1})
+
+	_, err := a.AuthenticateIdentity(context.Background(), "jens", "secret")
+	assert.NoError(t, err)
+
+	// The server closed the idle connection
+	conn := <-a.pool
+	conn.(*fakeLDAPConn).broken = true
+	a.pool <- conn
+
+	_, err = a.AuthenticateIdentity(context.Background(), "jens", "secret")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, directory.dials)
+	assert.Equal(t, 1, directory.closed)
+
+	// A new connection is not retried
+	a.options.Dial = func(ctx context.Context) (LDAPConn, error) {
+		conn, err := directory.dial(ctx)
+		conn.(*fakeLDAPConn).broken = true
+		return conn, err
+	}
+	<-a.pool
+	_, err = a.AuthenticateIdentity(context.Background(), "jens", "secret")
+	assert.True(t, errors.Is(err, ErrUnknown))
+	assert.Equal(t, 3, directory.dials)
+}
+
+func TestLDAPAuthenticator_ContextDeadline(t *testing.T) {
+	directory := newFakeLDAPDirectory()
+	directory.hang = true
+	a := newTestLDAPAuthenticator(t, directory, LDAPOptions{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := a.AuthenticateIdentity(ctx, "jens", "secret")
+	assert.True(t, errors.Is(err, ErrUnknown))
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Equal(t, 1, directory.closed)
+	assert.Len(t, a.pool, 0)
+
+	_, err = a.LookupIdentity(ctx, "jens")
+	assert.True(t, errors.Is(err, ErrUnknown))
+	assert.Equal(t, 1, directory.dials)
+}
+
+func TestNewLDAPAuthenticatorInvalidOptions(t *testing.T) {
+	valid := LDAPOptions{
+		URL:    "ldaps://ldap.example.com",
+		BindDN: "cn=service,dc=example,dc=com",
+		BaseDN: "dc=example,dc=com",
+	}
+
+	a, err := NewLDAPAuthenticator(valid)
+	assert.NoError(t, err)
+	assert.Equal(t, "ldap.example.com", a.options.TLSConfig.ServerName)
+
+	tests := []struct {
+		name   string
+		modify func(o *LDAPOptions)
+	}{
+		{"TestNoURL", func(o *LDAPOptions) { o.URL = "" }},
+		{"TestNoBindDN", func(o *LDAPOptions) { o.BindDN = "" }},
+		{"TestNoBaseDN", func(o *LDAPOptions) { o.BaseDN = "" }},
+		{"TestInvalidUserFilter", func(o *LDAPOptions) { o.UserFilter = "(uid=jens)" }},
+		{"TestInvalidGroupFilter", func(o *LDAPOptions) { o.GroupFilter = "(member=%s)(member=%s)" }},
+		{"TestNoUsernameAttribute", func(o *LDAPOptions) { o.UserFilter = "(&(objectClass=person)(uid=%s))" }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := valid
+			tt.modify(&options)
+			_, err := NewLDAPAuthenticator(options)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,265 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// LockoutState is the failed authentication attempts recorded for an account or IP.
+type LockoutState struct {
+	Failures    int
+	LastFailure time.Time
+}
+
+// LockoutPolicy is when a key is locked, and for how long.
+type LockoutPolicy struct {
+	// MaxFailures is the number of failed attempts after which the key is locked.
+	MaxFailures int
+	// LockoutDuration is how long the key is locked when it reaches MaxFailures. Every further failure doubles it, up to MaxLockoutDuration.
+	LockoutDuration    time.Duration
+	MaxLockoutDuration time.Duration
+	// ResetAfter is how long after the last failure the failures are forgotten.
+	ResetAfter time.Duration
+}
+
+// LockedFor returns how long a key with the given state is still locked at the given time, zero means the key is not locked.
+func (p LockoutPolicy) LockedFor(state LockoutState, now time.Time) time.Duration {
+	if state.Failures < p.MaxFailures || now.Sub(state.LastFailure) >= p.ResetAfter {
+		return 0
+	}
+
+	lockedUntil := state.LastFailure.Add(p.lockoutDuration(state.Failures - p.MaxFailures))
+	if !now.Before(lockedUntil) {
+		return 0
+	}
+	return lockedUntil.Sub(now)
+}
+
+// lockoutDuration returns the lockout duration after the given number of failures beyond the maximum, doubling for every failure.
+func (p LockoutPolicy) lockoutDuration(extraFailures int) time.Duration {
+	duration := p.LockoutDuration
+	for i := 0; i < extraFailures && duration < p.MaxLockoutDuration; i++ {
+		duration *= 2
+	}
+	if duration > p.MaxLockoutDuration {
+		duration = p.MaxLockoutDuration
+	}
+	return duration
+}
+
+// LockoutStore is an interface for storing the failed authentication attempts of the LockoutAuthenticator. Keys are prefixed with account: or ip:.
+type LockoutStore interface {
+	// Attempt checks if the key is locked at the given time according to the policy, and records a failed attempt for it at that time if it is not. Both happen atomically, so concurrent attempts can not all pass the check before any of their failures is recorded. It returns the state of the key before the attempt, in which failures older than the ResetAfter of the policy are forgotten.
+	Attempt(ctx context.Context, key string, now time.Time, policy LockoutPolicy) (LockoutState, error)
+	// Forgive takes back a failed attempt recorded by Attempt at attemptedAt, for an attempt that did not fail because of wrong credentials. lastFailure is the last failure of the state returned by Attempt, it is restored if no failure was recorded since.
+	Forgive(ctx context.Context, key string, attemptedAt, lastFailure time.Time) error
+	// Reset forgets the failures of the key.
+	Reset(ctx context.Context, key string) error
+}
+
+// InMemoryLockoutStore is a LockoutStore that keeps the failures in memory, which is enough for a single instance of the token server.
+type InMemoryLockoutStore struct {
+	mu        sync.Mutex
+	states    map[string]LockoutState
+	lastSweep time.Time
+}
+
+// NewInMemoryLockoutStore creates a new InMemoryLockoutStore.
+func NewInMemoryLockoutStore() *InMemoryLockoutStore {
+	return &InMemoryLockoutStore{
+		states: make(map[string]LockoutState),
+	}
+}
+
+func (s *InMemoryLockoutStore) Attempt(ctx context.Context, key string, now time.Time, policy LockoutPolicy) (LockoutState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Forgotten failures are removed once in a while, so failures for many different accounts and IPs do not pile up.
+	if now.Sub(s.lastSweep) >= policy.ResetAfter {
+		for k, state := range s.states {
+			if now.Sub(state.LastFailure) >= policy.ResetAfter {
+				delete(s.states, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	state := s.states[key]
+	if now.Sub(state.LastFailure) >= policy.ResetAfter {
+		state = LockoutState{}
+	}
+	if policy.LockedFor(state, now) > 0 {
+		return state, nil
+	}
+
+	s.states[key] = LockoutState{Failures: state.Failures + 1, LastFailure: now}
+	return state, nil
+}
+
+func (s *InMemoryLockoutStore) Forgive(ctx context.Context, key string, attemptedAt, lastFailure time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, ok := s.states[key]
+	if !ok {
+		return nil
+	}
+	if state.Failures <= 1 {
+		delete(s.states, key)
+		return nil
+	}
+
+	state.Failures--
+	if state.LastFailure.Equal(attemptedAt) {
+		state.LastFailure = lastFailure
+	}
+	s.states[key] = state
+	return nil
+}
+
+func (s *InMemoryLockoutStore) Reset(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.states, key)
+	return nil
+}
+
+// LockoutOptions contains the options for a LockoutAuthenticator.
+type LockoutOptions struct {
+	// MaxAccountFailures is the number of failed attempts after which an account is locked. Defaults to 5.
+	MaxAccountFailures int
+	// MaxIPFailures is the number of failed attempts after which an IP is locked, for any account. Defaults to 20.
+	MaxIPFailures int
+	// LockoutDuration is how long an account or IP is locked when it reaches its maximum failures. Every further failure doubles it, up to MaxLockoutDuration. Defaults to 1 minute.
+	LockoutDuration time.Duration
+	// MaxLockoutDuration is the longest an account or IP is locked. Defaults to 15 minutes.
+	MaxLockoutDuration time.Duration
+	// ResetAfter is how long after the last failure the failures are forgotten. Defaults to 1 hour, and is at least MaxLockoutDuration.
+	ResetAfter time.Duration
+	// Store stores the failures. Defaults to an InMemoryLockoutStore.
+	Store LockoutStore
+}
+
+// LockoutAuthenticator is an authenticator protecting another authenticator against brute-force attacks. It counts the failed attempts per account and per IP, and locks an account or IP for an exponentially growing time once it has too many failures. Locked requests are rejected with ErrLockedOut, without asking the wrapped authenticator. A successful authentication forgets the failures of the account, but not those of the IP.
+//
+// Every attempt is counted as a failure before the wrapped authenticator is asked, and taken back when it does not fail because of wrong credentials, so concurrent attempts can not exceed the maximum failures.
+//
+// Anyone can lock an account by failing to log in as it, which is why the lockout is temporary.
+type LockoutAuthenticator struct {
+	authenticator IdentityAuthenticator
+	options       LockoutOptions
+	account       LockoutPolicy
+	ip            LockoutPolicy
+	now           func() time.Time
+}
+
+// NewLockoutAuthenticator creates a new LockoutAuthenticator for the given authenticator. The IP is read from the RequestMetadata of the context, so only the account is limited when there is none.
+func NewLockoutAuthenticator(authenticator IdentityAuthenticator, options LockoutOptions) *LockoutAuthenticator {
+	if options.MaxAccountFailures <= 0 {
+		options.MaxAccountFailures = 5
+	}
+	if options.MaxIPFailures <= 0 {
+		options.MaxIPFailures = 20
+	}
+	if options.LockoutDuration <= 0 {
+		options.LockoutDuration = time.Minute
+	}
+	if options.MaxLockoutDuration <= 0 {
+		options.MaxLockoutDuration = 15 * time.Minute
+	}
+	if options.MaxLockoutDuration < options.LockoutDuration {
+		options.MaxLockoutDuration = options.LockoutDuration
+	}
+	if options.ResetAfter <= 0 {
+		options.ResetAfter = time.Hour
+	}
+	if options.ResetAfter < options.MaxLockoutDuration {
+		options.ResetAfter = options.MaxLockoutDuration
+	}
+	if options.Store == nil {
+		options.Store = NewInMemoryLockoutStore()
+	}
+
+	account := LockoutPolicy{
+		MaxFailures:        options.MaxAccountFailures,
+		LockoutDuration:    options.LockoutDuration,
+		MaxLockoutDuration: options.MaxLockoutDuration,
+		ResetAfter:         options.ResetAfter,
+	}
+	ip := account
+	ip.MaxFailures = options.MaxIPFailures
+
+	return &LockoutAuthenticator{
+		authenticator: authenticator,
+		options:       options,
+		account:       account,
+		ip:            ip,
+		now:           time.Now,
+	}
+}
+
+// AuthenticateIdentity rejects the request with ErrLockedOut if the account or IP is locked, and authenticates with the wrapped authenticator otherwise. Failures because of wrong credentials are counted, other errors like ErrUnknown are not.
+func (a *LockoutAuthenticator) AuthenticateIdentity(ctx context.Context, user string, pass string) (*Identity, error) {
+	now := a.now()
+	accountKey := "account:" + user
+	ipKey := ""
+	if md, ok := RequestMetadataFromContext(ctx); ok && md.IP != "" {
+		ipKey = "ip:" + md.IP
+	}
+
+	account, err := a.attempt(ctx, accountKey, a.account, now)
+	if err != nil {
+		return nil, err
+	}
+
+	var ip LockoutState
+	if ipKey != "" {
+		if ip, err = a.attempt(ctx, ipKey, a.ip, now); err != nil {
+			// Forgiving is best effort, like counting below.
+			_ = a.options.Store.Forgive(ctx, accountKey, now, account.LastFailure)
+			return nil, err
+		}
+	}
+
+	identity, err := a.authenticator.AuthenticateIdentity(ctx, user, pass)
+	if err == nil {
+		_ = a.options.Store.Reset(ctx, accountKey)
+		if ipKey != "" {
+			_ = a.options.Store.Forgive(ctx, ipKey, now, ip.LastFailure)
+		}
+		return identity, nil
+	}
+
+	// Errors that are not an *Error are counted as well, the TokenHandler reports them as ErrInvalidCredentials.
+	var e *Error
+	if errors.As(err, &e) && !errors.Is(err, ErrInvalidCredentials) {
+		_ = a.options.Store.Forgive(ctx, accountKey, now, account.LastFailure)
+		if ipKey != "" {
+			_ = a.options.Store.Forgive(ctx, ipKey, now, ip.LastFailure)
+		}
+	}
+	return nil, err
+}
+
+// LookupIdentity looks up the current identity of the user with the wrapped authenticator, see IdentityLookup. Lookups do not check credentials, so they are neither counted nor locked.
+func (a *LockoutAuthenticator) LookupIdentity(ctx context.Context, subject string) (*Identity, error) {
+	return lookupIdentity(ctx, a.authenticator, subject)
+}
+
+// attempt records an attempt for the key, and returns the state of the key before it. If the key is locked, ErrLockedOut is returned and the attempt is not recorded.
+func (a *LockoutAuthenticator) attempt(ctx context.Context, key string, policy LockoutPolicy, now time.Time) (LockoutState, error) {
+	state, err := a.options.Store.Attempt(ctx, key, now, policy)
+	if err != nil {
+		// Without the state, the attempt can not be checked, so it is rejected instead of allowing unlimited attempts.
+		return LockoutState{}, ErrUnknown.WithCause(fmt.Errorf("lockout: %w", err))
+	}
+
+	if lockedFor := policy.LockedFor(state, now); lockedFor > 0 {
+		return LockoutState{}, ErrLockedOut.WithRetryAfter(lockedFor)
+	}
+	return state, nil
+}
@@ -0,0 +1,177 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestLockoutAuthenticator(backend IdentityAuthenticator, options LockoutOptions) (*LockoutAuthenticator, *time.Time) {
+	a := NewLockoutAuthenticator(backend, options)
+	now := time.Now()
+	a.now = func() time.Time { return now }
+	return a, &now
+}
+
+func contextWithIP(ip string) context.Context {
+	return WithRequestMetadata(context.Background(), &RequestMetadata{IP: ip})
+}
+
+func TestLockoutAuthenticator_Account(t *testing.T) {
+	backend := &chainTestBackend{user: "jens", pass: "secret"}
+	a, now := newTestLockoutAuthenticator(backend, LockoutOptions{MaxAccountFailures: 3, LockoutDuration: time.Minute, MaxLockoutDuration: 4 * time.Minute})
+	ctx := contextWithIP("192.0.2.1")
+
+	for i := 0; i < 3; i++ {
+		_, err := a.AuthenticateIdentity(ctx, "jens", "wrong")
+		assert.True(t, errors.Is(err, ErrInvalidCredentials))
+	}
+
+	// The account is locked, also for the right password and from another IP
+	_, err := a.AuthenticateIdentity(contextWithIP("192.0.2.2"), "jens", "secret")
+	var e *Error
+	assert.True(t, errors.As(err, &e))
+	assert.True(t, errors.Is(err, ErrLockedOut))
+	assert.Equal(t, time.Minute, e.RetryAfter)
+	assert.Equal(t, 3, backend.calls)
+
+	// Every failure after the lock expires doubles the lockout, up to the maximum
+	for _, want := range []time.Duration{2 * time.Minute, 4 * time.Minute, 4 * time.Minute} {
+		*now = now.Add(e.RetryAfter)
+		_, err = a.AuthenticateIdentity(ctx, "jens", "wrong")
+		assert.True(t, errors.Is(err, ErrInvalidCredentials))
+
+		_, err = a.AuthenticateIdentity(ctx, "jens", "secret")
+		assert.True(t, errors.As(err, &e))
+		assert.Equal(t, want, e.RetryAfter)
+	}
+
+	// A successful authentication forgets the failures
+	*now = now.Add(e.RetryAfter)
+	_, err = a.AuthenticateIdentity(ctx, "jens", "secret")
+	assert.NoError(t, err)
+	_, err = a.AuthenticateIdentity(ctx, "jens", "wrong")
+	assert.True(t, errors.Is(err, ErrInvalidCredentials))
+}
+
+func TestLockoutAuthenticator_IP(t *testing.T) {
+	backend := &chainTestBackend{user: "jens", pass: "secret"}
+	a, now := newTestLockoutAuthenticator(backend, LockoutOptions{MaxAccountFailures: 100, MaxIPFailures: 3})
+
+	// Guessing different accounts from one IP locks the IP
+	for _, user := range []string{"alice", "bob", "carol"} {
+		_, err := a.AuthenticateIdentity(contextWithIP("192.0.2.1"), user, "secret")
+		assert.True(t, errors.Is(err, ErrUnknownUser))
+	}
+
+	_, err := a.AuthenticateIdentity(contextWithIP("192.0.2.1"), "jens", "secret")
+	assert.True(t, errors.Is(err, ErrLockedOut))
+
+	_, err = a.AuthenticateIdentity(contextWithIP("192.0.2.2"), "jens", "secret")
+	assert.NoError(t, err)
+
+	// Failures are forgotten after ResetAfter
+	*now = now.Add(time.Hour)
+	_, err = a.AuthenticateIdentity(contextWithIP("192.0.2.1"), "jens", "secret")
+	assert.NoError(t, err)
+}
+
+func TestLockoutAuthenticator_BackendFailuresAreNotCounted(t *testing.T) {
+	backend := &chainTestBackend{user: "jens", pass: "secret", err: ErrUnknown}
+	a, _ := newTestLockoutAuthenticator(backend, LockoutOptions{MaxAccountFailures: 1})
+
+	for i := 0; i < 3; i++ {
+		_, err := a.AuthenticateIdentity(context.Background(), "jens", "secret")
+		assert.True(t, errors.Is(err, ErrUnknown))
+	}
+
+	backend.err = nil
+	_, err := a.AuthenticateIdentity(context.Background(), "jens", "secret")
+	assert.NoError(t, err)
+}
+
+// blockingBackend fails every authentication once release is closed.
+type blockingBackend struct {
+	calls   atomic.Int32
+	release chan struct{}
+}
+
+func (b *blockingBackend) AuthenticateIdentity(ctx context.Context, user string, pass string) (*Identity, error) {
+	b.calls.Add(1)
+	<-b.release
+	return nil, ErrInvalidCredentials
+}
+
+func TestLockoutAuthenticator_ConcurrentAttempts(t *testing.T) {
+	backend := &blockingBackend{release: make(chan struct{})}
+	a, _ := newTestLockoutAuthenticator(backend, LockoutOptions{MaxAccountFailures: 3})
+
+	// Attempts in flight count against the maximum, so concurrent guesses can not exceed it
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			_, err := a.AuthenticateIdentity(context.Background(), "jens", "wrong")
+			errs <- err
+		}()
+	}
+
+	var locked int
+	for i := 0; i < 7; i++ {
+		if errors.Is(<-errs, ErrLockedOut) {
+			locked++
+		}
+	}
+	close(backend.release)
+	for i := 0; i < 3; i++ {
+		assert.True(t, errors.Is(<-errs, ErrInvalidCredentials))
+	}
+	assert.Equal(t, 7, locked)
+	assert.Equal(t, int32(3), backend.calls.Load())
+}
+
+func TestInMemoryLockoutStore_Forgive(t *testing.T) {
+	ctx := context.Background()
+	s := NewInMemoryLockoutStore()
+	policy := LockoutPolicy{MaxFailures: 5, LockoutDuration: time.Minute, MaxLockoutDuration: time.Minute, ResetAfter: time.Hour}
+	first := time.Now()
+	second := first.Add(time.Minute)
+
+	_, err := s.Attempt(ctx, "ip:192.0.2.1", first, policy)
+	assert.NoError(t, err)
+	state, err := s.Attempt(ctx, "ip:192.0.2.1", second, policy)
+	assert.NoError(t, err)
+	assert.Equal(t, LockoutState{Failures: 1, LastFailure: first}, state)
+
+	// A forgiven attempt does not keep the earlier failures from being forgotten
+	assert.NoError(t, s.Forgive(ctx, "ip:192.0.2.1", second, state.LastFailure))
+	assert.Equal(t, LockoutState{Failures: 1, LastFailure: first}, s.states["ip:192.0.2.1"])
+
+	assert.NoError(t, s.Forgive(ctx, "ip:192.0.2.1", first, time.Time{}))
+	assert.NotContains(t, s.states, "ip:192.0.2.1")
+}
+
+func TestTokenHandler_LockedOut(t *testing.T) {
+	h := newTestTokenHandler(t, NewDummyAuthorizer())
+	h.authenticator = NewLockoutAuthenticator(h.authenticator, LockoutOptions{MaxAccountFailures: 1})
+
+	codes := []int{http.StatusUnauthorized, http.StatusTooManyRequests}
+	for _, code := range codes {
+		req := httptest.NewRequest(http.MethodGet, "/?account=jens&service=registry&client_id=docker", nil)
+		req.SetBasicAuth("jens", "wrong")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		assert.Equal(t, code, rec.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/?account=jens&service=registry&client_id=docker", nil)
+	req.SetBasicAuth("jens", "secret")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "60", rec.Header().Get("Retry-After"))
+}
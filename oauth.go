@@ -0,0 +1,106 @@
+package registry
+
+import (
+	"net/http"
+	"strings"
+)
+
+// GrantType is the OAuth2 grant type of a token request.
+type GrantType string
+
+const (
+	GrantTypePassword     GrantType = "password"
+	GrantTypeRefreshToken GrantType = "refresh_token"
+)
+
+// ParseGrantType parses a string into a GrantType. If the string is not a supported grant type, an error is returned.
+func ParseGrantType(grantType string) (GrantType, error) {
+	switch grantType {
+	case "password":
+		return GrantTypePassword, nil
+	case "refresh_token":
+		return GrantTypeRefreshToken, nil
+	case "":
+		return "", ErrInvalidRequest.WithDetail("grant_type is required")
+	}
+
+	return "", ErrUnsupportedGrantType.WithDetail(grantType)
+}
+
+// String returns the string representation of a GrantType.
+func (g GrantType) String() string {
+	return string(g)
+}
+
+// TokenRequest is an OAuth2 token request as posted to the token endpoint. It holds the credentials of the request next to the AuthorizationRequest, so the credentials are never passed on to an Authorizer.
+type TokenRequest struct {
+	GrantType GrantType
+	// Username and Password are set for the password grant type.
+	Username string
+	Password string
+	// RefreshToken is set for the refresh_token grant type.
+	RefreshToken string
+	// Request is the AuthorizationRequest of the token request. For the refresh_token grant type the account is empty, it has to be taken from the validated refresh token.
+	Request *AuthorizationRequest
+}
+
+// TokenRequestFromRequest parses the form encoded body of an OAuth2 token request, as described in https://distribution.github.io/distribution/spec/auth/oauth/.
+func TokenRequestFromRequest(r *http.Request) (*TokenRequest, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, ErrInvalidRequest.WithDetail(err.Error())
+	}
+	form := r.PostForm
+
+	grantType, err := ParseGrantType(form.Get("grant_type"))
+	if err != nil {
+		return nil, err
+	}
+
+	tokenReq := &TokenRequest{
+		GrantType: grantType,
+		Request:   &AuthorizationRequest{},
+	}
+	req := tokenReq.Request
+
+	switch grantType {
+	case GrantTypePassword:
+		if tokenReq.Username = form.Get("username"); tokenReq.Username == "" {
+			return nil, ErrInvalidRequest.WithDetail("username is required")
+		}
+		if tokenReq.Password = form.Get("password"); tokenReq.Password == "" {
+			return nil, ErrInvalidRequest.WithDetail("password is required")
+		}
+		req.Account = tokenReq.Username
+	case GrantTypeRefreshToken:
+		if tokenReq.RefreshToken = form.Get("refresh_token"); tokenReq.RefreshToken == "" {
+			return nil, ErrInvalidRequest.WithDetail("refresh_token is required")
+		}
+	}
+
+	if service := form.Get("service"); service != "" {
+		req.Service = service
+	} else {
+		return nil, ErrInvalidRequest.WithDetail("service is required")
+	}
+
+	if clientId := form.Get("client_id"); clientId != "" {
+		req.ClientId = clientId
+	} else {
+		return nil, ErrInvalidRequest.WithDetail("client_id is required")
+	}
+
+	req.AccessType = parseAccessType(form.Get("access_type"))
+
+	// The scope parameter is a space separated list of scopes, it may also be given multiple times.
+	var rawScopes []string
+	for _, scope := range form["scope"] {
+		rawScopes = append(rawScopes, strings.Fields(scope)...)
+	}
+	scopes, err := ParseScopes(rawScopes)
+	if err != nil {
+		return nil, err
+	}
+	req.Scopes = scopes
+
+	return tokenReq, nil
+}
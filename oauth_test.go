@@ -0,0 +1,123 @@
+package registry
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func newFormRequest(form url.Values) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req
+}
+
+func TestParseGrantType(t *testing.T) {
+	tests := []struct {
+		name      string
+		grantType string
+		want      GrantType
+		wantErr   bool
+	}{
+		{"TestPassword", "password", GrantTypePassword, false},
+		{"TestRefreshToken", "refresh_token", GrantTypeRefreshToken, false},
+		{"TestAuthorizationCode", "authorization_code", "", true},
+		{"TestEmpty", "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseGrantType(tt.grantType)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseGrantType() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("ParseGrantType() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenRequestFromRequest_Password(t *testing.T) {
+	req := newFormRequest(url.Values{
+		"grant_type":  {"password"},
+		"username":    {"jens"},
+		"password":    {"secret"},
+		"service":     {"registry"},
+		"client_id":   {"docker"},
+		"access_type": {"offline"},
+		"scope":       {"repository:foo/bar:pull repository:foo/baz:pull,push"},
+	})
+
+	got, err := TokenRequestFromRequest(req)
+	assert.NoError(t, err)
+	assert.Equal(t, GrantTypePassword, got.GrantType)
+	assert.Equal(t, "jens", got.Username)
+	assert.Equal(t, "secret", got.Password)
+	assert.Equal(t, "jens", got.Request.Account)
+	assert.Equal(t, "registry", got.Request.Service)
+	assert.Equal(t, "docker", got.Request.ClientId)
+	assert.Equal(t, AccessTypeOffline, got.Request.AccessType)
+	assert.Len(t, got.Request.Scopes, 2)
+	assert.Equal(t, "repository:foo/bar:pull", got.Request.Scopes[0].String())
+	assert.Equal(t, "repository:foo/baz:pull,push", got.Request.Scopes[1].String())
+}
+
+func TestTokenRequestFromRequest_RefreshToken(t *testing.T) {
+	req := newFormRequest(url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {"abc"},
+		"service":       {"registry"},
+		"client_id":     {"docker"},
+	})
+
+	got, err := TokenRequestFromRequest(req)
+	assert.NoError(t, err)
+	assert.Equal(t, GrantTypeRefreshToken, got.GrantType)
+	assert.Equal(t, "abc", got.RefreshToken)
+	assert.Empty(t, got.Request.Account)
+	assert.Equal(t, AccessTypeOnline, got.Request.AccessType)
+	assert.Empty(t, got.Request.Scopes)
+}
+
+func TestTokenRequestFromRequest_Invalid(t *testing.T) {
+	valid := url.Values{
+		"grant_type": {"password"},
+		"username":   {"jens"},
+		"password":   {"secret"},
+		"service":    {"registry"},
+		"client_id":  {"docker"},
+	}
+
+	tests := []struct {
+		name  string
+		key   string
+		value string
+	}{
+		{"TestNoGrantType", "grant_type", ""},
+		{"TestUnsupportedGrantType", "grant_type", "client_credentials"},
+		{"TestNoUsername", "username", ""},
+		{"TestNoPassword", "password", ""},
+		{"TestNoService", "service", ""},
+		{"TestNoClientId", "client_id", ""},
+		{"TestInvalidScope", "scope", "repository:foo/bar"},
+		{"TestNoRefreshToken", "grant_type", "refresh_token"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{}
+			for k, v := range valid {
+				form[k] = v
+			}
+			form.Set(tt.key, tt.value)
+
+			_, err := TokenRequestFromRequest(newFormRequest(form))
+			assert.Error(t, err)
+		})
+	}
+}
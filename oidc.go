@@ -0,0 +1,163 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// OIDCIssuer is an issuer of OIDC ID tokens trusted by the OIDCAuthenticator, like GitHub Actions (https://token.actions.githubusercontent.com) or GitLab CI (https://gitlab.com).
+type OIDCIssuer struct {
+	// Issuer is the issuer URL, which must equal the iss claim of its tokens.
+	Issuer string
+	// JWKSURL is the URL of the JSON Web Key Set of the issuer. Defaults to the jwks_uri of the OpenID configuration of the issuer.
+	JWKSURL string
+	// JWKSFile is a local JSON Web Key Set file, used instead of fetching the keys of the issuer.
+	JWKSFile string
+	// Audiences are the accepted values of the aud claim, at least one is required.
+	Audiences []string
+	// SubjectClaim is the claim used as subject of the identity, which the username must equal. Defaults to sub.
+	SubjectClaim string
+	// GroupsClaim is the claim holding the groups of the identity, as string or array of strings. If empty, the identity has no groups.
+	GroupsClaim string
+	// Claims are the claims added to the attributes of the identity, like repository, ref and workflow, so authorizers can use them.
+	Claims []string
+	// RequiredClaims are claims that must have the given value, like repository_owner to only accept tokens of your own organization.
+	RequiredClaims map[string]string
+}
+
+// OIDCOptions contains the options for an OIDCAuthenticator.
+type OIDCOptions struct {
+	Issuers []OIDCIssuer
+	// HTTPClient is used to fetch the OpenID configuration and keys. Defaults to a client with a 10 second timeout.
+	HTTPClient *http.Client
+	// JWKSCacheTTL is how long the keys of an issuer are cached. Defaults to 1 hour.
+	JWKSCacheTTL time.Duration
+	// ClockSkew is the clock difference with the issuers that is allowed when checking the expiry of tokens. Defaults to 1 minute.
+	ClockSkew time.Duration
+}
+
+// OIDCAuthenticator is an authenticator accepting a JWT, like an OIDC ID token of a CI job, as password. The token must be signed with a key of one of the trusted issuers, must not be expired and must be for one of the audiences of the issuer. The claims of the token are mapped into the identity, so CI jobs can be authorized on their repository, ref or workflow without static secrets.
+type OIDCAuthenticator struct {
+	options OIDCOptions
+	issuers map[string]*oidcIssuer
+	now     func() time.Time
+}
+
+type oidcIssuer struct {
+	OIDCIssuer
+	keys *jwksKeySet
+}
+
+// NewOIDCAuthenticator creates a new OIDCAuthenticator with the given options. No keys are fetched until the first authentication.
+func NewOIDCAuthenticator(options OIDCOptions) (*OIDCAuthenticator, error) {
+	if options.HTTPClient == nil {
+		options.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	if options.JWKSCacheTTL <= 0 {
+		options.JWKSCacheTTL = time.Hour
+	}
+	if options.ClockSkew == 0 {
+		options.ClockSkew = time.Minute
+	}
+
+	if len(options.Issuers) == 0 {
+		return nil, fmt.Errorf("at least one oidc issuer is required")
+	}
+
+	a := &OIDCAuthenticator{
+		options: options,
+		issuers: make(map[string]*oidcIssuer, len(options.Issuers)),
+		now:     time.Now,
+	}
+	for _, issuer := range options.Issuers {
+		if issuer.Issuer == "" {
+			return nil, fmt.Errorf("oidc issuer has no issuer url")
+		}
+		if _, ok := a.issuers[issuer.Issuer]; ok {
+			return nil, fmt.Errorf("oidc issuer %s is declared more than once", issuer.Issuer)
+		}
+		if len(issuer.Audiences) == 0 {
+			return nil, fmt.Errorf("oidc issuer %s has no audiences", issuer.Issuer)
+		}
+		if issuer.SubjectClaim == "" {
+			issuer.SubjectClaim = "sub"
+		}
+
+		issuerURL := issuer.Issuer
+		a.issuers[issuer.Issuer] = &oidcIssuer{
+			OIDCIssuer: issuer,
+			keys: &jwksKeySet{
+				url:  issuer.JWKSURL,
+				file: issuer.JWKSFile,
+				discover: func(ctx context.Context) (string, error) {
+					return discoverJWKSURL(ctx, options.HTTPClient, issuerURL)
+				},
+				client:     options.HTTPClient,
+				ttl:        options.JWKSCacheTTL,
+				minRefresh: time.Minute,
+				now:        time.Now,
+			},
+		}
+	}
+	return a, nil
+}
+
+// AuthenticateIdentity authenticates the user with the JWT passed as password. Passwords that are not a JWT, and tokens of issuers that are not trusted, are rejected with ErrUnknownUser, so the authenticator can be chained with password authenticators. The identity has the iss claim and the configured claims as attributes.
+func (a *OIDCAuthenticator) AuthenticateIdentity(ctx context.Context, user string, pass string) (*Identity, error) {
+	if !looksLikeJWT(pass) {
+		return nil, ErrUnknownUser
+	}
+
+	token, err := parseJWT(pass)
+	if err != nil {
+		return nil, ErrInvalidCredentials.WithDetail(err.Error())
+	}
+
+	issuer, ok := a.issuers[token.claims.string("iss")]
+	if !ok {
+		return nil, ErrUnknownUser
+	}
+
+	if err := a.validate(ctx, issuer, token); err != nil {
+		return nil, err
+	}
+
+	subject := token.claims.string(issuer.SubjectClaim)
+	if subject == "" || subject != user {
+		return nil, ErrInvalidCredentials.WithDetail(fmt.Sprintf("username must be the %s claim of the token", issuer.SubjectClaim))
+	}
+
+	attributes := map[string]string{"iss": issuer.Issuer}
+	for _, claim := range issuer.Claims {
+		if value := token.claims.string(claim); value != "" {
+			attributes[claim] = value
+		}
+	}
+
+	var groups []string
+	if issuer.GroupsClaim != "" {
+		groups = token.claims.strings(issuer.GroupsClaim)
+	}
+
+	return &Identity{
+		Subject:    subject,
+		Groups:     groups,
+		Attributes: attributes,
+		Method:     AuthMethodOIDC,
+	}, nil
+}
+
+func (a *OIDCAuthenticator) validate(ctx context.Context, issuer *oidcIssuer, token *jwtToken) error {
+	if err := validateJWT(ctx, token, issuer.keys, issuer.Audiences, a.now(), a.options.ClockSkew); err != nil {
+		return err
+	}
+
+	for claim, value := range issuer.RequiredClaims {
+		if token.claims.string(claim) != value {
+			return ErrInvalidCredentials.WithDetail(fmt.Sprintf("jwt claim %s does not have the required value", claim))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestOIDCAuthenticator(t *testing.T, issuers ...OIDCIssuer) *OIDCAuthenticator {
+	a, err := NewOIDCAuthenticator(OIDCOptions{Issuers: issuers})
+	assert.NoError(t, err)
+	return a
+}
+
+func TestOIDCAuthenticator(t *testing.T) {
+	issuer := newTestJWTIssuer(t)
+	a := newTestOIDCAuthenticator(t, OIDCIssuer{
+		Issuer:         issuer.url(),
+		Audiences:      []string{"registry"},
+		SubjectClaim:   "repository",
+		Claims:         []string{"repository", "ref", "workflow"},
+		RequiredClaims: map[string]string{"repository_owner": "acme"},
+	})
+
+	claims := func() map[string]interface{} {
+		return map[string]interface{}{
+			"sub":              "repo:acme/app:ref:refs/heads/main",
+			"aud":              "registry",
+			"repository":       "acme/app",
+			"repository_owner": "acme",
+			"ref":              "refs/heads/main",
+			"workflow":         "release",
+		}
+	}
+
+	for _, alg := range []struct{ alg, kid string }{{"RS256", "rsa"}, {"ES256", "ec"}} {
+		identity, err := a.AuthenticateIdentity(context.Background(), "acme/app", issuer.sign(t, alg.alg, alg.kid, claims()))
+		assert.NoError(t, err)
+		assert.Equal(t, "acme/app", identity.Subject)
+		assert.Equal(t, AuthMethodOIDC, identity.Method)
+		assert.Equal(t, "refs/heads/main", identity.Attribute("ref"))
+		assert.Equal(t, "release", identity.Attribute("workflow"))
+		assert.Equal(t, issuer.url(), identity.Attribute("iss"))
+	}
+
+	// The keys are fetched once and cached
+	assert.Equal(t, 1, issuer.jwksCalls)
+
+	tests := []struct {
+		name   string
+		user   string
+		modify func(claims map[string]interface{})
+	}{
+		{"TestOtherAudience", "acme/app", func(c map[string]interface{}) { c["aud"] = "other" }},
+		{"TestExpired", "acme/app", func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() }},
+		{"TestNoExpiry", "acme/app", func(c map[string]interface{}) { c["exp"] = nil }},
+		{"TestNotYetValid", "acme/app", func(c map[string]interface{}) { c["nbf"] = time.Now().Add(time.Hour).Unix() }},
+		{"TestOtherOwner", "acme/app", func(c map[string]interface{}) { c["repository_owner"] = "evil" }},
+		{"TestOtherUser", "acme/other", func(c map[string]interface{}) {}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := claims()
+			tt.modify(c)
+			_, err := a.AuthenticateIdentity(context.Background(), tt.user, issuer.sign(t, "RS256", "rsa", c))
+			assert.True(t, errors.Is(err, ErrInvalidCredentials), "error = %v", err)
+			assert.False(t, errors.Is(err, ErrUnknownUser))
+		})
+	}
+
+	// Tokens of other issuers and passwords are left to other authenticators
+	c := claims()
+	c["iss"] = "https://other.example.com"
+	_, err := a.AuthenticateIdentity(context.Background(), "acme/app", issuer.sign(t, "RS256", "rsa", c))
+	assert.True(t, errors.Is(err, ErrUnknownUser))
+	_, err = a.AuthenticateIdentity(context.Background(), "acme/app", "secret")
+	assert.True(t, errors.Is(err, ErrUnknownUser))
+}
+
+func TestOIDCAuthenticator_UnknownKeyID(t *testing.T) {
+	issuer := newTestJWTIssuer(t)
+	a := newTestOIDCAuthenticator(t, OIDCIssuer{Issuer: issuer.url(), Audiences: []string{"registry"}})
+	token := issuer.sign(t, "RS256", "rotated", map[string]interface{}{"sub": "jens", "aud": "registry"})
+
+	now := time.Now()
+	a.issuers[issuer.url()].keys.now = func() time.Time { return now }
+
+	_, err := a.AuthenticateIdentity(context.Background(), "jens", token)
+	assert.True(t, errors.Is(err, ErrInvalidCredentials))
+	assert.Equal(t, 1, issuer.jwksCalls)
+
+	// Unknown key IDs do not fetch the keys again within the minimum refresh interval
+	_, err = a.AuthenticateIdentity(context.Background(), "jens", token)
+	assert.True(t, errors.Is(err, ErrInvalidCredentials))
+	assert.Equal(t, 1, issuer.jwksCalls)
+
+	// But do after it, so rotated keys are picked up before the cache expires
+	now = now.Add(time.Minute)
+	_, err = a.AuthenticateIdentity(context.Background(), "jens", token)
+	assert.True(t, errors.Is(err, ErrInvalidCredentials))
+	assert.Equal(t, 2, issuer.jwksCalls)
+}
+
+func TestOIDCAuthenticator_JWKSFile(t *testing.T) {
+	issuer := newTestJWTIssuer(t)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	assert.NoError(t, os.WriteFile(path, mustMarshal(t, issuer.jwks()), 0600))
+
+	a := newTestOIDCAuthenticator(t, OIDCIssuer{Issuer: "https://token.actions.githubusercontent.com", JWKSFile: path, Audiences: []string{"registry"}})
+	token := issuer.sign(t, "ES256", "ec", map[string]interface{}{"iss": "https://token.actions.githubusercontent.com", "sub": "jens", "aud": "registry"})
+
+	_, err := a.AuthenticateIdentity(context.Background(), "jens", token)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, issuer.jwksCalls)
+}
+
+func TestOIDCAuthenticator_IssuerUnavailable(t *testing.T) {
+	issuer := newTestJWTIssuer(t)
+	a := newTestOIDCAuthenticator(t, OIDCIssuer{Issuer: issuer.url(), Audiences: []string{"registry"}})
+	token := issuer.sign(t, "RS256", "rsa", map[string]interface{}{"sub": "jens", "aud": "registry"})
+	issuer.server.Close()
+
+	_, err := a.AuthenticateIdentity(context.Background(), "jens", token)
+	assert.True(t, errors.Is(err, ErrUnknown))
+}
+
+func TestNewOIDCAuthenticatorInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		issuers []OIDCIssuer
+	}{
+		{"TestNoIssuers", nil},
+		{"TestNoIssuerURL", []OIDCIssuer{{Audiences: []string{"registry"}}}},
+		{"TestNoAudiences", []OIDCIssuer{{Issuer: "https://gitlab.com"}}},
+		{"TestDuplicateIssuer", []OIDCIssuer{{Issuer: "https://gitlab.com", Audiences: []string{"registry"}}, {Issuer: "https://gitlab.com", Audiences: []string{"registry"}}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewOIDCAuthenticator(OIDCOptions{Issuers: tt.issuers})
+			assert.Error(t, err)
+		})
+	}
+}
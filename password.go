@@ -0,0 +1,260 @@
+package registry
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+)
+
+// dummyBcryptHash is a bcrypt hash used to spend the same time on unknown users as on known users, so the existence of a user can not be derived from the response time.
+const dummyBcryptHash = "$2a$10$1z/1FEJStQGjM8BKS1702.372n7l.eHpOlW.h2l42LRVXDRjp8Y2W"
+
+// Argon2idParams are the parameters used by HashPasswordArgon2id.
+type Argon2idParams struct {
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+	SaltLen uint32
+	KeyLen  uint32
+}
+
+// DefaultArgon2idParams are the parameters recommended by RFC 9106 for memory constrained environments.
+var DefaultArgon2idParams = Argon2idParams{
+	Memory:  64 * 1024,
+	Time:    3,
+	Threads: 4,
+	SaltLen: 16,
+	KeyLen:  32,
+}
+
+// HashPassword hashes the password with bcrypt at the default cost. Passwords longer than 72 bytes are rejected by bcrypt, use HashPasswordArgon2id for those.
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// HashPasswordArgon2id hashes the password with argon2id and the given parameters, in the PHC string format accepted by VerifyPassword. Invalid parameters, like a zero time or more memory than VerifyPassword accepts, are an error.
+func HashPasswordArgon2id(password string, params Argon2idParams) (string, error) {
+	if err := params.validate(); err != nil {
+		return "", err
+	}
+
+	salt := make([]byte, params.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, params.KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, params.Memory, params.Time, params.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// VerifyPassword checks the password against the given hash. Supported are bcrypt ($2a$, $2b$, $2y$), argon2id ($argon2id$, in the PHC string format) and for legacy htpasswd files SHA1 ({SHA}) and APR1 ($apr1$). If the password does not match, false is returned. If the hash format is not supported, an error is returned.
+func VerifyPassword(hash, password string) (bool, error) {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return err == nil, err
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return verifyArgon2id(hash, password)
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		return constantTimeEqual(hash[len("{SHA}"):], base64.StdEncoding.EncodeToString(sum[:])), nil
+	case strings.HasPrefix(hash, "$apr1$"):
+		parts := strings.Split(hash, "$")
+		if len(parts) != 4 {
+			return false, fmt.Errorf("invalid apr1 hash")
+		}
+		return constantTimeEqual(hash, apr1Crypt(password, parts[2])), nil
+	}
+
+	return false, fmt.Errorf("unsupported password hash format")
+}
+
+// checkPasswordHash checks that the hash is in one of the formats supported by VerifyPassword and can be parsed, so a broken hash is noticed when it is configured instead of when a user logs in.
+func checkPasswordHash(hash string) error {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		_, err := bcrypt.Cost([]byte(hash))
+		return err
+	case strings.HasPrefix(hash, "$argon2id$"):
+		_, _, _, err := parseArgon2id(hash)
+		return err
+	case strings.HasPrefix(hash, "{SHA}"):
+		if sum, err := base64.StdEncoding.DecodeString(hash[len("{SHA}"):]); err != nil || len(sum) != sha1.Size {
+			return fmt.Errorf("invalid sha1 hash")
+		}
+		return nil
+	case strings.HasPrefix(hash, "$apr1$"):
+		if len(strings.Split(hash, "$")) != 4 {
+			return fmt.Errorf("invalid apr1 hash")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unsupported password hash format")
+}
+
+// spendPasswordVerification verifies the password against a dummy hash, to be used when a user is unknown.
+func spendPasswordVerification(password string) {
+	_ = bcrypt.CompareHashAndPassword([]byte(dummyBcryptHash), []byte(password))
+}
+
+// maxArgon2idMemory is the most memory in KiB an argon2id hash may use, so a hash can not make a verification allocate an unbounded amount of memory.
+const maxArgon2idMemory = 4 * 1024 * 1024
+
+// validate checks the parameters, argon2 panics on some invalid parameters instead of returning an error.
+func (p Argon2idParams) validate() error {
+	if p.Time < 1 {
+		return fmt.Errorf("argon2id time must be at least 1")
+	}
+	if p.Threads < 1 {
+		return fmt.Errorf("argon2id threads must be at least 1")
+	}
+	if p.Memory < 8*uint32(p.Threads) || p.Memory > maxArgon2idMemory {
+		return fmt.Errorf("argon2id memory must be between %d and %d KiB", 8*uint32(p.Threads), maxArgon2idMemory)
+	}
+	if p.SaltLen < 1 {
+		return fmt.Errorf("argon2id salt length must be at least 1")
+	}
+	if p.KeyLen < 1 {
+		return fmt.Errorf("argon2id key length must be at least 1")
+	}
+	return nil
+}
+
+// parseArgon2id parses an argon2id hash in the PHC string format: $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>.
+func parseArgon2id(hash string) (Argon2idParams, []byte, []byte, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return Argon2idParams{}, nil, nil, fmt.Errorf("invalid argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return Argon2idParams{}, nil, nil, fmt.Errorf("unsupported argon2id version")
+	}
+
+	var params Argon2idParams
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return Argon2idParams{}, nil, nil, fmt.Errorf("invalid argon2id parameters")
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return Argon2idParams{}, nil, nil, fmt.Errorf("invalid argon2id salt")
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return Argon2idParams{}, nil, nil, fmt.Errorf("invalid argon2id hash")
+	}
+
+	params.SaltLen = uint32(len(salt))
+	params.KeyLen = uint32(len(key))
+	if err := params.validate(); err != nil {
+		return Argon2idParams{}, nil, nil, err
+	}
+	return params, salt, key, nil
+}
+
+// verifyArgon2id verifies the password against an argon2id hash in the PHC string format.
+func verifyArgon2id(hash, password string) (bool, error) {
+	params, salt, key, err := parseArgon2id(hash)
+	if err != nil {
+		return false, err
+	}
+
+	derived := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, params.KeyLen)
+	return subtle.ConstantTimeCompare(key, derived) == 1, nil
+}
+
+func constantTimeEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+const apr1Alphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// apr1Crypt computes the Apache variant of the MD5 crypt algorithm, as used by htpasswd -m.
+func apr1Crypt(password, salt string) string {
+	const magic = "$apr1$"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw, s := []byte(password), []byte(salt)
+
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write(s)
+	alt.Write(pw)
+	altSum := alt.Sum(nil)
+
+	h := md5.New()
+	h.Write(pw)
+	h.Write([]byte(magic))
+	h.Write(s)
+	for i := len(pw); i > 0; i -= 16 {
+		h.Write(altSum[:min(i, 16)])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(pw[:1])
+		}
+	}
+	sum := h.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		r := md5.New()
+		if i&1 != 0 {
+			r.Write(pw)
+		} else {
+			r.Write(sum)
+		}
+		if i%3 != 0 {
+			r.Write(s)
+		}
+		if i%7 != 0 {
+			r.Write(pw)
+		}
+		if i&1 != 0 {
+			r.Write(sum)
+		} else {
+			r.Write(pw)
+		}
+		sum = r.Sum(nil)
+	}
+
+	var out strings.Builder
+	out.WriteString(magic)
+	out.WriteString(salt)
+	out.WriteString("$")
+	encode := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out.WriteByte(apr1Alphabet[v&0x3f])
+			v >>= 6
+		}
+	}
+	encode(uint32(sum[0])<<16|uint32(sum[6])<<8|uint32(sum[12]), 4)
+	encode(uint32(sum[1])<<16|uint32(sum[7])<<8|uint32(sum[13]), 4)
+	encode(uint32(sum[2])<<16|uint32(sum[8])<<8|uint32(sum[14]), 4)
+	encode(uint32(sum[3])<<16|uint32(sum[9])<<8|uint32(sum[15]), 4)
+	encode(uint32(sum[4])<<16|uint32(sum[10])<<8|uint32(sum[5]), 4)
+	encode(uint32(sum[11]), 2)
+
+	return out.String()
+}
@@ -0,0 +1,120 @@
+package registry
+
+import "testing"
+
+func TestVerifyPassword(t *testing.T) {
+	tests := []struct {
+		name     string
+		hash     string
+		password string
+		want     bool
+		wantErr  bool
+	}{
+		{"TestBcrypt", "$2a$10$J12IkNnVv6Cmm5KPzMrFL.ya4IB6Uz7.0C71unneN9.ikZW0Ot8M.", "secret", true, false},
+		{"TestBcryptWrong", "$2a$10$J12IkNnVv6Cmm5KPzMrFL.ya4IB6Uz7.0C71unneN9.ikZW0Ot8M.", "wrong", false, false},
+		{"TestBcryptInvalid", "$2a$10$invalid", "secret", false, true},
+		{"TestSHA", "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "secret", true, false},
+		{"TestSHAWrong", "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "wrong", false, false},
+		{"TestAPR1", "$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0", "secret", true, false},
+		{"TestAPR1ShortSalt", "$apr1$abc$NKxAkoTtUloZMd1uGIvNG0", "pw", true, false},
+		{"TestAPR1Wrong", "$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0", "wrong", false, false},
+		{"TestAPR1Invalid", "$apr1$saltsalt", "secret", false, true},
+		{"TestPlain", "secret", "secret", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := VerifyPassword(tt.hash, tt.password)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("VerifyPassword() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("VerifyPassword() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyPasswordArgon2id(t *testing.T) {
+	const hash = "$argon2id$v=19$m=8192,t=1,p=1$c29tZXNhbHRzb21lc2FsdA$wbG8ol8HdlikAcXtl+f/NSzCiQoFbRK7tS6+aougO5U"
+
+	if ok, err := VerifyPassword(hash, "secret"); err != nil || !ok {
+		t.Errorf("VerifyPassword() = %v, %v, want true, nil", ok, err)
+	}
+
+	if ok, err := VerifyPassword(hash, "wrong"); err != nil || ok {
+		t.Errorf("VerifyPassword() = %v, %v, want false, nil", ok, err)
+	}
+
+	for _, invalid := range []string{
+		"$argon2id$v=19$m=8192,t=1,p=1$c29tZXNhbHRzb21lc2FsdA",
+		"$argon2id$v=16$m=8192,t=1,p=1$c29tZXNhbHRzb21lc2FsdA$wbG8ol8HdlikAcXtl+f/NSzCiQoFbRK7tS6+aougO5U",
+		"$argon2id$v=19$m=8192$c29tZXNhbHRzb21lc2FsdA$wbG8ol8HdlikAcXtl+f/NSzCiQoFbRK7tS6+aougO5U",
+		"$argon2id$v=19$m=8192,t=1,p=1$!!!$wbG8ol8HdlikAcXtl+f/NSzCiQoFbRK7tS6+aougO5U",
+		"$argon2id$v=19$m=8192,t=0,p=1$c29tZXNhbHRzb21lc2FsdA$wbG8ol8HdlikAcXtl+f/NSzCiQoFbRK7tS6+aougO5U",
+		"$argon2id$v=19$m=8192,t=1,p=0$c29tZXNhbHRzb21lc2FsdA$wbG8ol8HdlikAcXtl+f/NSzCiQoFbRK7tS6+aougO5U",
+		"$argon2id$v=19$m=4294967295,t=1,p=1$c29tZXNhbHRzb21lc2FsdA$wbG8ol8HdlikAcXtl+f/NSzCiQoFbRK7tS6+aougO5U",
+		"$argon2id$v=19$m=8192,t=1,p=1$$wbG8ol8HdlikAcXtl+f/NSzCiQoFbRK7tS6+aougO5U",
+		"$argon2id$v=19$m=8192,t=1,p=1$c29tZXNhbHRzb21lc2FsdA$",
+	} {
+		if err := checkPasswordHash(invalid); err == nil {
+			t.Errorf("checkPasswordHash(%q) error = nil, want error", invalid)
+		}
+		if _, err := VerifyPassword(invalid, "secret"); err == nil {
+			t.Errorf("VerifyPassword(%q) error = nil, want error", invalid)
+		}
+	}
+}
+
+func TestHashPassword(t *testing.T) {
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Errorf("HashPassword() error = %v", err)
+		return
+	}
+
+	if ok, err := VerifyPassword(hash, "secret"); err != nil || !ok {
+		t.Errorf("VerifyPassword() = %v, %v, want true, nil", ok, err)
+	}
+
+	if _, err := HashPassword(string(make([]byte, 73))); err == nil {
+		t.Errorf("HashPassword() error = nil, want error for passwords longer than 72 bytes")
+	}
+}
+
+func TestHashPasswordArgon2id(t *testing.T) {
+	params := DefaultArgon2idParams
+	params.Memory = 8 * 1024
+	params.Time = 1
+
+	hash, err := HashPasswordArgon2id("secret", params)
+	if err != nil {
+		t.Errorf("HashPasswordArgon2id() error = %v", err)
+		return
+	}
+
+	if err := checkPasswordHash(hash); err != nil {
+		t.Errorf("HashPasswordArgon2id() = %v, not a supported hash: %v", hash, err)
+	}
+
+	if ok, err := VerifyPassword(hash, "secret"); err != nil || !ok {
+		t.Errorf("VerifyPassword() = %v, %v, want true, nil", ok, err)
+	}
+
+	if ok, err := VerifyPassword(hash, "wrong"); err != nil || ok {
+		t.Errorf("VerifyPassword() = %v, %v, want false, nil", ok, err)
+	}
+
+	for _, invalid := range []Argon2idParams{
+		{Memory: 8 * 1024, Time: 0, Threads: 1, SaltLen: 16, KeyLen: 32},
+		{Memory: 8 * 1024, Time: 1, Threads: 0, SaltLen: 16, KeyLen: 32},
+		{Memory: 4, Time: 1, Threads: 1, SaltLen: 16, KeyLen: 32},
+		{Memory: 8 * 1024, Time: 1, Threads: 1, SaltLen: 0, KeyLen: 32},
+		{Memory: 8 * 1024, Time: 1, Threads: 1, SaltLen: 16, KeyLen: 0},
+	} {
+		if _, err := HashPasswordArgon2id("secret", invalid); err == nil {
+			t.Errorf("HashPasswordArgon2id(%+v) error = nil, want error", invalid)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"path"
+)
+
+// PublicAuthorizer is an authorizer granting pull on public repositories to everyone, including anonymous requests. Other scopes of anonymous requests are granted nothing, and every scope of authenticated requests is authorized by the next authorizer, with pull added for public repositories.
+type PublicAuthorizer struct {
+	next     Authorizer
+	patterns []string
+}
+
+// NewPublicAuthorizer creates a new PublicAuthorizer for the repositories matching one of the patterns, which use the syntax of path.Match, so library/* matches library/alpine but not library/alpine/edge. If next is nil, authenticated requests are only granted pull on public repositories as well.
+func NewPublicAuthorizer(next Authorizer, patterns ...string) (*PublicAuthorizer, error) {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid public repository pattern %s: %w", pattern, err)
+		}
+	}
+	return &PublicAuthorizer{next: next, patterns: patterns}, nil
+}
+
+// IsPublic checks if the repository is public.
+func (a *PublicAuthorizer) IsPublic(repository string) bool {
+	for _, pattern := range a.patterns {
+		// The patterns are validated on creation, so Match can not fail
+		if ok, _ := path.Match(pattern, repository); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Authorize grants pull on public repositories, and passes the scopes of authenticated requests on to the next authorizer.
+func (a *PublicAuthorizer) Authorize(ctx context.Context, req *AuthorizationRequest, scope *Scope) (ActionSet, error) {
+	var public ActionSet
+	if scope.Type == ScopeTypeRepository && a.IsPublic(scope.Name) {
+		public = ActionSet{ActionPull}
+	}
+
+	if req.Identity.IsAnonymous() || a.next == nil {
+		return public, nil
+	}
+
+	actions, err := a.next.Authorize(ctx, req, scope)
+	if err != nil {
+		return nil, err
+	}
+	if len(public) > 0 && !actions.Contains(ActionPull) {
+		// The actions may be shared with the next authorizer, like the requested actions of the scope
+		actions = append(append(ActionSet(nil), actions...), ActionPull)
+	}
+	return actions, nil
+}
@@ -0,0 +1,53 @@
+package registry
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestPublicAuthorizer(t *testing.T) {
+	a, err := NewPublicAuthorizer(NewDummyAuthorizer(), "library/*", "public")
+	assert.NoError(t, err)
+
+	anonymous := &AuthorizationRequest{Identity: AnonymousIdentity()}
+	user := &AuthorizationRequest{Account: "jens", Identity: &Identity{Subject: "jens", Method: AuthMethodPassword}}
+
+	tests := []struct {
+		name  string
+		req   *AuthorizationRequest
+		scope string
+		want  ActionSet
+	}{
+		{"TestAnonymousPublic", anonymous, "repository:library/alpine:pull,push", ActionSet{ActionPull}},
+		{"TestAnonymousExactName", anonymous, "repository:public:pull", ActionSet{ActionPull}},
+		{"TestAnonymousNested", anonymous, "repository:library/alpine/edge:pull", nil},
+		{"TestAnonymousPrivate", anonymous, "repository:acme/app:pull", nil},
+		{"TestAnonymousCatalog", anonymous, "registry:catalog:*", nil},
+		{"TestUserPrivate", user, "repository:acme/app:pull,push", ActionSet{ActionPull, ActionPush}},
+		{"TestUserPublic", user, "repository:library/alpine:push", ActionSet{ActionPush, ActionPull}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scope, err := ParseScope(tt.scope)
+			assert.NoError(t, err)
+			requested := append(ActionSet(nil), scope.Actions...)
+
+			got, err := a.Authorize(context.Background(), tt.req, scope)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, requested, scope.Actions)
+		})
+	}
+
+	// A user named anonymous is not anonymous
+	named := &AuthorizationRequest{Account: AnonymousSubject, Identity: &Identity{Subject: AnonymousSubject, Method: AuthMethodPassword}}
+	scope, _ := ParseScope("repository:acme/app:pull")
+	got, err := a.Authorize(context.Background(), named, scope)
+	assert.NoError(t, err)
+	assert.Equal(t, ActionSet{ActionPull}, got)
+
+	_, err = NewPublicAuthorizer(nil, "library/[")
+	assert.Error(t, err)
+}
@@ -0,0 +1,165 @@
+package registry
+
+import (
+	"container/list"
+	"golang.org/x/time/rate"
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimit is a token bucket limit. The zero value means no limit.
+type RateLimit struct {
+	// Rate is the number of requests per second allowed on average.
+	Rate float64
+	// Burst is the number of requests allowed at once. Defaults to Rate rounded up, with a minimum of 1.
+	Burst int
+}
+
+func (l RateLimit) enabled() bool {
+	return l.Rate > 0
+}
+
+func (l RateLimit) newLimiter() *rate.Limiter {
+	burst := l.Burst
+	if burst <= 0 {
+		burst = int(math.Max(1, math.Ceil(l.Rate)))
+	}
+	return rate.NewLimiter(rate.Limit(l.Rate), burst)
+}
+
+// RateLimiterOptions contains the options for a RateLimiter. Limits that are not set are not applied.
+type RateLimiterOptions struct {
+	// Global limits all token requests together.
+	Global RateLimit
+	// PerIP limits the token requests of every client IP.
+	PerIP RateLimit
+	// PerAccount limits the token requests of every account from every client IP. The account is only claimed by the request, as limits are applied before the credentials are checked, so the IP is part of the key: keyed on the account alone, anyone could exhaust the bucket of another account and keep its user from getting tokens. Without a client IP, the account alone is the key.
+	PerAccount RateLimit
+	// PerClient limits the token requests of every client_id.
+	PerClient RateLimit
+	// MaxKeys is the maximum number of IPs, accounts and client_ids limits are kept for, each. The least recently used is forgotten when it is reached, which gives it a full bucket again. Defaults to 10000.
+	MaxKeys int
+}
+
+// RateLimiter limits the rate of token requests with token buckets, globally and per IP, account and client_id. Set it as RateLimiter of the TokenHandlerOptions to limit a TokenHandler. It is safe for concurrent use.
+type RateLimiter struct {
+	global     *rate.Limiter
+	perIP      *keyedRateLimiter
+	perAccount *keyedRateLimiter
+	perClient  *keyedRateLimiter
+	now        func() time.Time
+
+	mu sync.Mutex
+}
+
+// NewRateLimiter creates a new RateLimiter with the given options.
+func NewRateLimiter(options RateLimiterOptions) *RateLimiter {
+	if options.MaxKeys <= 0 {
+		options.MaxKeys = 10000
+	}
+
+	l := &RateLimiter{
+		perIP:      newKeyedRateLimiter(options.PerIP, options.MaxKeys),
+		perAccount: newKeyedRateLimiter(options.PerAccount, options.MaxKeys),
+		perClient:  newKeyedRateLimiter(options.PerClient, options.MaxKeys),
+		now:        time.Now,
+	}
+	if options.Global.enabled() {
+		l.global = options.Global.newLimiter()
+	}
+	return l
+}
+
+// Allow takes a request from the buckets of the given IP, account and client_id, and from the global bucket. The account bucket is that of the account from the IP, see PerAccount. Empty keys are not limited. If any of the buckets is empty, no request is taken from the others and ErrTooManyRequests is returned, with the time until the request would be allowed as RetryAfter.
+func (l *RateLimiter) Allow(ip, account, clientId string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	accountKey := account
+	if ip != "" && account != "" {
+		accountKey = ip + " " + account
+	}
+
+	now := l.now()
+	limits := []struct {
+		name    string
+		limiter *rate.Limiter
+	}{
+		{"global", l.global},
+		{"ip", l.perIP.get(ip)},
+		{"account", l.perAccount.get(accountKey)},
+		{"client_id", l.perClient.get(clientId)},
+	}
+
+	reservations := make([]*rate.Reservation, 0, len(limits))
+	for _, limit := range limits {
+		if limit.limiter == nil {
+			continue
+		}
+
+		reservation := limit.limiter.ReserveN(now, 1)
+		delay := reservation.DelayFrom(now)
+		if reservation.OK() && delay == 0 {
+			reservations = append(reservations, reservation)
+			continue
+		}
+
+		// The request is not made, so it must not count against the other limits either.
+		reservation.CancelAt(now)
+		for _, r := range reservations {
+			r.CancelAt(now)
+		}
+		if delay == rate.InfDuration {
+			delay = time.Second
+		}
+		return ErrTooManyRequests.WithDetail(limit.name + " rate limit exceeded").WithRetryAfter(delay)
+	}
+	return nil
+}
+
+// keyedRateLimiter keeps a token bucket per key, forgetting the least recently used key when it has too many.
+type keyedRateLimiter struct {
+	limit    RateLimit
+	maxKeys  int
+	limiters map[string]*list.Element
+	lru      *list.List
+}
+
+type keyedRateLimiterEntry struct {
+	key     string
+	limiter *rate.Limiter
+}
+
+func newKeyedRateLimiter(limit RateLimit, maxKeys int) *keyedRateLimiter {
+	if !limit.enabled() {
+		return nil
+	}
+	return &keyedRateLimiter{
+		limit:    limit,
+		maxKeys:  maxKeys,
+		limiters: make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// get returns the limiter of the key, or nil if the key or the limiter is empty.
+func (k *keyedRateLimiter) get(key string) *rate.Limiter {
+	if k == nil || key == "" {
+		return nil
+	}
+
+	if element, ok := k.limiters[key]; ok {
+		k.lru.MoveToFront(element)
+		return element.Value.(*keyedRateLimiterEntry).limiter
+	}
+
+	limiter := k.limit.newLimiter()
+	k.limiters[key] = k.lru.PushFront(&keyedRateLimiterEntry{key: key, limiter: limiter})
+	for k.lru.Len() > k.maxKeys {
+		oldest := k.lru.Back()
+		k.lru.Remove(oldest)
+		delete(k.limiters, oldest.Value.(*keyedRateLimiterEntry).key)
+	}
+	return limiter
+}
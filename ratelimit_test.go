@@ -0,0 +1,99 @@
+package registry
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func newTestRateLimiter(options RateLimiterOptions) (*RateLimiter, *time.Time) {
+	l := NewRateLimiter(options)
+	now := time.Now()
+	l.now = func() time.Time { return now }
+	return l, &now
+}
+
+func TestRateLimiter_PerKey(t *testing.T) {
+	l, now := newTestRateLimiter(RateLimiterOptions{
+		PerIP:      RateLimit{Rate: 1, Burst: 2},
+		PerAccount: RateLimit{Rate: 0.5, Burst: 1},
+	})
+
+	assert.NoError(t, l.Allow("192.0.2.1", "jens", "docker"))
+
+	err := l.Allow("192.0.2.1", "jens", "docker")
+	var e *Error
+	assert.True(t, errors.As(err, &e))
+	assert.True(t, errors.Is(err, ErrTooManyRequests))
+	assert.Equal(t, "account rate limit exceeded", e.Detail)
+	assert.Equal(t, 2*time.Second, e.RetryAfter)
+
+	// The request denied by the account limit did not take from the IP bucket
+	assert.NoError(t, l.Allow("192.0.2.1", "alice", "docker"))
+	err = l.Allow("192.0.2.1", "bob", "docker")
+	assert.True(t, errors.As(err, &e))
+	assert.Equal(t, "ip rate limit exceeded", e.Detail)
+	assert.Equal(t, time.Second, e.RetryAfter)
+
+	// Requests for an account from one IP do not exhaust the bucket of the account from other IPs
+	assert.NoError(t, l.Allow("192.0.2.2", "jens", "docker"))
+
+	// Empty keys are not limited
+	assert.NoError(t, l.Allow("", "", ""))
+
+	*now = now.Add(time.Second)
+	assert.NoError(t, l.Allow("192.0.2.1", "carol", "docker"))
+}
+
+func TestRateLimiter_GlobalAndClient(t *testing.T) {
+	l, _ := newTestRateLimiter(RateLimiterOptions{
+		Global:    RateLimit{Rate: 10, Burst: 3},
+		PerClient: RateLimit{Rate: 1},
+	})
+
+	assert.NoError(t, l.Allow("192.0.2.1", "jens", "ci"))
+	assert.True(t, errors.Is(l.Allow("192.0.2.1", "jens", "ci"), ErrTooManyRequests))
+	assert.NoError(t, l.Allow("192.0.2.1", "jens", "docker"))
+	assert.NoError(t, l.Allow("192.0.2.1", "jens", ""))
+	assert.True(t, errors.Is(l.Allow("192.0.2.1", "jens", ""), ErrTooManyRequests))
+}
+
+func TestRateLimiter_MaxKeys(t *testing.T) {
+	l, _ := newTestRateLimiter(RateLimiterOptions{PerIP: RateLimit{Rate: 1}, MaxKeys: 2})
+
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		assert.NoError(t, l.Allow(ip, "", ""))
+	}
+	assert.Equal(t, 2, l.perIP.lru.Len())
+
+	// The least recently used IP was forgotten
+	assert.NoError(t, l.Allow("192.0.2.1", "", ""))
+	assert.Error(t, l.Allow("192.0.2.3", "", ""))
+}
+
+func TestTokenHandler_RateLimited(t *testing.T) {
+	h := newTestTokenHandler(t, NewDummyAuthorizer())
+	h.options.RateLimiter = NewRateLimiter(RateLimiterOptions{PerAccount: RateLimit{Rate: 0.1}})
+
+	req := httptest.NewRequest(http.MethodGet, "/?account=jens&service=registry&client_id=docker", nil)
+	req.SetBasicAuth("jens", "secret")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// The account is limited for the OAuth2 flow as well
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, newFormRequest(url.Values{
+		"grant_type": {"password"},
+		"username":   {"jens"},
+		"password":   {"secret"},
+		"service":    {"registry"},
+		"client_id":  {"docker"},
+	}))
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "10", rec.Header().Get("Retry-After"))
+}
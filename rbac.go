@@ -0,0 +1,341 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Role is a named set of actions, which is granted to users and groups with a RoleBinding.
+type Role struct {
+	Name    string   `yaml:"name" json:"name"`
+	Actions []string `yaml:"actions" json:"actions"`
+}
+
+// DefaultRoles are the roles every RBACPolicy has, unless it declares a role with the same name.
+var DefaultRoles = []Role{
+	{Name: "reader", Actions: []string{"pull"}},
+	{Name: "developer", Actions: []string{"pull", "push"}},
+	{Name: "maintainer", Actions: []string{"pull", "push", "*"}},
+	{Name: "admin", Actions: []string{"pull", "push", "*", "admin", "catalog"}},
+}
+
+// RoleBinding grants a role to a user or group on a repository namespace.
+type RoleBinding struct {
+	Role string `yaml:"role" json:"role"`
+	// User is the subject of the identities the role is granted to. Exactly one of User and Group must be set.
+	User  string `yaml:"user,omitempty" json:"user,omitempty"`
+	Group string `yaml:"group,omitempty" json:"group,omitempty"`
+	// Namespace is the repository namespace the role is granted on, like team-a for team-a and every repository below it. If empty, the role is granted on every repository and on the registry scopes, like the catalog.
+	Namespace string `yaml:"namespace,omitempty" json:"namespace,omitempty"`
+}
+
+// covers checks if the binding grants its role on the scope.
+func (b RoleBinding) covers(scope *Scope) bool {
+	if b.Namespace == "" {
+		return true
+	}
+	return scope.Type == ScopeTypeRepository && (scope.Name == b.Namespace || strings.HasPrefix(scope.Name, b.Namespace+"/"))
+}
+
+// appliesTo checks if the binding grants its role to the identity. Anonymous identities are not bound to any role.
+func (b RoleBinding) appliesTo(identity *Identity) bool {
+	if identity == nil || identity.IsAnonymous() {
+		return false
+	}
+	if b.User != "" {
+		return identity.Subject == b.User
+	}
+	return identity.HasGroup(b.Group)
+}
+
+// RBACPolicy is the format of an RBAC file.
+//
+//	roles:
+//	  - name: releaser
+//	    actions: [pull, push]
+//	bindings:
+//	  - role: developer
+//	    group: team-a
+//	    namespace: team-a
+//	  - role: admin
+//	    user: jens
+type RBACPolicy struct {
+	// Roles are added to the DefaultRoles, replacing default roles with the same name.
+	Roles    []Role        `yaml:"roles,omitempty" json:"roles,omitempty"`
+	Bindings []RoleBinding `yaml:"bindings" json:"bindings"`
+}
+
+// ParseRBACPolicy parses the contents of an RBAC file and validates it. JSON is parsed when isJSON is true, YAML otherwise.
+func ParseRBACPolicy(data []byte, isJSON bool) (*RBACPolicy, error) {
+	policy := &RBACPolicy{}
+	if err := unmarshalConfig(data, isJSON, policy); err != nil {
+		return nil, err
+	}
+
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// Validate checks that every role has a unique name and valid actions, and every binding a known role, a user or group, and a namespace without wildcards.
+func (p *RBACPolicy) Validate() error {
+	seen := make(map[string]bool, len(p.Roles))
+	for i, role := range p.Roles {
+		if role.Name == "" {
+			return fmt.Errorf("role %d has no name", i)
+		}
+		if seen[role.Name] {
+			return fmt.Errorf("role %s is declared more than once", role.Name)
+		}
+		seen[role.Name] = true
+
+		if _, err := ParseActions(role.Actions); err != nil {
+			return fmt.Errorf("role %s: %w", role.Name, err)
+		}
+	}
+
+	roles := p.roles()
+	for i, binding := range p.Bindings {
+		if _, ok := roles[binding.Role]; !ok {
+			return fmt.Errorf("binding %d has unknown role %q", i, binding.Role)
+		}
+		if (binding.User == "") == (binding.Group == "") {
+			return fmt.Errorf("binding %d must have either a user or a group", i)
+		}
+		if strings.ContainsAny(binding.Namespace, "*?") || strings.HasPrefix(binding.Namespace, "/") || strings.HasSuffix(binding.Namespace, "/") {
+			return fmt.Errorf("binding %d has invalid namespace %q", i, binding.Namespace)
+		}
+	}
+	return nil
+}
+
+// roles returns the actions of the default roles and the roles of the policy by name. Roles with invalid actions are left out, they are rejected by Validate.
+func (p *RBACPolicy) roles() map[string]ActionSet {
+	roles := make(map[string]ActionSet, len(DefaultRoles)+len(p.Roles))
+	for _, role := range append(append([]Role(nil), DefaultRoles...), p.Roles...) {
+		if actions, err := ParseActions(role.Actions); err == nil {
+			roles[role.Name] = actions
+		}
+	}
+	return roles
+}
+
+// RBACStore stores the roles and bindings of an RBACAuthorizer.
+type RBACStore interface {
+	// Policy returns the current roles and bindings. The caller must not change the returned policy.
+	Policy(ctx context.Context) (*RBACPolicy, error)
+}
+
+// InMemoryRBACStore is an RBACStore keeping the policy in memory, which can be changed while it is used.
+type InMemoryRBACStore struct {
+	mu     sync.RWMutex
+	policy *RBACPolicy
+}
+
+// NewInMemoryRBACStore creates a new InMemoryRBACStore with the DefaultRoles and no bindings.
+func NewInMemoryRBACStore() *InMemoryRBACStore {
+	return &InMemoryRBACStore{policy: &RBACPolicy{}}
+}
+
+func (s *InMemoryRBACStore) Policy(ctx context.Context) (*RBACPolicy, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.policy, nil
+}
+
+// update validates the changed copy of the policy and swaps it in, so policies returned earlier are never changed.
+func (s *InMemoryRBACStore) update(change func(policy *RBACPolicy)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	policy := &RBACPolicy{
+		Roles:    append([]Role(nil), s.policy.Roles...),
+		Bindings: append([]RoleBinding(nil), s.policy.Bindings...),
+	}
+	change(policy)
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+	s.policy = policy
+	return nil
+}
+
+// SetRole adds the role, or replaces the role with the same name.
+func (s *InMemoryRBACStore) SetRole(role Role) error {
+	return s.update(func(policy *RBACPolicy) {
+		for i, r := range policy.Roles {
+			if r.Name == role.Name {
+				policy.Roles[i] = role
+				return
+			}
+		}
+		policy.Roles = append(policy.Roles, role)
+	})
+}
+
+// DeleteRole deletes the role. Deleting a role that replaces a default role restores the default role. Roles that are still bound can not be deleted.
+func (s *InMemoryRBACStore) DeleteRole(name string) error {
+	return s.update(func(policy *RBACPolicy) {
+		roles := policy.Roles[:0]
+		for _, r := range policy.Roles {
+			if r.Name != name {
+				roles = append(roles, r)
+			}
+		}
+		policy.Roles = roles
+	})
+}
+
+// AddBinding adds the binding, if it does not exist yet.
+func (s *InMemoryRBACStore) AddBinding(binding RoleBinding) error {
+	return s.update(func(policy *RBACPolicy) {
+		for _, b := range policy.Bindings {
+			if b == binding {
+				return
+			}
+		}
+		policy.Bindings = append(policy.Bindings, binding)
+	})
+}
+
+// RemoveBinding removes the binding.
+func (s *InMemoryRBACStore) RemoveBinding(binding RoleBinding) error {
+	return s.update(func(policy *RBACPolicy) {
+		bindings := policy.Bindings[:0]
+		for _, b := range policy.Bindings {
+			if b != binding {
+				bindings = append(bindings, b)
+			}
+		}
+		policy.Bindings = bindings
+	})
+}
+
+// FileRBACStore is an RBACStore for an RBAC file, see RBACPolicy for the format. The file is loaded again when it changes on disk.
+type FileRBACStore struct {
+	reloader *fileReloader
+
+	mu     sync.RWMutex
+	policy *RBACPolicy
+}
+
+// NewFileRBACStore creates a new FileRBACStore for the RBAC file at the given path. Files with a .json extension are parsed as JSON, others as YAML. If the file can not be loaded or is invalid, an error is returned.
+func NewFileRBACStore(path string) (*FileRBACStore, error) {
+	s := &FileRBACStore{}
+	s.reloader = newFileReloader(path, func(data []byte) error {
+		policy, err := ParseRBACPolicy(data, isJSONPath(path))
+		if err != nil {
+			return err
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.policy = policy
+		return nil
+	})
+	if err := s.reloader.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload loads the RBAC file if it has changed. This is done every time the policy is used as well, calling it is only needed to check for errors in the file. If the file can not be loaded, the previously loaded policy is kept.
+func (s *FileRBACStore) Reload() error {
+	return s.reloader.reload()
+}
+
+// SetErrorLog sets the logger for failures to reload the RBAC file when the policy is used. If nil, the standard logger of the log package is used.
+func (s *FileRBACStore) SetErrorLog(logger *log.Logger) {
+	s.reloader.setErrorLog(logger)
+}
+
+// Policy returns the policy of the RBAC file. If the file can not be reloaded, the previously loaded policy is returned and the error is logged.
+func (s *FileRBACStore) Policy(ctx context.Context) (*RBACPolicy, error) {
+	s.reloader.refresh()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.policy, nil
+}
+
+// RBACPermission is an effective permission of an identity on a namespace, see RBACAuthorizer.EffectivePermissions.
+type RBACPermission struct {
+	// Namespace is the namespace the permission is for, empty for the whole registry.
+	Namespace string
+	// Roles are the roles the identity has on the namespace.
+	Roles []string
+	// Actions are the actions of the roles.
+	Actions ActionSet
+}
+
+// RBACAuthorizer is an authorizer granting the actions of the roles bound to the identity of the request, or to one of its groups, on the namespace of the scope. Anonymous requests are granted nothing, use a PublicAuthorizer over it for public repositories.
+type RBACAuthorizer struct {
+	store RBACStore
+}
+
+// NewRBACAuthorizer creates a new RBACAuthorizer with the policy of the given store.
+func NewRBACAuthorizer(store RBACStore) *RBACAuthorizer {
+	return &RBACAuthorizer{store: store}
+}
+
+// Authorize returns the requested actions of the scope that the roles of the identity allow.
+func (a *RBACAuthorizer) Authorize(ctx context.Context, req *AuthorizationRequest, scope *Scope) (ActionSet, error) {
+	policy, err := a.store.Policy(ctx)
+	if err != nil {
+		return nil, ErrUnknown.WithCause(fmt.Errorf("rbac: %w", err))
+	}
+
+	roles := policy.roles()
+	// Bindings match the identity only, the account the client sent is not trusted
+	identity := req.Identity
+	var allowed ActionSet
+	for _, binding := range policy.Bindings {
+		if binding.appliesTo(identity) && binding.covers(scope) {
+			allowed = append(allowed, roles[binding.Role]...)
+		}
+	}
+	return scope.Actions.Intersect(allowed), nil
+}
+
+// EffectivePermissions returns the permissions of the identity per namespace, sorted by namespace. The actions of a namespace do not include the actions the identity has on the namespaces containing it.
+func (a *RBACAuthorizer) EffectivePermissions(ctx context.Context, identity *Identity) ([]*RBACPermission, error) {
+	policy, err := a.store.Policy(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	roles := policy.roles()
+	byNamespace := make(map[string]*RBACPermission)
+	for _, binding := range policy.Bindings {
+		if !binding.appliesTo(identity) {
+			continue
+		}
+
+		permission, ok := byNamespace[binding.Namespace]
+		if !ok {
+			permission = &RBACPermission{Namespace: binding.Namespace, Actions: ActionSet{}}
+			byNamespace[binding.Namespace] = permission
+		}
+		if !containsString(permission.Roles, binding.Role) {
+			permission.Roles = append(permission.Roles, binding.Role)
+		}
+		for _, action := range roles[binding.Role] {
+			if !permission.Actions.Contains(action) {
+				permission.Actions = append(permission.Actions, action)
+			}
+		}
+	}
+
+	permissions := make([]*RBACPermission, 0, len(byNamespace))
+	for _, permission := range byNamespace {
+		sort.Strings(permission.Roles)
+		permissions = append(permissions, permission)
+	}
+	sort.Slice(permissions, func(i, j int) bool { return permissions[i].Namespace < permissions[j].Namespace })
+	return permissions, nil
+}
@@ -0,0 +1,152 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"path/filepath"
+	"testing"
+)
+
+const testRBACYAML = `roles:
+  - name: releaser
+    actions: [pull, push]
+  - name: reader
+    actions: [pull, catalog]
+bindings:
+  - role: developer
+    group: team-a
+    namespace: team-a
+  - role: maintainer
+    user: jens
+    namespace: team-a/app
+  - role: releaser
+    user: ci
+    namespace: releases
+  - role: reader
+    group: everyone
+  - role: admin
+    user: root
+`
+
+func TestRBACAuthorizer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rbac.yaml")
+	writeTestFile(t, path, testRBACYAML)
+	store, err := NewFileRBACStore(path)
+	assert.NoError(t, err)
+	a := NewRBACAuthorizer(store)
+
+	user := func(subject string, groups ...string) *AuthorizationRequest {
+		return &AuthorizationRequest{Account: subject, Identity: &Identity{Subject: subject, Groups: groups}}
+	}
+
+	tests := []struct {
+		name  string
+		req   *AuthorizationRequest
+		scope string
+		want  ActionSet
+	}{
+		{"TestGroupNamespace", user("alice", "team-a"), "repository:team-a/web:pull,push,*", ActionSet{ActionPull, ActionPush}},
+		{"TestNamespaceItself", user("alice", "team-a"), "repository:team-a:push", ActionSet{ActionPush}},
+		{"TestNamespacePrefix", user("alice", "team-a"), "repository:team-ab/web:pull", ActionSet{}},
+		{"TestRolesAreMerged", user("jens", "team-a"), "repository:team-a/app/api:pull,push,*", ActionSet{ActionPull, ActionPush, ActionAll}},
+		{"TestCustomRole", user("ci"), "repository:releases/app:push", ActionSet{ActionPush}},
+		{"TestReplacedDefaultRole", user("bob", "everyone"), "registry:catalog:*,catalog", ActionSet{ActionCatalog}},
+		{"TestRegistryWide", user("bob", "everyone"), "repository:team-b/app:pull,push", ActionSet{ActionPull}},
+		{"TestAdmin", user("root"), "registry:catalog:*", ActionSet{ActionAll}},
+		{"TestNoBindings", user("eve"), "repository:team-a/app:pull", ActionSet{}},
+		{"TestNamespaceNotForRegistry", user("alice", "team-a"), "registry:catalog:*", ActionSet{}},
+		{"TestAnonymous", &AuthorizationRequest{Identity: AnonymousIdentity()}, "repository:team-a/app:pull", ActionSet{}},
+		{"TestAccountWithoutIdentity", &AuthorizationRequest{Account: "ci"}, "repository:releases/app:pull", ActionSet{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, authorizeTestScope(t, a, tt.req, tt.scope))
+		})
+	}
+
+	// Invalid files keep the previous policy, and are logged
+	var logs bytes.Buffer
+	store.SetErrorLog(log.New(&logs, "", 0))
+	writeTestFile(t, path, "bindings:\n  - role: owner\n    user: jens\n")
+	assert.Equal(t, ActionSet{ActionPull}, authorizeTestScope(t, a, user("bob", "everyone"), "repository:team-b/app:pull"))
+	assert.Contains(t, logs.String(), "reloading "+path+" failed")
+	assert.Error(t, store.Reload())
+}
+
+func TestRBACAuthorizer_EffectivePermissions(t *testing.T) {
+	store := NewInMemoryRBACStore()
+	assert.NoError(t, store.AddBinding(RoleBinding{Role: "developer", Group: "team-a", Namespace: "team-a"}))
+	assert.NoError(t, store.AddBinding(RoleBinding{Role: "maintainer", User: "jens", Namespace: "team-a"}))
+	assert.NoError(t, store.AddBinding(RoleBinding{Role: "reader", Group: "everyone"}))
+	assert.NoError(t, store.AddBinding(RoleBinding{Role: "reader", Group: "everyone"}))
+	a := NewRBACAuthorizer(store)
+
+	permissions, err := a.EffectivePermissions(context.Background(), &Identity{Subject: "jens", Groups: []string{"team-a", "everyone"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []*RBACPermission{
+		{Namespace: "", Roles: []string{"reader"}, Actions: ActionSet{ActionPull}},
+		{Namespace: "team-a", Roles: []string{"developer", "maintainer"}, Actions: ActionSet{ActionPull, ActionPush, ActionAll}},
+	}, permissions)
+
+	permissions, err = a.EffectivePermissions(context.Background(), AnonymousIdentity())
+	assert.NoError(t, err)
+	assert.Empty(t, permissions)
+}
+
+func TestInMemoryRBACStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemoryRBACStore()
+	a := NewRBACAuthorizer(store)
+	req := &AuthorizationRequest{Account: "ci", Identity: &Identity{Subject: "ci"}}
+
+	assert.NoError(t, store.SetRole(Role{Name: "pusher", Actions: []string{"push"}}))
+	assert.NoError(t, store.AddBinding(RoleBinding{Role: "pusher", User: "ci", Namespace: "builds"}))
+	assert.Equal(t, ActionSet{ActionPush}, authorizeTestScope(t, a, req, "repository:builds/app:pull,push"))
+
+	// Policies returned earlier are not changed
+	before, err := store.Policy(ctx)
+	assert.NoError(t, err)
+	assert.NoError(t, store.SetRole(Role{Name: "pusher", Actions: []string{"pull", "push"}}))
+	assert.Equal(t, []string{"push"}, before.Roles[0].Actions)
+	assert.Equal(t, ActionSet{ActionPull, ActionPush}, authorizeTestScope(t, a, req, "repository:builds/app:pull,push"))
+
+	// Bound roles can not be deleted
+	assert.Error(t, store.DeleteRole("pusher"))
+	assert.NoError(t, store.RemoveBinding(RoleBinding{Role: "pusher", User: "ci", Namespace: "builds"}))
+	assert.NoError(t, store.DeleteRole("pusher"))
+	assert.Equal(t, ActionSet{}, authorizeTestScope(t, a, req, "repository:builds/app:pull,push"))
+
+	invalid := []error{
+		store.SetRole(Role{Name: "broken", Actions: []string{"delete"}}),
+		store.SetRole(Role{Actions: []string{"pull"}}),
+		store.AddBinding(RoleBinding{Role: "unknown", User: "ci"}),
+		store.AddBinding(RoleBinding{Role: "reader"}),
+		store.AddBinding(RoleBinding{Role: "reader", User: "ci", Group: "ci"}),
+		store.AddBinding(RoleBinding{Role: "reader", User: "ci", Namespace: "team-*"}),
+		store.AddBinding(RoleBinding{Role: "reader", User: "ci", Namespace: "team-a/"}),
+	}
+	for i, err := range invalid {
+		assert.Error(t, err, i)
+	}
+	policy, _ := store.Policy(ctx)
+	assert.Empty(t, policy.Roles)
+	assert.Empty(t, policy.Bindings)
+}
+
+func TestParseRBACPolicy(t *testing.T) {
+	policy, err := ParseRBACPolicy([]byte(`{"bindings": [{"role": "admin", "group": "admins"}]}`), true)
+	assert.NoError(t, err)
+	assert.Len(t, policy.Bindings, 1)
+
+	invalid := []string{
+		"roles:\n  - name: a\n    actions: [pull]\n  - name: a\n    actions: [push]\nbindings: []\n",
+		"bindings:\n  - role: reader\n    users: jens\n",
+	}
+	for _, data := range invalid {
+		_, err := ParseRBACPolicy([]byte(data), false)
+		assert.Error(t, err, data)
+	}
+}
@@ -0,0 +1,181 @@
+package registry
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrRefreshTokenNotFound is returned by a RefreshTokenStore when the refresh token hash is unknown.
+var ErrRefreshTokenNotFound = errors.New("refresh token not found")
+
+// DefaultRefreshTokenExpiresIn is the number of seconds refresh tokens expire after if the RefreshTokenManager is created without expiry, 30 days.
+const DefaultRefreshTokenExpiresIn int64 = 30 * 24 * 60 * 60
+
+// RefreshTokenInfo contains the information a refresh token was issued for.
+type RefreshTokenInfo struct {
+	Account  string
+	ClientId string
+	Service  string
+	IssuedAt int64
+	// ExpiresAt is the unix time the refresh token expires at, zero means the refresh token never expires. Refresh tokens issued by the RefreshTokenManager always expire.
+	ExpiresAt int64
+	// Identity is the identity the refresh token was issued to. The TokenHandler looks up the current identity of its subject on every use, the snapshot only restricts how it is used, like the allowed scopes of an access token.
+	Identity *Identity
+}
+
+// Expired checks if the refresh token has expired at the given time.
+func (i *RefreshTokenInfo) Expired(now time.Time) bool {
+	return i.ExpiresAt != 0 && now.Unix() >= i.ExpiresAt
+}
+
+// RefreshTokenStore is an interface for storing issued refresh tokens. The store only ever receives a hash of the refresh token, never the refresh token itself.
+type RefreshTokenStore interface {
+	// Store stores the info for the given refresh token hash.
+	Store(ctx context.Context, hash string, info *RefreshTokenInfo) error
+	// Get returns the info for the given refresh token hash, or ErrRefreshTokenNotFound if the refresh token hash is unknown.
+	Get(ctx context.Context, hash string) (*RefreshTokenInfo, error)
+	// Delete deletes the given refresh token hash, deleting an unknown hash is not an error.
+	Delete(ctx context.Context, hash string) error
+}
+
+// InMemoryRefreshTokenStore is a RefreshTokenStore that keeps the refresh tokens in memory, refresh tokens are lost when the process exits.
+type InMemoryRefreshTokenStore struct {
+	mu     sync.RWMutex
+	tokens map[string]*RefreshTokenInfo
+}
+
+// NewInMemoryRefreshTokenStore creates a new InMemoryRefreshTokenStore.
+func NewInMemoryRefreshTokenStore() *InMemoryRefreshTokenStore {
+	return &InMemoryRefreshTokenStore{
+		tokens: make(map[string]*RefreshTokenInfo),
+	}
+}
+
+func (s *InMemoryRefreshTokenStore) Store(ctx context.Context, hash string, info *RefreshTokenInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[hash] = info
+	return nil
+}
+
+func (s *InMemoryRefreshTokenStore) Get(ctx context.Context, hash string) (*RefreshTokenInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	info, ok := s.tokens[hash]
+	if !ok {
+		return nil, ErrRefreshTokenNotFound
+	}
+	return info, nil
+}
+
+func (s *InMemoryRefreshTokenStore) Delete(ctx context.Context, hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tokens, hash)
+	return nil
+}
+
+// RefreshTokenManager issues and validates opaque refresh tokens, which are tied to the account, client_id and service they were issued for.
+type RefreshTokenManager struct {
+	store     RefreshTokenStore
+	expiresIn int64
+}
+
+// NewRefreshTokenManager creates a new RefreshTokenManager using the given store. Refresh tokens expire after expiresIn seconds, zero or less means after DefaultRefreshTokenExpiresIn.
+func NewRefreshTokenManager(store RefreshTokenStore, expiresIn int64) *RefreshTokenManager {
+	if expiresIn <= 0 {
+		expiresIn = DefaultRefreshTokenExpiresIn
+	}
+	return &RefreshTokenManager{
+		store:     store,
+		expiresIn: expiresIn,
+	}
+}
+
+// Issue issues a new refresh token for the account, client_id and service of the given request.
+func (m *RefreshTokenManager) Issue(ctx context.Context, req *AuthorizationRequest) (string, error) {
+	if req == nil {
+		return "", fmt.Errorf("request is nil")
+	}
+
+	if req.Account == "" {
+		return "", fmt.Errorf("refresh tokens can only be issued for an account")
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	refreshToken := encodeBase64(raw)
+
+	now := time.Now().Unix()
+	info := &RefreshTokenInfo{
+		Account:   req.Account,
+		ClientId:  req.ClientId,
+		Service:   req.Service,
+		IssuedAt:  now,
+		ExpiresAt: now + m.expiresIn,
+		Identity:  req.Identity,
+	}
+
+	if err := m.store.Store(ctx, hashRefreshToken(refreshToken), info); err != nil {
+		return "", err
+	}
+
+	return refreshToken, nil
+}
+
+// Validate validates the refresh token against the given request and returns the info it was issued with, or an ErrInvalidRefreshToken error. The client_id and service of the request must match the ones the refresh token was issued for, as must the account if the request has one.
+func (m *RefreshTokenManager) Validate(ctx context.Context, refreshToken string, req *AuthorizationRequest) (*RefreshTokenInfo, error) {
+	if refreshToken == "" {
+		return nil, ErrInvalidRequest.WithDetail("refresh token is required")
+	}
+
+	if req == nil {
+		return nil, fmt.Errorf("request is nil")
+	}
+
+	hash := hashRefreshToken(refreshToken)
+	info, err := m.store.Get(ctx, hash)
+	if errors.Is(err, ErrRefreshTokenNotFound) {
+		return nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, ErrUnknown.WithCause(fmt.Errorf("refresh token store: %w", err))
+	}
+
+	if info.Expired(time.Now()) {
+		_ = m.store.Delete(ctx, hash)
+		return nil, ErrInvalidRefreshToken.WithDetail("refresh token has expired")
+	}
+
+	if info.ClientId != req.ClientId {
+		return nil, ErrInvalidRefreshToken.WithDetail("refresh token was issued to a different client")
+	}
+
+	if info.Service != req.Service {
+		return nil, ErrInvalidRefreshToken.WithDetail("refresh token was issued for a different service")
+	}
+
+	if req.Account != "" && info.Account != req.Account {
+		return nil, ErrInvalidRefreshToken.WithDetail("refresh token was issued for a different account")
+	}
+
+	return info, nil
+}
+
+// Revoke revokes the given refresh token.
+func (m *RefreshTokenManager) Revoke(ctx context.Context, refreshToken string) error {
+	return m.store.Delete(ctx, hashRefreshToken(refreshToken))
+}
+
+func hashRefreshToken(refreshToken string) string {
+	sum := sha256.Sum256([]byte(refreshToken))
+	return hex.EncodeToString(sum[:])
+}
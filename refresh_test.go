@@ -0,0 +1,118 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRefreshTokenManager_IssueAndValidate(t *testing.T) {
+	store := NewInMemoryRefreshTokenStore()
+	m := NewRefreshTokenManager(store, 3600)
+	req := &AuthorizationRequest{
+		Account:  "jens",
+		Service:  "registry",
+		ClientId: "docker",
+	}
+
+	refreshToken, err := m.Issue(context.Background(), req)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, refreshToken)
+
+	// The store must never hold the refresh token itself
+	_, err = store.Get(context.Background(), refreshToken)
+	assert.True(t, errors.Is(err, ErrRefreshTokenNotFound))
+
+	info, err := m.Validate(context.Background(), refreshToken, req)
+	assert.NoError(t, err)
+	assert.Equal(t, "jens", info.Account)
+	assert.Equal(t, info.IssuedAt+3600, info.ExpiresAt)
+
+	// The account may be omitted, it is taken from the refresh token
+	_, err = m.Validate(context.Background(), refreshToken, &AuthorizationRequest{Service: "registry", ClientId: "docker"})
+	assert.NoError(t, err)
+}
+
+func TestRefreshTokenManager_ValidateFails(t *testing.T) {
+	m := NewRefreshTokenManager(NewInMemoryRefreshTokenStore(), 0)
+	req := &AuthorizationRequest{
+		Account:  "jens",
+		Service:  "registry",
+		ClientId: "docker",
+	}
+
+	refreshToken, err := m.Issue(context.Background(), req)
+	assert.NoError(t, err)
+
+	// Refresh tokens expire by default
+	info, err := m.Validate(context.Background(), refreshToken, req)
+	assert.NoError(t, err)
+	assert.Equal(t, info.IssuedAt+DefaultRefreshTokenExpiresIn, info.ExpiresAt)
+
+	tests := []struct {
+		name         string
+		refreshToken string
+		req          *AuthorizationRequest
+	}{
+		{"TestEmpty", "", req},
+		{"TestUnknown", "unknown", req},
+		{"TestOtherAccount", refreshToken, &AuthorizationRequest{Account: "other", Service: "registry", ClientId: "docker"}},
+		{"TestOtherService", refreshToken, &AuthorizationRequest{Account: "jens", Service: "other", ClientId: "docker"}},
+		{"TestOtherClient", refreshToken, &AuthorizationRequest{Account: "jens", Service: "registry", ClientId: "other"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := m.Validate(context.Background(), tt.refreshToken, tt.req)
+			assert.Error(t, err)
+		})
+	}
+
+	assert.NoError(t, m.Revoke(context.Background(), refreshToken))
+	_, err = m.Validate(context.Background(), refreshToken, req)
+	assert.Equal(t, ErrInvalidRefreshToken, err)
+}
+
+// failingRefreshTokenStore is a RefreshTokenStore whose database is down.
+type failingRefreshTokenStore struct {
+	InMemoryRefreshTokenStore
+}
+
+func (s *failingRefreshTokenStore) Get(ctx context.Context, hash string) (*RefreshTokenInfo, error) {
+	return nil, errors.New("dial tcp 192.0.2.1:5432: connection refused")
+}
+
+func TestRefreshTokenManager_ValidateStoreError(t *testing.T) {
+	m := NewRefreshTokenManager(&failingRefreshTokenStore{}, 0)
+
+	// An unavailable store is not an invalid refresh token, and its error is not sent to the client
+	_, err := m.Validate(context.Background(), "refresh", &AuthorizationRequest{Service: "registry"})
+	assert.True(t, errors.Is(err, ErrUnknown))
+	assert.Empty(t, err.(*Error).Detail)
+}
+
+func TestRefreshTokenManager_ValidateExpired(t *testing.T) {
+	store := NewInMemoryRefreshTokenStore()
+	m := NewRefreshTokenManager(store, 3600)
+	req := &AuthorizationRequest{
+		Account:  "jens",
+		Service:  "registry",
+		ClientId: "docker",
+	}
+
+	refreshToken, err := m.Issue(context.Background(), req)
+	assert.NoError(t, err)
+
+	info, err := store.Get(context.Background(), hashRefreshToken(refreshToken))
+	assert.NoError(t, err)
+	info.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+
+	_, err = m.Validate(context.Background(), refreshToken, req)
+	assert.Error(t, err)
+
+	// Expired refresh tokens are removed from the store
+	_, err = store.Get(context.Background(), hashRefreshToken(refreshToken))
+	assert.Error(t, err)
+}
@@ -0,0 +1,115 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"gopkg.in/yaml.v3"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileReloader loads a file and loads it again when its modification time or size changes, so configuration files can be edited without restarting the server.
+type fileReloader struct {
+	path string
+	// load parses the file contents and swaps them in. If it returns an error, the previously loaded contents must be kept.
+	load func(data []byte) error
+
+	mu     sync.Mutex
+	loaded bool
+	// modTime and size are of the file at the last attempt to load it, err is the error of that attempt. missing is set while the file can not be found.
+	modTime time.Time
+	size    int64
+	err     error
+	missing bool
+	// errorLog logs the failures of refresh, if nil the standard logger of the log package is used.
+	errorLog *log.Logger
+}
+
+func newFileReloader(path string, load func(data []byte) error) *fileReloader {
+	return &fileReloader{
+		path: path,
+		load: load,
+	}
+}
+
+// reload loads the file if it has changed since the last attempt to load it. If that attempt failed, its error is returned until the file changes again, so a broken file is not read and parsed over and over.
+func (r *fileReloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, err := r.attempt()
+	return err
+}
+
+// refresh loads the file if it has changed, before it is used for a request. A broken file must not fail every request, so the previously loaded contents stay in use and the error is logged instead, once per change of the file.
+func (r *fileReloader) refresh() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if attempted, err := r.attempt(); attempted && err != nil {
+		logger := r.errorLog
+		if logger == nil {
+			logger = log.Default()
+		}
+		logger.Printf("registry: reloading %s failed, keeping the previously loaded contents: %v", r.path, err)
+	}
+}
+
+// setErrorLog sets the logger for the failures of refresh.
+func (r *fileReloader) setErrorLog(logger *log.Logger) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.errorLog = logger
+}
+
+// attempt loads the file if it has changed and reports if it did try to. It must be called with mu held.
+func (r *fileReloader) attempt() (bool, error) {
+	info, err := os.Stat(r.path)
+	if err != nil {
+		attempted := !r.missing
+		r.missing = true
+		return attempted, err
+	}
+	r.missing = false
+
+	if (r.loaded || r.err != nil) && info.ModTime().Equal(r.modTime) && info.Size() == r.size {
+		return false, r.err
+	}
+
+	data, err := os.ReadFile(r.path)
+	if err == nil {
+		err = r.load(data)
+	}
+
+	r.modTime = info.ModTime()
+	r.size = info.Size()
+	r.err = err
+	if err == nil {
+		r.loaded = true
+	}
+	return true, err
+}
+
+// unmarshalConfig unmarshals a configuration file, which is JSON when isJSON is true and YAML otherwise. Unknown fields are rejected, so typos in the file do not go unnoticed. An empty YAML file leaves v untouched.
+func unmarshalConfig(data []byte, isJSON bool, v interface{}) error {
+	if isJSON {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		return decoder.Decode(v)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(v); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+func isJSONPath(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".json")
+}
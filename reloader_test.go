@@ -0,0 +1,102 @@
+package registry
+
+import (
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileReloader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	assert.NoError(t, os.WriteFile(path, []byte("first"), 0600))
+
+	var loaded []string
+	r := newFileReloader(path, func(data []byte) error {
+		if string(data) == "invalid" {
+			return errors.New("invalid contents")
+		}
+		loaded = append(loaded, string(data))
+		return nil
+	})
+
+	assert.NoError(t, r.reload())
+	assert.NoError(t, r.reload())
+	assert.Equal(t, []string{"first"}, loaded)
+
+	assert.NoError(t, os.WriteFile(path, []byte("second"), 0600))
+	assert.NoError(t, r.reload())
+	assert.Equal(t, []string{"first", "second"}, loaded)
+
+	// A failed load is not retried until the file changes again
+	var attempts int
+	load := r.load
+	r.load = func(data []byte) error {
+		attempts++
+		return load(data)
+	}
+	assert.NoError(t, os.WriteFile(path, []byte("invalid"), 0600))
+	assert.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)))
+	assert.Error(t, r.reload())
+	assert.Error(t, r.reload())
+	assert.Equal(t, 1, attempts)
+	assert.Equal(t, []string{"first", "second"}, loaded)
+
+	assert.NoError(t, os.WriteFile(path, []byte("third"), 0600))
+	assert.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(2*time.Minute)))
+	assert.NoError(t, r.reload())
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, []string{"first", "second", "third"}, loaded)
+
+	assert.NoError(t, os.Remove(path))
+	assert.Error(t, r.reload())
+}
+
+func TestFileReloader_Refresh(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	assert.NoError(t, os.WriteFile(path, []byte("first"), 0600))
+
+	loaded := ""
+	r := newFileReloader(path, func(data []byte) error {
+		if string(data) == "invalid" {
+			return errors.New("invalid contents")
+		}
+		loaded = string(data)
+		return nil
+	})
+	var logs bytes.Buffer
+	r.setErrorLog(log.New(&logs, "", 0))
+
+	r.refresh()
+	assert.Equal(t, "first", loaded)
+	assert.Empty(t, logs.String())
+
+	// Failures are logged once per change of the file, and the previous contents are kept
+	assert.NoError(t, os.WriteFile(path, []byte("invalid"), 0600))
+	assert.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)))
+	r.refresh()
+	r.refresh()
+	assert.Equal(t, "first", loaded)
+	assert.Equal(t, 1, strings.Count(logs.String(), "invalid contents"))
+
+	assert.NoError(t, os.Remove(path))
+	r.refresh()
+	r.refresh()
+	assert.Equal(t, 1, strings.Count(logs.String(), "no such file"))
+
+	assert.NoError(t, os.WriteFile(path, []byte("invalid"), 0600))
+	assert.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(2*time.Minute)))
+	r.refresh()
+	assert.Equal(t, 2, strings.Count(logs.String(), "invalid contents"))
+
+	assert.NoError(t, os.WriteFile(path, []byte("second"), 0600))
+	assert.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(3*time.Minute)))
+	r.refresh()
+	assert.Equal(t, "second", loaded)
+	assert.Equal(t, 3, strings.Count(logs.String(), "\n"))
+}
@@ -0,0 +1,118 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// RequestMetadata contains metadata of the HTTP request a token was requested with. The TokenHandler attaches it to the context passed to the Authenticator and Authorizer.
+type RequestMetadata struct {
+	// IP is the client IP, see ClientIP.
+	IP string
+	// RemoteAddr is the network address of the direct peer, which is a proxy if the request was forwarded.
+	RemoteAddr string
+	UserAgent  string
+	// Header contains the request headers, without the Authorization header.
+	Header http.Header
+}
+
+type requestMetadataKey struct{}
+
+// WithRequestMetadata returns a copy of the context holding the given RequestMetadata.
+func WithRequestMetadata(ctx context.Context, md *RequestMetadata) context.Context {
+	return context.WithValue(ctx, requestMetadataKey{}, md)
+}
+
+// RequestMetadataFromContext returns the RequestMetadata held by the context, if any.
+func RequestMetadataFromContext(ctx context.Context) (*RequestMetadata, bool) {
+	md, ok := ctx.Value(requestMetadataKey{}).(*RequestMetadata)
+	return md, ok
+}
+
+// NewRequestMetadata creates the RequestMetadata for the given request, resolving the client IP with the given trusted proxies.
+func NewRequestMetadata(r *http.Request, trustedProxies []*net.IPNet) *RequestMetadata {
+	header := r.Header.Clone()
+	header.Del("Authorization")
+
+	return &RequestMetadata{
+		IP:         ClientIP(r, trustedProxies),
+		RemoteAddr: r.RemoteAddr,
+		UserAgent:  r.UserAgent(),
+		Header:     header,
+	}
+}
+
+// ParseTrustedProxies parses a slice of IP addresses and CIDR ranges into networks usable by ClientIP. If any of the strings is not a valid IP or CIDR, an error is returned.
+func ParseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, len(proxies))
+	for i, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy: %s", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			nets[i] = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy: %s", proxy)
+		}
+		nets[i] = ipNet
+	}
+	return nets, nil
+}
+
+// ClientIP returns the IP of the client that made the request. The X-Forwarded-For and X-Real-IP headers are only used when the request comes from one of the trusted proxies, otherwise the IP of RemoteAddr is returned. X-Forwarded-For is read from right to left, skipping trusted proxies, so a client can not spoof its IP by sending the header itself.
+func ClientIP(r *http.Request, trustedProxies []*net.IPNet) string {
+	remoteIP := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		remoteIP = host
+	}
+
+	if !isTrustedProxy(remoteIP, trustedProxies) {
+		return remoteIP
+	}
+
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				// An invalid hop can not be trusted, so neither can anything to the left of it.
+				break
+			}
+			if i == 0 || !isTrustedProxy(hop, trustedProxies) {
+				return hop
+			}
+		}
+	}
+
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(realIP) != nil {
+		return realIP
+	}
+
+	return remoteIP
+}
+
+func isTrustedProxy(ip string, trustedProxies []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, proxy := range trustedProxies {
+		if proxy.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
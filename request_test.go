@@ -0,0 +1,83 @@
+package registry
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	nets, err := ParseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1", "::1"})
+	assert.NoError(t, err)
+	assert.Len(t, nets, 3)
+	assert.Equal(t, "10.0.0.0/8", nets[0].String())
+	assert.Equal(t, "192.168.1.1/32", nets[1].String())
+	assert.Equal(t, "::1/128", nets[2].String())
+
+	_, err = ParseTrustedProxies([]string{"10.0.0.0/33"})
+	assert.Error(t, err)
+
+	_, err = ParseTrustedProxies([]string{"proxy"})
+	assert.Error(t, err)
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, err := ParseTrustedProxies([]string{"10.0.0.0/8"})
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        string
+		realIP     string
+		want       string
+	}{
+		{"TestNoProxy", "1.2.3.4:1234", "", "", "1.2.3.4"},
+		{"TestUntrustedProxy", "1.2.3.4:1234", "5.6.7.8", "5.6.7.8", "1.2.3.4"},
+		{"TestTrustedProxy", "10.0.0.1:1234", "5.6.7.8", "", "5.6.7.8"},
+		{"TestTrustedProxyChain", "10.0.0.1:1234", "5.6.7.8, 10.0.0.2", "", "5.6.7.8"},
+		{"TestSpoofedHop", "10.0.0.1:1234", "9.9.9.9, 5.6.7.8", "", "5.6.7.8"},
+		{"TestAllTrusted", "10.0.0.1:1234", "10.0.0.3, 10.0.0.2", "", "10.0.0.3"},
+		{"TestRealIP", "10.0.0.1:1234", "", "5.6.7.8", "5.6.7.8"},
+		{"TestInvalidHeaders", "10.0.0.1:1234", "garbage", "garbage", "10.0.0.1"},
+		{"TestIPv6", "[::1]:1234", "", "", "::1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.xff != "" {
+				req.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			if tt.realIP != "" {
+				req.Header.Set("X-Real-IP", tt.realIP)
+			}
+
+			assert.Equal(t, tt.want, ClientIP(req, trusted))
+		})
+	}
+}
+
+func TestRequestMetadataContext(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "1.2.3.4:1234"
+	req.Header.Set("User-Agent", "docker/24.0.0")
+	req.SetBasicAuth("jens", "secret")
+
+	_, ok := RequestMetadataFromContext(context.Background())
+	assert.False(t, ok)
+
+	ctx := WithRequestMetadata(context.Background(), NewRequestMetadata(req, nil))
+	md, ok := RequestMetadataFromContext(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, "1.2.3.4", md.IP)
+	assert.Equal(t, "1.2.3.4:1234", md.RemoteAddr)
+	assert.Equal(t, "docker/24.0.0", md.UserAgent)
+	assert.Empty(t, md.Header.Get("Authorization"))
+
+	// The request itself must keep its Authorization header
+	assert.NotEmpty(t, req.Header.Get("Authorization"))
+}
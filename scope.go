@@ -49,21 +49,21 @@ type Scope struct {
 	Actions ActionSet
 }
 
-// ParseScope parses a string into a Scope. If the string is not a valid scope, an error is returned.
+// ParseScope parses a string into a Scope. If the string is not a valid scope, an ErrInvalidScope error is returned.
 func ParseScope(scope string) (*Scope, error) {
 	parts := strings.Split(scope, ":")
 	if len(parts) != 3 {
-		return nil, fmt.Errorf("invalid scope: %s", scope)
+		return nil, ErrInvalidScope.WithDetail(scope)
 	}
 
 	scopeType, err := ParseScopeType(parts[0])
 	if err != nil {
-		return nil, err
+		return nil, ErrInvalidScope.WithDetail(err.Error())
 	}
 
 	parsedActions, err := ParseActions(strings.Split(parts[2], ","))
 	if err != nil {
-		return nil, err
+		return nil, ErrInvalidScope.WithDetail(err.Error())
 	}
 
 	return &Scope{
@@ -72,3 +72,26 @@ func ParseScope(scope string) (*Scope, error) {
 		Actions: parsedActions,
 	}, nil
 }
+
+// ParseScopes parses a slice of strings into a slice of Scopes. If any of the strings are not valid scopes, an error is returned.
+func ParseScopes(scopes []string) ([]*Scope, error) {
+	parsed := make([]*Scope, len(scopes))
+	for i, scope := range scopes {
+		s, err := ParseScope(scope)
+		if err != nil {
+			return nil, err
+		}
+		parsed[i] = s
+	}
+	return parsed, nil
+}
+
+// String returns the string representation of a Scope, in the same format that ParseScope accepts.
+func (s *Scope) String() string {
+	return fmt.Sprintf("%s:%s:%s", s.Type, s.Name, strings.Join(s.Actions.ToStrings(), ","))
+}
+
+// Matches checks if the Scope refers to the same resource (type and name) as the given Scope.
+func (s *Scope) Matches(other *Scope) bool {
+	return s.Type == other.Type && s.Name == other.Name
+}
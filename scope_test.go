@@ -1,6 +1,9 @@
 package registry
 
-import "testing"
+import (
+	"errors"
+	"testing"
+)
 
 func TestParseScope(t *testing.T) {
 	tests := []struct {
@@ -80,3 +83,37 @@ func TestFailParseScope(t *testing.T) {
 		})
 	}
 }
+
+func TestParseScopes(t *testing.T) {
+	got, err := ParseScopes([]string{"repository:foo/bar:pull", "registry:catalog:*"})
+	if err != nil {
+		t.Errorf("ParseScopes() error = %v", err)
+		return
+	}
+
+	if len(got) != 2 {
+		t.Errorf("ParseScopes() got %d scopes, want 2", len(got))
+		return
+	}
+
+	if got[0].String() != "repository:foo/bar:pull" {
+		t.Errorf("ParseScopes() got[0] = %v, want repository:foo/bar:pull", got[0])
+	}
+
+	if got[1].String() != "registry:catalog:*" {
+		t.Errorf("ParseScopes() got[1] = %v, want registry:catalog:*", got[1])
+	}
+
+	if _, err := ParseScopes([]string{"repository:foo/bar:pull", "repository:foo/bar"}); err == nil {
+		t.Errorf("ParseScopes() error = nil, want error")
+	}
+}
+
+func TestParseScopeReturnsInvalidScope(t *testing.T) {
+	for _, rawScope := range []string{"repository:foo/bar", "non:foo/bar:pull", "repository:foo/bar:unknown"} {
+		_, err := ParseScope(rawScope)
+		if !errors.Is(err, ErrInvalidScope) {
+			t.Errorf("ParseScope(%q) error = %v, want ErrInvalidScope", rawScope, err)
+		}
+	}
+}
@@ -0,0 +1,422 @@
+package registry
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SQLDialect contains the differences between the databases supported by the SQLUserStore.
+type SQLDialect struct {
+	Name string
+	// numberedPlaceholders makes queries use $1, $2, ... instead of ?.
+	numberedPlaceholders bool
+	// migrationLock is run at the start of the migration transaction, to keep other instances from migrating at the same time. SQLite allows only one writer at a time, so it needs no lock.
+	migrationLock string
+}
+
+var (
+	SQLiteDialect = &SQLDialect{Name: "sqlite"}
+	// The key of the advisory lock is an arbitrary constant, shared by every instance migrating the same database.
+	PostgresDialect = &SQLDialect{Name: "postgres", numberedPlaceholders: true, migrationLock: `SELECT pg_advisory_xact_lock(5927163804)`}
+)
+
+// rebind rewrites the ? placeholders of a query into the placeholders of the dialect.
+func (d *SQLDialect) rebind(query string) string {
+	if !d.numberedPlaceholders {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// sqlMigrations are the schema migrations of the SQLUserStore, the version of a migration is its index plus one. Migrations must never be changed once released, only appended to.
+var sqlMigrations = []string{
+	`CREATE TABLE registry_users (
+		username      VARCHAR(255) PRIMARY KEY,
+		display_name  VARCHAR(255) NOT NULL DEFAULT '',
+		password_hash VARCHAR(255) NOT NULL,
+		disabled      BOOLEAN NOT NULL DEFAULT FALSE,
+		expires_at    BIGINT NULL,
+		created_at    BIGINT NOT NULL,
+		updated_at    BIGINT NOT NULL
+	)`,
+	`CREATE TABLE registry_user_groups (
+		username   VARCHAR(255) NOT NULL REFERENCES registry_users (username) ON DELETE CASCADE,
+		group_name VARCHAR(255) NOT NULL,
+		PRIMARY KEY (username, group_name)
+	)`,
+}
+
+// User is a user of the SQLUserStore.
+type User struct {
+	Username    string
+	DisplayName string
+	Groups      []string
+	Disabled    bool
+	// ExpiresAt is the time the account expires at, the zero time means the account never expires.
+	ExpiresAt time.Time
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Expired checks if the account has expired at the given time.
+func (u *User) Expired(now time.Time) bool {
+	return !u.ExpiresAt.IsZero() && !now.Before(u.ExpiresAt)
+}
+
+// SQLUserStore stores users, password hashes and group memberships in a database. Run Migrate before using it, to create or update the schema.
+type SQLUserStore struct {
+	db      *sql.DB
+	dialect *SQLDialect
+}
+
+// NewSQLUserStore creates a new SQLUserStore for the given database, which must be of the given dialect.
+func NewSQLUserStore(db *sql.DB, dialect *SQLDialect) *SQLUserStore {
+	return &SQLUserStore{
+		db:      db,
+		dialect: dialect,
+	}
+}
+
+// Migrate applies the schema migrations that have not been applied yet. Reading the current version and applying the migrations happens in one transaction, so instances starting at the same time do not apply a migration twice, and a failing migration leaves the schema unchanged.
+func (s *SQLUserStore) Migrate(ctx context.Context) error {
+	return s.transaction(ctx, func(tx *sql.Tx) error {
+		if s.dialect.migrationLock != "" {
+			if _, err := tx.ExecContext(ctx, s.dialect.migrationLock); err != nil {
+				return err
+			}
+		}
+
+		if _, err := tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS registry_schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+			return err
+		}
+
+		var current int
+		if err := tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM registry_schema_migrations`).Scan(&current); err != nil {
+			return err
+		}
+
+		for version := current + 1; version <= len(sqlMigrations); version++ {
+			if _, err := tx.ExecContext(ctx, sqlMigrations[version-1]); err != nil {
+				return fmt.Errorf("migration %d: %w", version, err)
+			}
+			if _, err := tx.ExecContext(ctx, s.dialect.rebind(`INSERT INTO registry_schema_migrations (version) VALUES (?)`), version); err != nil {
+				return fmt.Errorf("migration %d: %w", version, err)
+			}
+		}
+		return nil
+	})
+}
+
+// CreateUser creates the user with the given password, which is hashed with HashPassword.
+func (s *SQLUserStore) CreateUser(ctx context.Context, user *User, password string) error {
+	if user.Username == "" {
+		return fmt.Errorf("username is required")
+	}
+
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	return s.transaction(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, s.dialect.rebind(`INSERT INTO registry_users (username, display_name, password_hash, disabled, expires_at, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)`),
+			user.Username, user.DisplayName, hash, user.Disabled, nullUnix(user.ExpiresAt), now.Unix(), now.Unix())
+		if err != nil {
+			return err
+		}
+		return s.setGroups(ctx, tx, user.Username, user.Groups)
+	})
+}
+
+// GetUser returns the user with the given username. If the user does not exist, ErrUnknownUser is returned.
+func (s *SQLUserStore) GetUser(ctx context.Context, username string) (*User, error) {
+	user, _, err := s.getUser(ctx, username)
+	return user, err
+}
+
+// ListUsers returns all users, ordered by username.
+func (s *SQLUserStore) ListUsers(ctx context.Context) ([]*User, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT username, display_name, disabled, expires_at, created_at, updated_at FROM registry_users ORDER BY username`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []*User
+	byName := make(map[string]*User)
+	for rows.Next() {
+		user, _, err := scanUser(rows, false)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+		byName[user.Username] = user
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	groups, err := s.db.QueryContext(ctx, `SELECT username, group_name FROM registry_user_groups ORDER BY group_name`)
+	if err != nil {
+		return nil, err
+	}
+	defer groups.Close()
+
+	for groups.Next() {
+		var username, group string
+		if err := groups.Scan(&username, &group); err != nil {
+			return nil, err
+		}
+		if user, ok := byName[username]; ok {
+			user.Groups = append(user.Groups, group)
+		}
+	}
+	return users, groups.Err()
+}
+
+// UpdateUser updates the display name, disabled flag, expiry and groups of the user. If the user does not exist, ErrUnknownUser is returned.
+func (s *SQLUserStore) UpdateUser(ctx context.Context, user *User) error {
+	return s.transaction(ctx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, s.dialect.rebind(`UPDATE registry_users SET display_name = ?, disabled = ?, expires_at = ?, updated_at = ? WHERE username = ?`),
+			user.DisplayName, user.Disabled, nullUnix(user.ExpiresAt), time.Now().Unix(), user.Username)
+		if err := requireAffected(result, err); err != nil {
+			return err
+		}
+		return s.setGroups(ctx, tx, user.Username, user.Groups)
+	})
+}
+
+// SetPassword sets the password of the user, which is hashed with HashPassword. If the user does not exist, ErrUnknownUser is returned.
+func (s *SQLUserStore) SetPassword(ctx context.Context, username, password string) error {
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	return s.SetPasswordHash(ctx, username, hash)
+}
+
+// SetPasswordHash sets the password hash of the user, which must be in a format supported by VerifyPassword. If the user does not exist, ErrUnknownUser is returned.
+func (s *SQLUserStore) SetPasswordHash(ctx context.Context, username, hash string) error {
+	if err := checkPasswordHash(hash); err != nil {
+		return err
+	}
+
+	result, err := s.db.ExecContext(ctx, s.dialect.rebind(`UPDATE registry_users SET password_hash = ?, updated_at = ? WHERE username = ?`),
+		hash, time.Now().Unix(), username)
+	return requireAffected(result, err)
+}
+
+// DeleteUser deletes the user and its group memberships. If the user does not exist, ErrUnknownUser is returned.
+func (s *SQLUserStore) DeleteUser(ctx context.Context, username string) error {
+	return s.transaction(ctx, func(tx *sql.Tx) error {
+		// Foreign keys are not enforced by SQLite by default, so the memberships are deleted explicitly.
+		if _, err := tx.ExecContext(ctx, s.dialect.rebind(`DELETE FROM registry_user_groups WHERE username = ?`), username); err != nil {
+			return err
+		}
+		result, err := tx.ExecContext(ctx, s.dialect.rebind(`DELETE FROM registry_users WHERE username = ?`), username)
+		return requireAffected(result, err)
+	})
+}
+
+// AddUserToGroup adds the user to the group, adding a user to a group it is already a member of is not an error. If the user does not exist, ErrUnknownUser is returned.
+func (s *SQLUserStore) AddUserToGroup(ctx context.Context, username, group string) error {
+	user, err := s.GetUser(ctx, username)
+	if err != nil {
+		return err
+	}
+	if containsString(user.Groups, group) {
+		return nil
+	}
+
+	_, err = s.db.ExecContext(ctx, s.dialect.rebind(`INSERT INTO registry_user_groups (username, group_name) VALUES (?, ?)`), username, group)
+	return err
+}
+
+// RemoveUserFromGroup removes the user from the group, removing a user from a group it is not a member of is not an error.
+func (s *SQLUserStore) RemoveUserFromGroup(ctx context.Context, username, group string) error {
+	_, err := s.db.ExecContext(ctx, s.dialect.rebind(`DELETE FROM registry_user_groups WHERE username = ? AND group_name = ?`), username, group)
+	return err
+}
+
+// getUser returns the user and its password hash.
+func (s *SQLUserStore) getUser(ctx context.Context, username string) (*User, string, error) {
+	row := s.db.QueryRowContext(ctx, s.dialect.rebind(`SELECT username, display_name, disabled, expires_at, created_at, updated_at, password_hash FROM registry_users WHERE username = ?`), username)
+	user, hash, err := scanUser(row, true)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, "", ErrUnknownUser
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind(`SELECT group_name FROM registry_user_groups WHERE username = ? ORDER BY group_name`), username)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var group string
+		if err := rows.Scan(&group); err != nil {
+			return nil, "", err
+		}
+		user.Groups = append(user.Groups, group)
+	}
+	return user, hash, rows.Err()
+}
+
+func (s *SQLUserStore) setGroups(ctx context.Context, tx *sql.Tx, username string, groups []string) error {
+	if _, err := tx.ExecContext(ctx, s.dialect.rebind(`DELETE FROM registry_user_groups WHERE username = ?`), username); err != nil {
+		return err
+	}
+
+	unique := make([]string, 0, len(groups))
+	for _, group := range groups {
+		if group == "" {
+			return fmt.Errorf("group name is required")
+		}
+		if !containsString(unique, group) {
+			unique = append(unique, group)
+		}
+	}
+	sort.Strings(unique)
+
+	for _, group := range unique {
+		if _, err := tx.ExecContext(ctx, s.dialect.rebind(`INSERT INTO registry_user_groups (username, group_name) VALUES (?, ?)`), username, group); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLUserStore) transaction(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanUser(row rowScanner, withHash bool) (*User, string, error) {
+	var user User
+	var hash string
+	var expiresAt sql.NullInt64
+	var createdAt, updatedAt int64
+
+	dest := []interface{}{&user.Username, &user.DisplayName, &user.Disabled, &expiresAt, &createdAt, &updatedAt}
+	if withHash {
+		dest = append(dest, &hash)
+	}
+	if err := row.Scan(dest...); err != nil {
+		return nil, "", err
+	}
+
+	if expiresAt.Valid {
+		user.ExpiresAt = time.Unix(expiresAt.Int64, 0)
+	}
+	user.CreatedAt = time.Unix(createdAt, 0)
+	user.UpdatedAt = time.Unix(updatedAt, 0)
+	return &user, hash, nil
+}
+
+func requireAffected(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrUnknownUser
+	}
+	return nil
+}
+
+func nullUnix(t time.Time) sql.NullInt64 {
+	if t.IsZero() {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: t.Unix(), Valid: true}
+}
+
+// SQLAuthenticator is an authenticator for the users in an SQLUserStore. Disabled and expired users can not authenticate.
+type SQLAuthenticator struct {
+	store *SQLUserStore
+}
+
+// NewSQLAuthenticator creates a new SQLAuthenticator for the given store.
+func NewSQLAuthenticator(store *SQLUserStore) *SQLAuthenticator {
+	return &SQLAuthenticator{store: store}
+}
+
+// AuthenticateIdentity authenticates the user against the store. The groups of the user are part of the identity.
+func (a *SQLAuthenticator) AuthenticateIdentity(ctx context.Context, user string, pass string) (*Identity, error) {
+	u, hash, err := a.store.getUser(ctx, user)
+	if errors.Is(err, ErrUnknownUser) {
+		spendPasswordVerification(pass)
+		return nil, ErrUnknownUser
+	}
+	if err != nil {
+		return nil, ErrUnknown.WithCause(fmt.Errorf("sql: %w", err))
+	}
+
+	if valid, err := VerifyPassword(hash, pass); err != nil || !valid || u.Disabled || u.Expired(time.Now()) {
+		return nil, ErrInvalidCredentials
+	}
+
+	return u.identity(), nil
+}
+
+// LookupIdentity returns the current identity of the user in the store. Disabled and expired users are not found.
+func (a *SQLAuthenticator) LookupIdentity(ctx context.Context, subject string) (*Identity, error) {
+	u, _, err := a.store.getUser(ctx, subject)
+	if errors.Is(err, ErrUnknownUser) {
+		return nil, ErrUnknownUser
+	}
+	if err != nil {
+		return nil, ErrUnknown.WithCause(fmt.Errorf("sql: %w", err))
+	}
+
+	if u.Disabled || u.Expired(time.Now()) {
+		return nil, ErrUnknownUser
+	}
+	return u.identity(), nil
+}
+
+func (u *User) identity() *Identity {
+	return &Identity{
+		Subject:     u.Username,
+		DisplayName: u.DisplayName,
+		Groups:      u.Groups,
+		Method:      AuthMethodPassword,
+	}
+}
@@ -0,0 +1,12 @@
+package registry
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSQLDialectRebind(t *testing.T) {
+	query := "SELECT * FROM registry_users WHERE username = ? AND disabled = ?"
+	assert.Equal(t, query, SQLiteDialect.rebind(query))
+	assert.Equal(t, "SELECT * FROM registry_users WHERE username = $1 AND disabled = $2", PostgresDialect.rebind(query))
+}
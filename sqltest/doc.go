@@ -0,0 +1,2 @@
+// Package sqltest tests the SQLUserStore of the registry package against SQLite. It is a separate module, so the root module does not depend on the cgo SQLite driver.
+package sqltest
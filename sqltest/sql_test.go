@@ -0,0 +1,149 @@
+package sqltest
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	registry "github.com/JensvandeWiel/docker-reg-auth"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func newTestSQLUserStore(t *testing.T) (*sql.DB, *registry.SQLUserStore) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	assert.NoError(t, err)
+	// Every connection to :memory: is a separate database
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { _ = db.Close() })
+
+	store := registry.NewSQLUserStore(db, registry.SQLiteDialect)
+	assert.NoError(t, store.Migrate(context.Background()))
+	return db, store
+}
+
+func TestSQLUserStoreMigrate(t *testing.T) {
+	db, store := newTestSQLUserStore(t)
+
+	var version, count int
+	assert.NoError(t, db.QueryRow(`SELECT MAX(version), COUNT(*) FROM registry_schema_migrations`).Scan(&version, &count))
+	assert.Greater(t, version, 0)
+	assert.Equal(t, version, count)
+
+	// Migrating again is a no-op
+	assert.NoError(t, store.Migrate(context.Background()))
+	assert.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM registry_schema_migrations`).Scan(&count))
+	assert.Equal(t, version, count)
+}
+
+func TestSQLUserStore(t *testing.T) {
+	ctx := context.Background()
+	db, store := newTestSQLUserStore(t)
+
+	assert.NoError(t, store.CreateUser(ctx, &registry.User{Username: "jens", DisplayName: "Jens", Groups: []string{"developers", "admins", "developers"}}, "secret"))
+	assert.NoError(t, store.CreateUser(ctx, &registry.User{Username: "alice"}, "secret"))
+	assert.Error(t, store.CreateUser(ctx, &registry.User{Username: "jens"}, "secret"))
+	assert.Error(t, store.CreateUser(ctx, &registry.User{}, "secret"))
+
+	user, err := store.GetUser(ctx, "jens")
+	assert.NoError(t, err)
+	assert.Equal(t, "Jens", user.DisplayName)
+	assert.Equal(t, []string{"admins", "developers"}, user.Groups)
+	assert.True(t, user.ExpiresAt.IsZero())
+	assert.False(t, user.CreatedAt.IsZero())
+
+	users, err := store.ListUsers(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, users, 2)
+	assert.Equal(t, "alice", users[0].Username)
+	assert.Equal(t, []string{"admins", "developers"}, users[1].Groups)
+
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	user.Groups = []string{"developers"}
+	user.Disabled = true
+	user.ExpiresAt = expiresAt
+	assert.NoError(t, store.UpdateUser(ctx, user))
+	user, err = store.GetUser(ctx, "jens")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"developers"}, user.Groups)
+	assert.True(t, user.Disabled)
+	assert.True(t, expiresAt.Equal(user.ExpiresAt))
+
+	assert.NoError(t, store.AddUserToGroup(ctx, "jens", "admins"))
+	assert.NoError(t, store.AddUserToGroup(ctx, "jens", "admins"))
+	assert.NoError(t, store.RemoveUserFromGroup(ctx, "jens", "developers"))
+	user, err = store.GetUser(ctx, "jens")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"admins"}, user.Groups)
+
+	assert.Error(t, store.SetPasswordHash(ctx, "jens", "secret"))
+	assert.NoError(t, store.SetPasswordHash(ctx, "jens", "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ="))
+
+	assert.NoError(t, store.DeleteUser(ctx, "jens"))
+	_, err = store.GetUser(ctx, "jens")
+	assert.True(t, errors.Is(err, registry.ErrUnknownUser))
+
+	var memberships int
+	assert.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM registry_user_groups WHERE username = 'jens'`).Scan(&memberships))
+	assert.Equal(t, 0, memberships)
+
+	for _, err := range []error{
+		store.DeleteUser(ctx, "jens"),
+		store.UpdateUser(ctx, &registry.User{Username: "jens"}),
+		store.SetPassword(ctx, "jens", "secret"),
+		store.AddUserToGroup(ctx, "jens", "admins"),
+	} {
+		assert.True(t, errors.Is(err, registry.ErrUnknownUser), "error = %v", err)
+	}
+}
+
+func TestSQLAuthenticator(t *testing.T) {
+	ctx := context.Background()
+	_, store := newTestSQLUserStore(t)
+	a := registry.NewSQLAuthenticator(store)
+
+	assert.NoError(t, store.CreateUser(ctx, &registry.User{Username: "jens", DisplayName: "Jens", Groups: []string{"developers"}}, "secret"))
+	assert.NoError(t, store.CreateUser(ctx, &registry.User{Username: "disabled", Disabled: true}, "secret"))
+	assert.NoError(t, store.CreateUser(ctx, &registry.User{Username: "expired", ExpiresAt: time.Now().Add(-time.Minute)}, "secret"))
+
+	identity, err := a.AuthenticateIdentity(ctx, "jens", "secret")
+	assert.NoError(t, err)
+	assert.Equal(t, "jens", identity.Subject)
+	assert.Equal(t, "Jens", identity.DisplayName)
+	assert.Equal(t, []string{"developers"}, identity.Groups)
+
+	tests := []struct {
+		name string
+		user string
+		pass string
+	}{
+		{"TestWrongPassword", "jens", "wrong"},
+		{"TestUnknownUser", "unknown", "secret"},
+		{"TestDisabledUser", "disabled", "secret"},
+		{"TestExpiredUser", "expired", "secret"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := a.AuthenticateIdentity(ctx, tt.user, tt.pass)
+			assert.True(t, errors.Is(err, registry.ErrInvalidCredentials), "error = %v", err)
+		})
+	}
+
+	_, err = a.AuthenticateIdentity(ctx, "unknown", "secret")
+	assert.True(t, errors.Is(err, registry.ErrUnknownUser))
+
+	// A changed password is used right away
+	assert.NoError(t, store.SetPassword(ctx, "jens", "changed"))
+	_, err = a.AuthenticateIdentity(ctx, "jens", "changed")
+	assert.NoError(t, err)
+
+	identity, err = a.LookupIdentity(ctx, "jens")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"developers"}, identity.Groups)
+	for _, subject := range []string{"unknown", "disabled", "expired"} {
+		_, err = a.LookupIdentity(ctx, subject)
+		assert.True(t, errors.Is(err, registry.ErrUnknownUser), subject)
+	}
+}
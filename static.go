@@ -0,0 +1,158 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// StaticUser is a user declared in a static users file.
+type StaticUser struct {
+	Username    string `yaml:"username" json:"username"`
+	DisplayName string `yaml:"display_name,omitempty" json:"display_name,omitempty"`
+	// Password is the password hash of the user, in one of the formats supported by VerifyPassword (bcrypt or argon2id are recommended).
+	Password string   `yaml:"password" json:"password"`
+	Groups   []string `yaml:"groups,omitempty" json:"groups,omitempty"`
+	Disabled bool     `yaml:"disabled,omitempty" json:"disabled,omitempty"`
+}
+
+// StaticUsers is the format of a static users file.
+//
+//	users:
+//	  - username: jens
+//	    password: $2a$10$...
+//	    groups: [developers]
+type StaticUsers struct {
+	Users []StaticUser `yaml:"users" json:"users"`
+}
+
+// ParseStaticUsers parses the contents of a static users file and validates it. JSON is parsed when isJSON is true, YAML otherwise.
+func ParseStaticUsers(data []byte, isJSON bool) (*StaticUsers, error) {
+	users := &StaticUsers{}
+	if err := unmarshalConfig(data, isJSON, users); err != nil {
+		return nil, err
+	}
+
+	if err := users.Validate(); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// Validate checks that every user has a unique username, a supported password hash and no empty groups.
+func (u *StaticUsers) Validate() error {
+	seen := make(map[string]bool, len(u.Users))
+	for i, user := range u.Users {
+		if user.Username == "" {
+			return fmt.Errorf("user %d has no username", i)
+		}
+
+		if seen[user.Username] {
+			return fmt.Errorf("user %s is declared more than once", user.Username)
+		}
+		seen[user.Username] = true
+
+		if err := checkPasswordHash(user.Password); err != nil {
+			return fmt.Errorf("user %s has an invalid password hash: %w", user.Username, err)
+		}
+
+		for _, group := range user.Groups {
+			if group == "" {
+				return fmt.Errorf("user %s has an empty group", user.Username)
+			}
+		}
+	}
+	return nil
+}
+
+// StaticAuthenticator is an authenticator for users declared in a YAML or JSON file, see StaticUsers for the format. The groups of the user are part of the returned identity. The file is loaded again when it changes on disk.
+type StaticAuthenticator struct {
+	reloader *fileReloader
+
+	mu    sync.RWMutex
+	users map[string]StaticUser
+}
+
+// NewStaticAuthenticator creates a new StaticAuthenticator for the users file at the given path. Files with a .json extension are parsed as JSON, others as YAML. If the file can not be loaded or is invalid, an error is returned.
+func NewStaticAuthenticator(path string) (*StaticAuthenticator, error) {
+	a := &StaticAuthenticator{}
+	a.reloader = newFileReloader(path, func(data []byte) error {
+		return a.load(data, isJSONPath(path))
+	})
+	if err := a.reloader.reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *StaticAuthenticator) load(data []byte, isJSON bool) error {
+	parsed, err := ParseStaticUsers(data, isJSON)
+	if err != nil {
+		return err
+	}
+
+	users := make(map[string]StaticUser, len(parsed.Users))
+	for _, user := range parsed.Users {
+		users[user.Username] = user
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.users = users
+	return nil
+}
+
+// Reload loads the users file if it has changed. This is done on every authentication as well, calling it is only needed to check for errors in the file. If the file can not be loaded, the previously loaded users are kept.
+func (a *StaticAuthenticator) Reload() error {
+	return a.reloader.reload()
+}
+
+// SetErrorLog sets the logger for failures to reload the users file on authentication. If nil, the standard logger of the log package is used.
+func (a *StaticAuthenticator) SetErrorLog(logger *log.Logger) {
+	a.reloader.setErrorLog(logger)
+}
+
+// AuthenticateIdentity authenticates the user against the users file. Disabled users can not authenticate. If the file can not be reloaded, the previously loaded users are used and the error is logged.
+func (a *StaticAuthenticator) AuthenticateIdentity(ctx context.Context, user string, pass string) (*Identity, error) {
+	a.reloader.refresh()
+
+	a.mu.RLock()
+	u, ok := a.users[user]
+	a.mu.RUnlock()
+
+	if !ok {
+		spendPasswordVerification(pass)
+		return nil, ErrUnknownUser
+	}
+
+	if valid, err := VerifyPassword(u.Password, pass); err != nil || !valid || u.Disabled {
+		return nil, ErrInvalidCredentials
+	}
+
+	return u.identity(), nil
+}
+
+// LookupIdentity returns the current identity of the user in the users file. Disabled users are not found.
+func (a *StaticAuthenticator) LookupIdentity(ctx context.Context, subject string) (*Identity, error) {
+	a.reloader.refresh()
+
+	a.mu.RLock()
+	u, ok := a.users[subject]
+	a.mu.RUnlock()
+
+	if !ok || u.Disabled {
+		return nil, ErrUnknownUser
+	}
+	return u.identity(), nil
+}
+
+func (u StaticUser) identity() *Identity {
+	return &Identity{
+		Subject:     u.Username,
+		DisplayName: u.DisplayName,
+		Groups:      append([]string(nil), u.Groups...),
+		Method:      AuthMethodPassword,
+	}
+}
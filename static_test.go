@@ -0,0 +1,121 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"path/filepath"
+	"testing"
+)
+
+const testStaticUsersYAML = `users:
+  - username: jens
+    display_name: Jens
+    password: $2a$10$J12IkNnVv6Cmm5KPzMrFL.ya4IB6Uz7.0C71unneN9.ikZW0Ot8M.
+    groups: [developers, admins]
+  - username: argon
+    password: $argon2id$v=19$m=8192,t=1,p=1$c29tZXNhbHRzb21lc2FsdA$wbG8ol8HdlikAcXtl+f/NSzCiQoFbRK7tS6+aougO5U
+  - username: disabled
+    password: $2a$10$J12IkNnVv6Cmm5KPzMrFL.ya4IB6Uz7.0C71unneN9.ikZW0Ot8M.
+    disabled: true
+`
+
+const testStaticUsersJSON = `{"users": [{"username": "jens", "password": "$2a$10$J12IkNnVv6Cmm5KPzMrFL.ya4IB6Uz7.0C71unneN9.ikZW0Ot8M.", "groups": ["developers"]}]}`
+
+func TestParseStaticUsers(t *testing.T) {
+	users, err := ParseStaticUsers([]byte(testStaticUsersYAML), false)
+	assert.NoError(t, err)
+	assert.Len(t, users.Users, 3)
+	assert.Equal(t, []string{"developers", "admins"}, users.Users[0].Groups)
+	assert.True(t, users.Users[2].Disabled)
+
+	users, err = ParseStaticUsers([]byte(testStaticUsersJSON), true)
+	assert.NoError(t, err)
+	assert.Len(t, users.Users, 1)
+
+	users, err = ParseStaticUsers([]byte(""), false)
+	assert.NoError(t, err)
+	assert.Empty(t, users.Users)
+
+	invalid := []string{
+		"users:\n  - password: $2a$10$J12IkNnVv6Cmm5KPzMrFL.ya4IB6Uz7.0C71unneN9.ikZW0Ot8M.\n",
+		"users:\n  - username: jens\n    password: secret\n",
+		"users:\n  - username: jens\n    password: $2a$10$invalid\n",
+		"users:\n  - username: jens\n    password: $argon2id$v=19$m=8192,t=0,p=1$c29tZXNhbHRzb21lc2FsdA$wbG8ol8HdlikAcXtl+f/NSzCiQoFbRK7tS6+aougO5U\n",
+		"users:\n  - username: jens\n    password: '{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ='\n  - username: jens\n    password: '{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ='\n",
+		"users:\n  - username: jens\n    password: '{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ='\n    groups: ['']\n",
+		"users:\n  - username: jens\n    passwd: '{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ='\n",
+	}
+	for _, data := range invalid {
+		_, err := ParseStaticUsers([]byte(data), false)
+		assert.Error(t, err, data)
+	}
+}
+
+func TestStaticAuthenticator(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.yaml")
+	writeTestFile(t, path, testStaticUsersYAML)
+
+	a, err := NewStaticAuthenticator(path)
+	assert.NoError(t, err)
+
+	identity, err := a.AuthenticateIdentity(context.Background(), "jens", "secret")
+	assert.NoError(t, err)
+	assert.Equal(t, "jens", identity.Subject)
+	assert.Equal(t, "Jens", identity.DisplayName)
+	assert.True(t, identity.HasGroup("admins"))
+
+	_, err = a.AuthenticateIdentity(context.Background(), "argon", "secret")
+	assert.NoError(t, err)
+
+	for _, user := range []string{"disabled", "unknown"} {
+		_, err = a.AuthenticateIdentity(context.Background(), user, "secret")
+		assert.True(t, errors.Is(err, ErrInvalidCredentials))
+	}
+
+	_, err = a.AuthenticateIdentity(context.Background(), "jens", "wrong")
+	assert.True(t, errors.Is(err, ErrInvalidCredentials))
+
+	// The file is loaded again when it changes, invalid files keep the previous users and are logged
+	var logs bytes.Buffer
+	a.SetErrorLog(log.New(&logs, "", 0))
+	writeTestFile(t, path, "users:\n  - username: jens\n")
+	_, err = a.AuthenticateIdentity(context.Background(), "argon", "secret")
+	assert.NoError(t, err)
+	assert.Contains(t, logs.String(), "jens")
+	assert.Error(t, a.Reload())
+
+	writeTestFile(t, path, testStaticUsersJSON)
+	_, err = a.AuthenticateIdentity(context.Background(), "argon", "secret")
+	assert.Error(t, err)
+}
+
+func TestStaticAuthenticator_LookupIdentity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.yaml")
+	writeTestFile(t, path, testStaticUsersYAML)
+	a, err := NewStaticAuthenticator(path)
+	assert.NoError(t, err)
+
+	identity, err := a.LookupIdentity(context.Background(), "jens")
+	assert.NoError(t, err)
+	assert.True(t, identity.HasGroup("admins"))
+
+	for _, subject := range []string{"disabled", "unknown"} {
+		_, err = a.LookupIdentity(context.Background(), subject)
+		assert.True(t, errors.Is(err, ErrUnknownUser), subject)
+	}
+}
+
+func TestStaticAuthenticatorJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	writeTestFile(t, path, testStaticUsersJSON)
+
+	a, err := NewStaticAuthenticator(path)
+	assert.NoError(t, err)
+
+	identity, err := a.AuthenticateIdentity(context.Background(), "jens", "secret")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"developers"}, identity.Groups)
+}
@@ -0,0 +1,351 @@
+package registry
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNoTOTPSecret is returned by a TOTPStore when the user has no TOTP secret.
+var ErrNoTOTPSecret = errors.New("no totp secret")
+
+// TOTPOptions contains the parameters of RFC 6238 time-based one-time passwords. The defaults are the ones authenticator apps assume.
+type TOTPOptions struct {
+	// Digits is the number of digits of a code, at most 9. Defaults to 6.
+	Digits int
+	// Period is how long a code is valid, a whole number of seconds. Defaults to 30 seconds.
+	Period time.Duration
+	// Algorithm is the HMAC algorithm, SHA1, SHA256 or SHA512. Defaults to SHA1.
+	Algorithm string
+	// Skew is the number of periods before and after the current one whose codes are accepted as well. Defaults to 1, negative disables it.
+	Skew int
+}
+
+// withDefaults fills in the defaults and validates the options.
+func (o TOTPOptions) withDefaults() (TOTPOptions, error) {
+	if o.Digits == 0 {
+		o.Digits = 6
+	}
+	if o.Period == 0 {
+		o.Period = 30 * time.Second
+	}
+	if o.Algorithm == "" {
+		o.Algorithm = "SHA1"
+	}
+	if o.Skew == 0 {
+		o.Skew = 1
+	} else if o.Skew < 0 {
+		o.Skew = 0
+	}
+
+	if o.Digits < 1 || o.Digits > 9 {
+		return o, fmt.Errorf("totp codes must have 1 to 9 digits")
+	}
+	// Codes are computed from Unix time in whole seconds, and authenticator apps only support whole seconds.
+	if o.Period < time.Second || o.Period%time.Second != 0 {
+		return o, fmt.Errorf("totp period must be a whole number of seconds")
+	}
+	if _, err := o.hash(); err != nil {
+		return o, err
+	}
+	return o, nil
+}
+
+func (o TOTPOptions) hash() (func() hash.Hash, error) {
+	switch strings.ToUpper(o.Algorithm) {
+	case "SHA1":
+		return sha1.New, nil
+	case "SHA256":
+		return sha256.New, nil
+	case "SHA512":
+		return sha512.New, nil
+	default:
+		return nil, fmt.Errorf("unsupported totp algorithm %s", o.Algorithm)
+	}
+}
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret generates a random 160 bit TOTP secret, encoded as unpadded base32 like authenticator apps expect.
+func GenerateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// TOTPURI returns the otpauth URI for the secret, which authenticator apps import by scanning it as QR code. Invalid options are an error.
+func TOTPURI(secret, issuer, account string, options TOTPOptions) (string, error) {
+	options, err := options.withDefaults()
+	if err != nil {
+		return "", err
+	}
+	query := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {strings.ToUpper(options.Algorithm)},
+		"digits":    {strconv.Itoa(options.Digits)},
+		"period":    {strconv.Itoa(int(options.Period / time.Second))},
+	}
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + query.Encode(), nil
+}
+
+// TOTPCode returns the code of the secret at the given time.
+func TOTPCode(secret string, t time.Time, options TOTPOptions) (string, error) {
+	options, err := options.withDefaults()
+	if err != nil {
+		return "", err
+	}
+	return totpCode(secret, t.Unix()/int64(options.Period/time.Second), options)
+}
+
+// VerifyTOTP checks if the code is a valid code of the secret at the given time, allowing the configured skew.
+func VerifyTOTP(secret, code string, t time.Time, options TOTPOptions) (bool, error) {
+	options, err := options.withDefaults()
+	if err != nil {
+		return false, err
+	}
+	_, ok, err := verifyTOTPStep(secret, code, t, options)
+	return ok, err
+}
+
+// verifyTOTPStep verifies the code and returns the time step it belongs to, so a code can not be used twice.
+func verifyTOTPStep(secret, code string, t time.Time, options TOTPOptions) (int64, bool, error) {
+	if len(code) != options.Digits {
+		return 0, false, nil
+	}
+
+	current := t.Unix() / int64(options.Period/time.Second)
+	for step := current - int64(options.Skew); step <= current+int64(options.Skew); step++ {
+		expected, err := totpCode(secret, step, options)
+		if err != nil {
+			return 0, false, err
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+func totpCode(secret string, step int64, options TOTPOptions) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimRight(strings.ReplaceAll(secret, " ", ""), "=")))
+	if err != nil {
+		return "", fmt.Errorf("invalid totp secret: %w", err)
+	}
+	newHash, err := options.hash()
+	if err != nil {
+		return "", err
+	}
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(newHash, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation, see RFC 4226 section 5.3
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	modulo := uint32(1)
+	for i := 0; i < options.Digits; i++ {
+		modulo *= 10
+	}
+	return fmt.Sprintf("%0*d", options.Digits, value%modulo), nil
+}
+
+// TOTPStore stores the TOTP secrets of users. Unlike passwords the secrets can not be hashed, as they are needed to compute the codes.
+type TOTPStore interface {
+	// TOTPSecret returns the secret of the user, or ErrNoTOTPSecret if the user has none.
+	TOTPSecret(ctx context.Context, user string) (string, error)
+}
+
+// InMemoryTOTPStore is a TOTPStore keeping the secrets in memory.
+type InMemoryTOTPStore struct {
+	mu      sync.RWMutex
+	secrets map[string]string
+}
+
+// NewInMemoryTOTPStore creates a new InMemoryTOTPStore.
+func NewInMemoryTOTPStore() *InMemoryTOTPStore {
+	return &InMemoryTOTPStore{secrets: make(map[string]string)}
+}
+
+// SetTOTPSecret sets the secret of the user.
+func (s *InMemoryTOTPStore) SetTOTPSecret(user, secret string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.secrets[user] = secret
+}
+
+// DeleteTOTPSecret deletes the secret of the user.
+func (s *InMemoryTOTPStore) DeleteTOTPSecret(user string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.secrets, user)
+}
+
+func (s *InMemoryTOTPStore) TOTPSecret(ctx context.Context, user string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	secret, ok := s.secrets[user]
+	if !ok {
+		return "", ErrNoTOTPSecret
+	}
+	return secret, nil
+}
+
+// TOTPAuthenticatorOptions contains the options for a TOTPAuthenticator.
+type TOTPAuthenticatorOptions struct {
+	// Store holds the TOTP secrets of the users, required.
+	Store TOTPStore
+	// Groups are the groups whose members need a second factor, members without a secret can not log in until they enroll one. If empty, every user with a secret needs one.
+	Groups []string
+	// Header is the request header the code can be passed in, instead of appending it to the password. Defaults to X-Registry-OTP.
+	Header string
+	TOTPOptions
+}
+
+// TOTPAuthenticator is an authenticator adding a TOTP second factor to password logins of another authenticator. The code is appended to the password, as password+123456, or passed in a header. The password is checked before the code, so the code is only verified for valid passwords. Identities that are not authenticated with a password, like access tokens, do not need a second factor. The identity of a user that passed the second factor has the mfa attribute set to totp.
+type TOTPAuthenticator struct {
+	next    IdentityAuthenticator
+	options TOTPAuthenticatorOptions
+	now     func() time.Time
+
+	mu       sync.Mutex
+	lastStep map[string]int64
+}
+
+// NewTOTPAuthenticator creates a new TOTPAuthenticator over the given authenticator.
+func NewTOTPAuthenticator(next IdentityAuthenticator, options TOTPAuthenticatorOptions) (*TOTPAuthenticator, error) {
+	if next == nil {
+		return nil, fmt.Errorf("totp authenticator has no authenticator")
+	}
+	if options.Store == nil {
+		return nil, fmt.Errorf("totp authenticator has no store")
+	}
+	if options.Header == "" {
+		options.Header = "X-Registry-OTP"
+	}
+	totpOptions, err := options.TOTPOptions.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	options.TOTPOptions = totpOptions
+
+	return &TOTPAuthenticator{
+		next:     next,
+		options:  options,
+		now:      time.Now,
+		lastStep: make(map[string]int64),
+	}, nil
+}
+
+// AuthenticateIdentity authenticates the user with the next authenticator, and verifies the code if the user needs a second factor or passed one. Missing and invalid codes are rejected with ErrInvalidCredentials, without telling why, so the response does not reveal that the password was right.
+func (a *TOTPAuthenticator) AuthenticateIdentity(ctx context.Context, user string, pass string) (*Identity, error) {
+	secret, err := a.options.Store.TOTPSecret(ctx, user)
+	if errors.Is(err, ErrNoTOTPSecret) {
+		secret = ""
+	} else if err != nil {
+		return nil, ErrUnknown.WithCause(fmt.Errorf("totp: %w", err))
+	}
+
+	var code string
+	if md, ok := RequestMetadataFromContext(ctx); ok {
+		code = md.Header.Get(a.options.Header)
+	}
+	// The code is only split off the password of users with a secret, so passwords of other users may end in +digits
+	if code == "" && secret != "" {
+		pass, code = a.splitCode(pass)
+	}
+
+	identity, err := a.next.AuthenticateIdentity(ctx, user, pass)
+	if err != nil {
+		return nil, err
+	}
+	// Codes of users that do not need a second factor are verified when they have a secret, and ignored otherwise
+	if identity.Method != AuthMethodPassword || (!a.required(identity, secret) && (code == "" || secret == "")) {
+		return identity, nil
+	}
+
+	if secret == "" || code == "" {
+		return nil, ErrInvalidCredentials
+	}
+	if err := a.verify(user, secret, code); err != nil {
+		return nil, err
+	}
+
+	identity = identity.Clone()
+	if identity.Attributes == nil {
+		identity.Attributes = make(map[string]string)
+	}
+	identity.Attributes["mfa"] = "totp"
+	return identity, nil
+}
+
+// LookupIdentity looks up the current identity of the user with the next authenticator, see IdentityLookup. The second factor is checked when the refresh token is issued, so lookups do not need a code.
+func (a *TOTPAuthenticator) LookupIdentity(ctx context.Context, subject string) (*Identity, error) {
+	return lookupIdentity(ctx, a.next, subject)
+}
+
+// splitCode splits a password of the form password+123456 into the password and the code.
+func (a *TOTPAuthenticator) splitCode(pass string) (string, string) {
+	i := len(pass) - a.options.Digits - 1
+	if i < 0 || pass[i] != '+' {
+		return pass, ""
+	}
+	for _, c := range pass[i+1:] {
+		if c < '0' || c > '9' {
+			return pass, ""
+		}
+	}
+	return pass[:i], pass[i+1:]
+}
+
+// required checks if the identity needs a second factor.
+func (a *TOTPAuthenticator) required(identity *Identity, secret string) bool {
+	if len(a.options.Groups) == 0 {
+		return secret != ""
+	}
+	for _, group := range a.options.Groups {
+		if identity.HasGroup(group) {
+			return true
+		}
+	}
+	return false
+}
+
+// verify verifies the code, rejecting codes of a time step that was already used by the user.
+func (a *TOTPAuthenticator) verify(user, secret, code string) error {
+	step, ok, err := verifyTOTPStep(secret, code, a.now(), a.options.TOTPOptions)
+	if err != nil {
+		return ErrUnknown.WithCause(fmt.Errorf("totp: %w", err))
+	}
+	if !ok {
+		return ErrInvalidCredentials
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if last, ok := a.lastStep[user]; ok && step <= last {
+		return ErrInvalidCredentials
+	}
+	a.lastStep[user] = step
+	return nil
+}
@@ -0,0 +1,208 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// Test vectors of RFC 6238 appendix B, with the ASCII secrets encoded as base32
+	tests := []struct {
+		algorithm string
+		secret    string
+		unix      int64
+		want      string
+	}{
+		{"SHA1", "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ", 59, "94287082"},
+		{"SHA1", "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ", 1111111109, "07081804"},
+		{"SHA256", "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQGEZA", 59, "46119246"},
+		{"SHA256", "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQGEZA", 20000000000, "77737706"},
+		{"SHA512", "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQGEZDGNA", 59, "90693936"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			options := TOTPOptions{Digits: 8, Algorithm: tt.algorithm}
+			got, err := TOTPCode(tt.secret, time.Unix(tt.unix, 0), options)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	_, err := TOTPCode("not base32!", time.Now(), TOTPOptions{})
+	assert.Error(t, err)
+	_, err = TOTPCode("GEZDGNBVGY3TQOJQ", time.Now(), TOTPOptions{Algorithm: "MD5"})
+	assert.Error(t, err)
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	assert.NoError(t, err)
+	assert.Len(t, secret, 32)
+
+	now := time.Unix(1700000000, 0)
+	code, err := TOTPCode(secret, now, TOTPOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, code, 6)
+
+	for _, tt := range []struct {
+		offset time.Duration
+		skew   int
+		want   bool
+	}{
+		{0, -1, true},
+		{30 * time.Second, -1, false},
+		{30 * time.Second, 1, true},
+		{-30 * time.Second, 1, true},
+		{90 * time.Second, 1, false},
+	} {
+		ok, err := VerifyTOTP(secret, code, now.Add(tt.offset), TOTPOptions{Skew: tt.skew})
+		assert.NoError(t, err)
+		assert.Equal(t, tt.want, ok, "offset %s skew %d", tt.offset, tt.skew)
+	}
+
+	ok, _ := VerifyTOTP(secret, code[:5], now, TOTPOptions{})
+	assert.False(t, ok)
+}
+
+func TestTOTPOptionsInvalid(t *testing.T) {
+	for _, options := range []TOTPOptions{
+		{Digits: -1},
+		{Digits: 10},
+		{Period: -time.Second},
+		{Period: 500 * time.Millisecond},
+		{Period: 1500 * time.Millisecond},
+		{Algorithm: "MD5"},
+	} {
+		_, err := TOTPCode("JBSWY3DPEHPK3PXP", time.Now(), options)
+		assert.Error(t, err, "%+v", options)
+		_, err = VerifyTOTP("JBSWY3DPEHPK3PXP", "123456", time.Now(), options)
+		assert.Error(t, err, "%+v", options)
+		_, err = TOTPURI("JBSWY3DPEHPK3PXP", "ACME Registry", "jens", options)
+		assert.Error(t, err, "%+v", options)
+		_, err = NewTOTPAuthenticator(NewDummyAuthenticator(), TOTPAuthenticatorOptions{Store: NewInMemoryTOTPStore(), TOTPOptions: options})
+		assert.Error(t, err, "%+v", options)
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	raw, err := TOTPURI("JBSWY3DPEHPK3PXP", "ACME Registry", "jens@example.com", TOTPOptions{})
+	assert.NoError(t, err)
+	uri, err := url.Parse(raw)
+	assert.NoError(t, err)
+	assert.Equal(t, "otpauth", uri.Scheme)
+	assert.Equal(t, "totp", uri.Host)
+	assert.Equal(t, "/ACME Registry:jens@example.com", uri.Path)
+	assert.Equal(t, url.Values{
+		"secret":    {"JBSWY3DPEHPK3PXP"},
+		"issuer":    {"ACME Registry"},
+		"algorithm": {"SHA1"},
+		"digits":    {"6"},
+		"period":    {"30"},
+	}, uri.Query())
+}
+
+func newTestTOTPAuthenticator(t *testing.T, groups ...string) (*TOTPAuthenticator, *time.Time) {
+	store := NewInMemoryTOTPStore()
+	store.SetTOTPSecret("jens", "JBSWY3DPEHPK3PXP")
+	store.SetTOTPSecret("alice", "KRSXG5CTMVRXEZLU")
+
+	next, err := NewChainAuthenticator(ChainFirstSuccess,
+		ChainBackend{Name: "humans", Authenticator: &chainTestBackend{user: "jens", pass: "secret", groups: []string{"pushers"}}},
+		ChainBackend{Name: "readers", Authenticator: &chainTestBackend{user: "alice", pass: "secret+123456"}},
+		ChainBackend{Name: "robots", Authenticator: &chainTestBackend{user: "ci", pass: "robot", groups: []string{"pushers"}}},
+	)
+	assert.NoError(t, err)
+
+	a, err := NewTOTPAuthenticator(next, TOTPAuthenticatorOptions{Store: store, Groups: groups})
+	assert.NoError(t, err)
+	now := time.Unix(1700000000, 0)
+	a.now = func() time.Time { return now }
+	return a, &now
+}
+
+func TestTOTPAuthenticator(t *testing.T) {
+	a, now := newTestTOTPAuthenticator(t)
+	code, err := TOTPCode("JBSWY3DPEHPK3PXP", *now, TOTPOptions{})
+	assert.NoError(t, err)
+
+	identity, err := a.AuthenticateIdentity(context.Background(), "jens", "secret+"+code)
+	assert.NoError(t, err)
+	assert.Equal(t, "totp", identity.Attribute("mfa"))
+
+	// A code can be used once
+	_, err = a.AuthenticateIdentity(context.Background(), "jens", "secret+"+code)
+	assert.True(t, errors.Is(err, ErrInvalidCredentials))
+
+	*now = now.Add(30 * time.Second)
+	code, _ = TOTPCode("JBSWY3DPEHPK3PXP", *now, TOTPOptions{})
+
+	tests := []struct {
+		name string
+		user string
+		pass string
+	}{
+		{"TestNoCode", "jens", "secret"},
+		{"TestWrongCode", "jens", "secret+000000"},
+		{"TestWrongPassword", "jens", "wrong+" + code},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := a.AuthenticateIdentity(context.Background(), tt.user, tt.pass)
+			// Failures of the second factor can not be told apart from a wrong password
+			assert.Equal(t, ErrInvalidCredentials, err)
+		})
+	}
+
+	// The code can be passed in a header as well
+	ctx := WithRequestMetadata(context.Background(), &RequestMetadata{Header: http.Header{"X-Registry-Otp": {code}}})
+	identity, err = a.AuthenticateIdentity(ctx, "jens", "secret")
+	assert.NoError(t, err)
+	assert.Equal(t, "totp", identity.Attribute("mfa"))
+
+	// Users without a secret do not need a second factor
+	identity, err = a.AuthenticateIdentity(context.Background(), "ci", "robot")
+	assert.NoError(t, err)
+	assert.Equal(t, "", identity.Attribute("mfa"))
+}
+
+func TestTOTPAuthenticator_Groups(t *testing.T) {
+	a, now := newTestTOTPAuthenticator(t, "pushers")
+
+	// Members of the groups need a second factor, even without a secret
+	_, err := a.AuthenticateIdentity(context.Background(), "ci", "robot")
+	assert.True(t, errors.Is(err, ErrInvalidCredentials))
+
+	_, err = a.AuthenticateIdentity(context.Background(), "jens", "secret")
+	assert.True(t, errors.Is(err, ErrInvalidCredentials))
+
+	// Other users with a secret do not either, but the code is still split off their password and verified
+	_, err = a.AuthenticateIdentity(context.Background(), "alice", "secret+123456")
+	assert.True(t, errors.Is(err, ErrInvalidCredentials), "error = %v", err)
+	code, _ := TOTPCode("KRSXG5CTMVRXEZLU", *now, TOTPOptions{})
+	identity, err := a.AuthenticateIdentity(context.Background(), "alice", "secret+123456+"+code)
+	assert.NoError(t, err)
+	assert.Equal(t, "totp", identity.Attribute("mfa"))
+}
+
+func TestTOTPAuthenticator_AccessTokens(t *testing.T) {
+	a, _ := newTestTOTPAuthenticator(t, "pushers")
+	manager := NewAccessTokenManager(NewInMemoryAccessTokenStore())
+	token, err := manager.Issue(context.Background(), &AccessToken{Name: "ci", Subject: "jens", Groups: []string{"pushers"}})
+	assert.NoError(t, err)
+
+	// Access tokens are not interactive logins, so they do not need a second factor
+	tokens, err := NewTOTPAuthenticator(NewAccessTokenAuthenticator(manager, a.next, newMockAuthenticator("jens", "secret")), a.options)
+	assert.NoError(t, err)
+	identity, err := tokens.AuthenticateIdentity(context.Background(), "jens", token)
+	assert.NoError(t, err)
+	assert.Equal(t, AuthMethodAccessToken, identity.Method)
+
+	_, err = NewTOTPAuthenticator(a.next, TOTPAuthenticatorOptions{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,213 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// WebhookOptions contains the options for a WebhookAuthenticator.
+type WebhookOptions struct {
+	// URL is the URL the credentials are posted to, required.
+	URL string
+	// Header contains extra headers sent with every request, like an Authorization header authenticating the registry with the service.
+	Header http.Header
+	// Timeout is the timeout of a single attempt. Defaults to 5 seconds.
+	Timeout time.Duration
+	// Retries is the number of times a request is retried when the service can not be reached or responds with a 429 or 5xx status. Defaults to no retries.
+	Retries int
+	// RetryBackoff is the delay before the first retry, which doubles for every next retry. Defaults to 100 milliseconds.
+	RetryBackoff time.Duration
+	// CAFile is a PEM file with the CAs used to verify the certificate of the service. Defaults to the system roots.
+	CAFile string
+	// ClientCertFile and ClientKeyFile are the PEM encoded certificate and key used to authenticate with the service over mTLS.
+	ClientCertFile string
+	ClientKeyFile  string
+	// HTTPClient is used to call the service, the TLS options are ignored if it is set.
+	HTTPClient *http.Client
+}
+
+// WebhookRequest is the JSON body posted to the service of a WebhookAuthenticator.
+type WebhookRequest struct {
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+	IP        string `json:"ip,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+}
+
+// WebhookResponse is the JSON body the service of a WebhookAuthenticator responds with, with a 200 status. A 401 or 403 status is taken as a failed authentication as well, whatever the body.
+type WebhookResponse struct {
+	// Authenticated is true if the credentials are valid.
+	Authenticated bool `json:"authenticated"`
+	// UnknownUser is true if the user does not exist, so a ChainAuthenticator can try its next backend.
+	UnknownUser bool `json:"unknown_user,omitempty"`
+	// Reason is the reason the authentication failed. It is sent to the client as detail of the error.
+	Reason string `json:"reason,omitempty"`
+	// Subject is the subject of the identity. Defaults to the username.
+	Subject     string            `json:"subject,omitempty"`
+	DisplayName string            `json:"display_name,omitempty"`
+	Groups      []string          `json:"groups,omitempty"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+}
+
+// WebhookAuthenticator is an authenticator delegating to an external HTTP service. The credentials and the RequestMetadata of the request are posted to the service as a WebhookRequest, and the WebhookResponse it responds with is mapped into the identity.
+type WebhookAuthenticator struct {
+	options WebhookOptions
+	sleep   func(ctx context.Context, d time.Duration) error
+}
+
+// NewWebhookAuthenticator creates a new WebhookAuthenticator with the given options. If the TLS files can not be loaded, an error is returned.
+func NewWebhookAuthenticator(options WebhookOptions) (*WebhookAuthenticator, error) {
+	if options.URL == "" {
+		return nil, fmt.Errorf("webhook authenticator has no url")
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = 5 * time.Second
+	}
+	if options.Retries < 0 {
+		options.Retries = 0
+	}
+	if options.RetryBackoff <= 0 {
+		options.RetryBackoff = 100 * time.Millisecond
+	}
+
+	if options.HTTPClient == nil {
+		tlsConfig, err := webhookTLSConfig(options)
+		if err != nil {
+			return nil, err
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		options.HTTPClient = &http.Client{Transport: transport}
+	}
+
+	return &WebhookAuthenticator{options: options, sleep: sleepContext}, nil
+}
+
+func webhookTLSConfig(options WebhookOptions) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if options.CAFile != "" {
+		pool, err := LoadCertificatePool(options.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+
+	if options.ClientCertFile != "" || options.ClientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(options.ClientCertFile, options.ClientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// AuthenticateIdentity authenticates the user with the service. Failures to reach the service, after retrying, are returned as ErrUnknown.
+func (a *WebhookAuthenticator) AuthenticateIdentity(ctx context.Context, user string, pass string) (*Identity, error) {
+	body := WebhookRequest{Username: user, Password: pass}
+	if md, ok := RequestMetadataFromContext(ctx); ok {
+		body.IP = md.IP
+		body.UserAgent = md.UserAgent
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, ErrUnknown.WithCause(fmt.Errorf("webhook: %w", err))
+	}
+
+	var resp *WebhookResponse
+	backoff := a.options.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		var retry bool
+		resp, retry, err = a.post(ctx, data)
+		if err == nil || !retry || attempt >= a.options.Retries {
+			break
+		}
+
+		if err := a.sleep(ctx, backoff); err != nil {
+			return nil, ErrUnknown.WithCause(fmt.Errorf("webhook: %w", err))
+		}
+		backoff *= 2
+	}
+	if err != nil {
+		return nil, ErrUnknown.WithCause(fmt.Errorf("webhook: %w", err))
+	}
+
+	if !resp.Authenticated {
+		if resp.UnknownUser {
+			return nil, ErrUnknownUser
+		}
+		if resp.Reason != "" {
+			return nil, ErrInvalidCredentials.WithDetail(resp.Reason)
+		}
+		return nil, ErrInvalidCredentials
+	}
+
+	subject := resp.Subject
+	if subject == "" {
+		subject = user
+	}
+	return &Identity{
+		Subject:     subject,
+		DisplayName: resp.DisplayName,
+		Groups:      resp.Groups,
+		Attributes:  resp.Attributes,
+		Method:      AuthMethodPassword,
+	}, nil
+}
+
+// post posts the request to the service once. If it fails, retry tells if the request may succeed when it is retried.
+func (a *WebhookAuthenticator) post(ctx context.Context, data []byte) (resp *WebhookResponse, retry bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, a.options.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.options.URL, bytes.NewReader(data))
+	if err != nil {
+		return nil, false, err
+	}
+	for name, values := range a.options.Header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	httpResp, err := a.options.HTTPClient.Do(req)
+	if err != nil {
+		return nil, true, err
+	}
+	defer httpResp.Body.Close()
+
+	switch {
+	case httpResp.StatusCode == http.StatusUnauthorized || httpResp.StatusCode == http.StatusForbidden:
+		return &WebhookResponse{}, false, nil
+	case httpResp.StatusCode == http.StatusTooManyRequests || httpResp.StatusCode >= 500:
+		return nil, true, fmt.Errorf("POST %s: %s", a.options.URL, httpResp.Status)
+	case httpResp.StatusCode != http.StatusOK:
+		return nil, false, fmt.Errorf("POST %s: %s", a.options.URL, httpResp.Status)
+	}
+
+	resp = &WebhookResponse{}
+	if err := json.NewDecoder(io.LimitReader(httpResp.Body, 1<<20)).Decode(resp); err != nil {
+		return nil, false, err
+	}
+	return resp, false, nil
+}
+
+// sleepContext sleeps for the duration, or until the context is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,229 @@
+package registry
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testWebhook is an httptest stand-in for a webhook service, knowing the user jens with password secret, who can also log in with the email address jens@example.com. The first failures requests are answered with a 503 status.
+type testWebhook struct {
+	server *httptest.Server
+
+	mu       sync.Mutex
+	requests []WebhookRequest
+	failures int
+	delay    time.Duration
+}
+
+func newTestWebhook(t *testing.T) *testWebhook {
+	w := &testWebhook{}
+	w.server = httptest.NewUnstartedServer(http.HandlerFunc(w.serveHTTP))
+	t.Cleanup(w.server.Close)
+	return w
+}
+
+func (w *testWebhook) serveHTTP(rw http.ResponseWriter, r *http.Request) {
+	var req WebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || r.Header.Get("Authorization") != "Bearer registry" {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	w.mu.Lock()
+	w.requests = append(w.requests, req)
+	fail := w.failures > 0
+	w.failures--
+	delay := w.delay
+	w.mu.Unlock()
+
+	time.Sleep(delay)
+	switch {
+	case fail:
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	case req.Username == "blocked":
+		rw.WriteHeader(http.StatusForbidden)
+	case req.Username == "jens@example.com" && req.Password == "secret":
+		writeJSON(rw, http.StatusOK, WebhookResponse{Authenticated: true, Subject: "jens"})
+	case req.Username != "jens":
+		writeJSON(rw, http.StatusOK, WebhookResponse{UnknownUser: true})
+	case req.Password != "secret":
+		writeJSON(rw, http.StatusOK, WebhookResponse{Reason: "password expired"})
+	default:
+		writeJSON(rw, http.StatusOK, WebhookResponse{
+			Authenticated: true,
+			DisplayName:   "Jens",
+			Groups:        []string{"developers"},
+			Attributes:    map[string]string{"department": "platform"},
+		})
+	}
+}
+
+func (w *testWebhook) calls() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.requests)
+}
+
+func newTestWebhookAuthenticator(t *testing.T, options WebhookOptions) *WebhookAuthenticator {
+	options.Header = http.Header{"Authorization": {"Bearer registry"}}
+	a, err := NewWebhookAuthenticator(options)
+	assert.NoError(t, err)
+	a.sleep = func(ctx context.Context, d time.Duration) error { return nil }
+	return a
+}
+
+func TestWebhookAuthenticator(t *testing.T) {
+	w := newTestWebhook(t)
+	w.server.Start()
+	a := newTestWebhookAuthenticator(t, WebhookOptions{URL: w.server.URL})
+
+	ctx := WithRequestMetadata(context.Background(), &RequestMetadata{IP: "192.0.2.1", UserAgent: "docker/24.0"})
+	identity, err := a.AuthenticateIdentity(ctx, "jens", "secret")
+	assert.NoError(t, err)
+	assert.Equal(t, "jens", identity.Subject)
+	assert.Equal(t, "Jens", identity.DisplayName)
+	assert.True(t, identity.HasGroup("developers"))
+	assert.Equal(t, "platform", identity.Attribute("department"))
+	assert.Equal(t, WebhookRequest{Username: "jens", Password: "secret", IP: "192.0.2.1", UserAgent: "docker/24.0"}, w.requests[0])
+
+	var e *Error
+	_, err = a.AuthenticateIdentity(ctx, "jens", "wrong")
+	assert.True(t, errors.As(err, &e))
+	assert.True(t, errors.Is(err, ErrInvalidCredentials))
+	assert.Equal(t, "password expired", e.Detail)
+
+	_, err = a.AuthenticateIdentity(ctx, "blocked", "secret")
+	assert.True(t, errors.Is(err, ErrInvalidCredentials))
+	assert.False(t, errors.Is(err, ErrUnknownUser))
+
+	_, err = a.AuthenticateIdentity(ctx, "alice", "secret")
+	assert.True(t, errors.Is(err, ErrUnknownUser))
+
+	identity, err = a.AuthenticateIdentity(ctx, "jens@example.com", "secret")
+	assert.NoError(t, err)
+	assert.Equal(t, "jens", identity.Subject)
+}
+
+func TestTokenHandler_WebhookSubject(t *testing.T) {
+	w := newTestWebhook(t)
+	w.server.Start()
+	h := newTestTokenHandler(t, NewDummyAuthorizer())
+	h.authenticator = newTestWebhookAuthenticator(t, WebhookOptions{URL: w.server.URL})
+
+	// The token is issued to the subject returned by the webhook, not to the username
+	req := httptest.NewRequest(http.MethodGet, "/?account=jens@example.com&service=registry&client_id=docker&offline_token=true", nil)
+	req.SetBasicAuth("jens@example.com", "secret")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	body, tok := decodeToken(t, rec)
+	assert.Equal(t, "jens", tok.Claims.Subject)
+
+	// So is the refresh token
+	info, err := h.options.RefreshTokens.Validate(context.Background(), body["refresh_token"].(string), &AuthorizationRequest{Service: "registry", ClientId: "docker"})
+	assert.NoError(t, err)
+	assert.Equal(t, "jens", info.Account)
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, newFormRequest(url.Values{
+		"grant_type": {"password"},
+		"username":   {"jens@example.com"},
+		"password":   {"secret"},
+		"service":    {"registry"},
+		"client_id":  {"docker"},
+	}))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	_, tok = decodeToken(t, rec)
+	assert.Equal(t, "jens", tok.Claims.Subject)
+}
+
+func TestWebhookAuthenticator_Retries(t *testing.T) {
+	w := newTestWebhook(t)
+	w.server.Start()
+	a := newTestWebhookAuthenticator(t, WebhookOptions{URL: w.server.URL, Retries: 2})
+
+	var delays []time.Duration
+	a.sleep = func(ctx context.Context, d time.Duration) error {
+		delays = append(delays, d)
+		return nil
+	}
+
+	w.failures = 2
+	_, err := a.AuthenticateIdentity(context.Background(), "jens", "secret")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, w.calls())
+	assert.Equal(t, []time.Duration{100 * time.Millisecond, 200 * time.Millisecond}, delays)
+
+	// Failed authentications are not retried
+	_, err = a.AuthenticateIdentity(context.Background(), "jens", "wrong")
+	assert.True(t, errors.Is(err, ErrInvalidCredentials))
+	assert.Equal(t, 4, w.calls())
+
+	w.failures = 3
+	_, err = a.AuthenticateIdentity(context.Background(), "jens", "secret")
+	assert.True(t, errors.Is(err, ErrUnknown))
+	assert.Equal(t, 7, w.calls())
+}
+
+func TestWebhookAuthenticator_Timeout(t *testing.T) {
+	w := newTestWebhook(t)
+	w.delay = 200 * time.Millisecond
+	w.server.Start()
+	a := newTestWebhookAuthenticator(t, WebhookOptions{URL: w.server.URL, Timeout: 20 * time.Millisecond, Retries: 1})
+
+	_, err := a.AuthenticateIdentity(context.Background(), "jens", "secret")
+	assert.True(t, errors.Is(err, ErrUnknown))
+	assert.Equal(t, 2, w.calls())
+}
+
+func TestWebhookAuthenticator_MutualTLS(t *testing.T) {
+	ca := newTestCA(t, "Webhook CA")
+	w := newTestWebhook(t)
+	w.server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: ca.pool()}
+	w.server.StartTLS()
+
+	dir := t.TempDir()
+	writePEM := func(name, blockType string, der []byte) string {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600))
+		return path
+	}
+
+	cert, key := ca.issueWithKey(t, nil)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.NoError(t, err)
+	options := WebhookOptions{
+		URL:            w.server.URL,
+		CAFile:         writePEM("ca.crt", "CERTIFICATE", w.server.Certificate().Raw),
+		ClientCertFile: writePEM("client.crt", "CERTIFICATE", cert.Raw),
+		ClientKeyFile:  writePEM("client.key", "PRIVATE KEY", keyDER),
+	}
+
+	a := newTestWebhookAuthenticator(t, options)
+	_, err = a.AuthenticateIdentity(context.Background(), "jens", "secret")
+	assert.NoError(t, err)
+
+	// Without a client certificate the handshake fails
+	options.ClientCertFile, options.ClientKeyFile = "", ""
+	a = newTestWebhookAuthenticator(t, options)
+	_, err = a.AuthenticateIdentity(context.Background(), "jens", "secret")
+	assert.True(t, errors.Is(err, ErrUnknown))
+
+	_, err = NewWebhookAuthenticator(WebhookOptions{URL: w.server.URL, ClientCertFile: "/does/not/exist"})
+	assert.Error(t, err)
+	_, err = NewWebhookAuthenticator(WebhookOptions{})
+	assert.Error(t, err)
+}